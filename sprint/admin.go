@@ -0,0 +1,267 @@
+package sprint
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"tuxpa.in/a/zlog/log"
+)
+
+var ErrSprintNotRunning = errors.New("sprint is not running")
+
+// default and maximum page size of AdminHandler progress listings
+const (
+	defaultProgressPageSize = 100
+	maxProgressPageSize     = 1000
+)
+
+// Status is a snapshot of sprint progress, see Sprint.Status
+type Status struct {
+	Active         bool             `json:"active"`
+	Paused         bool             `json:"paused"`
+	ChainHead      uint64           `json:"chain_head"`
+	SprintHead     int64            `json:"sprint_head"`
+	FinalizedBlock uint64           `json:"finalized_block"`
+	StageSize      uint64           `json:"stage_size"`
+	Lanes          map[string]int64 `json:"lanes"`
+	Validators     []int64          `json:"validators"`
+	// Number of tasks waiting in each queue
+	Queues     map[string]int  `json:"queues"`
+	BlockCache BlockCacheStats `json:"block_cache"`
+}
+
+// Status returns the heads of the sprint, its lanes and validators along with its queue depths
+func (s *Sprint) Status() Status {
+	q := s.executionQueue
+	st := Status{
+		Active:         s.IsActive(),
+		Paused:         s.Paused(),
+		ChainHead:      s.m.CurrentBlock(),
+		SprintHead:     s.lastSuccessfulBlock.Load(),
+		FinalizedBlock: s.FinalizedBlock(),
+		StageSize:      s.stageSize.Load(),
+		Lanes:          s.LaneHeads(),
+		Validators:     make([]int64, len(s.validatorBlockStatus)),
+		Queues: map[string]int{
+			"task":              len(q.taskQueue),
+			"upload":            len(q.uploadSequence),
+			"validation":        len(q.validationQueue),
+			"validation_upload": len(q.validationSequence),
+		},
+		BlockCache: s.BlockCacheStats(),
+	}
+	for i := range s.validatorBlockStatus {
+		st.Validators[i] = s.validatorBlockStatus[i].Load()
+	}
+	if h := s.historyQueue; h != nil {
+		st.Queues["history_task"] = len(h.taskQueue)
+		st.Queues["history_upload"] = len(h.uploadSequence)
+	}
+	return st
+}
+
+// Pause stops scheduling, executing and validating new ranges. Ranges already queued are still
+// committed. Paused sprints keep running until stopped, and resume where they left off.
+func (s *Sprint) Pause() {
+	if s.paused.CompareAndSwap(false, true) {
+		log.Info().Msg("sprint paused")
+	}
+}
+
+// Resume undoes Pause
+func (s *Sprint) Resume() {
+	if s.paused.CompareAndSwap(true, false) {
+		log.Info().Msg("sprint resumed")
+	}
+}
+
+// Paused reports whether the sprint is paused
+func (s *Sprint) Paused() bool {
+	return s.paused.Load()
+}
+
+// Progress returns up to limit ranges of every lane ordered by start block, skipping the first offset
+func (s *Sprint) Progress(ctx context.Context, offset, limit int) ([]*StageProgressLog, error) {
+	return s.store.ListProgress(ctx, offset, limit)
+}
+
+// ResetRange marks the ranges of a lane overlapping startBlock to endBlock unscheduled, so they are
+// fetched again. Their events are passed to SprintManager.Validate rather than Insert, which replaces
+// the events already stored for the range. Failed ranges are reset along with the others, which
+// resumes their lane.
+// Returns the number of ranges reset, skipping ranges that are in flight.
+func (s *Sprint) ResetRange(ctx context.Context, lane string, startBlock, endBlock int) (int, error) {
+	if startBlock > endBlock {
+		return 0, errors.New("start block must be less than or equal to end block")
+	}
+	n, err := s.store.ResetRange(ctx, lane, startBlock, endBlock)
+	if err != nil {
+		return 0, err
+	}
+	log.Info().Str("lane", lane).Int("start_block", startBlock).Int("end_block", endBlock).Int("ranges", n).Msg("reset ranges")
+	return n, nil
+}
+
+// ValidateRange queues an extra validator pass over finished ranges of every lane overlapping
+// startBlock to endBlock, finalized ranges included. At most as many ranges as fit in the validation
+// queue are queued, and the number queued is returned, so large spans take several calls.
+func (s *Sprint) ValidateRange(ctx context.Context, startBlock, endBlock int) (int, error) {
+	if startBlock > endBlock {
+		return 0, errors.New("start block must be less than or equal to end block")
+	}
+	if !s.IsActive() {
+		return 0, ErrSprintNotRunning
+	}
+	free := s.c.ValidatorQueueSize - len(s.executionQueue.validationSequence)
+	if free <= 0 {
+		return 0, errors.New("validation queue is full")
+	}
+	ranges, err := s.store.ClaimRanges(ctx, startBlock, endBlock, free)
+	if err != nil {
+		return 0, err
+	}
+	for _, prog := range ranges {
+		s.executionQueue.addValidationTask(ctx, prog, true)
+	}
+	log.Info().Int("start_block", startBlock).Int("end_block", endBlock).Int("ranges", len(ranges)).Msg("queued validation of ranges")
+	return len(ranges), nil
+}
+
+// NewAdminHandler returns an http.Handler for operating a sprint, to be mounted on an internal
+// listener. Responses are JSON. Endpoints:
+//
+//	GET  /status                             heads and queue depths, see Sprint.Status
+//	GET  /progress?offset=&limit=            progress rows, see Sprint.Progress
+//	POST /pause                              see Sprint.Pause
+//	POST /resume                             see Sprint.Resume
+//	POST /reset?start=&end=&lane=            see Sprint.ResetRange
+//	POST /validate?start=&end=               see Sprint.ValidateRange
+func NewAdminHandler(s *Sprint) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", adminMethod(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, http.StatusOK, s.Status())
+	}))
+	mux.HandleFunc("/progress", adminMethod(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		offset, err := queryInt(r, "offset", 0)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+		limit, err := queryInt(r, "limit", defaultProgressPageSize)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+		if offset < 0 || limit <= 0 || limit > maxProgressPageSize {
+			writeAdminError(w, http.StatusBadRequest, fmt.Errorf("offset must be at least 0 and limit between 1 and %d", maxProgressPageSize))
+			return
+		}
+		rows, err := s.Progress(r.Context(), offset, limit)
+		if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if rows == nil {
+			rows = []*StageProgressLog{}
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]any{"offset": offset, "limit": limit, "rows": rows})
+	}))
+	mux.HandleFunc("/pause", adminMethod(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		s.Pause()
+		writeAdminJSON(w, http.StatusOK, map[string]bool{"paused": true})
+	}))
+	mux.HandleFunc("/resume", adminMethod(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		s.Resume()
+		writeAdminJSON(w, http.StatusOK, map[string]bool{"paused": false})
+	}))
+	mux.HandleFunc("/reset", adminMethod(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		start, end, err := queryRange(r)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+		n, err := s.ResetRange(r.Context(), r.URL.Query().Get("lane"), start, end)
+		if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]int{"reset": n})
+	}))
+	mux.HandleFunc("/validate", adminMethod(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		start, end, err := queryRange(r)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+		n, err := s.ValidateRange(r.Context(), start, end)
+		if errors.Is(err, ErrSprintNotRunning) {
+			writeAdminError(w, http.StatusConflict, err)
+			return
+		}
+		if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]int{"queued": n})
+	}))
+	return mux
+}
+
+func adminMethod(method string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+		fn(w, r)
+	}
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Err(err).Msg("error writing admin response")
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	writeAdminJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func queryInt(r *http.Request, key string, def int) (int, error) {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return n, nil
+}
+
+func queryRange(r *http.Request) (int, int, error) {
+	q := r.URL.Query()
+	if q.Get("start") == "" || q.Get("end") == "" {
+		return 0, 0, errors.New("start and end are required")
+	}
+	start, err := queryInt(r, "start", 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := queryInt(r, "end", 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	if start < 0 || start > end {
+		return 0, 0, errors.New("start must be between 0 and end")
+	}
+	return start, end, nil
+}
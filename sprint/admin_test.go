@@ -0,0 +1,164 @@
+package sprint
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/upper/db/v4"
+)
+
+func adminRequest(t *testing.T, h http.Handler, method, target string, out any) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+	if out != nil {
+		if err := json.NewDecoder(rec.Body).Decode(out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec.Code
+}
+
+func TestAdminHandler(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryProgressStore()
+	s := newLaneTestSprint(t, store)
+	if err := s.schedule(ctx); err != nil {
+		t.Fatal(err)
+	}
+	h := NewAdminHandler(s)
+
+	var status Status
+	if code := adminRequest(t, h, http.MethodGet, "/status", &status); code != http.StatusOK {
+		t.Fatalf("status returned %d", code)
+	}
+	if status.ChainHead != 100 || status.Paused {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if code := adminRequest(t, h, http.MethodGet, "/pause", nil); code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected GET /pause to be rejected, got %d", code)
+	}
+	adminRequest(t, h, http.MethodPost, "/pause", nil)
+	if !s.Paused() {
+		t.Fatal("expected sprint to be paused")
+	}
+	adminRequest(t, h, http.MethodPost, "/resume", nil)
+	if s.Paused() {
+		t.Fatal("expected sprint to be resumed")
+	}
+
+	var page struct {
+		Rows []*StageProgressLog `json:"rows"`
+	}
+	if code := adminRequest(t, h, http.MethodGet, "/progress?offset=2&limit=3", &page); code != http.StatusOK {
+		t.Fatalf("progress returned %d", code)
+	}
+	if len(page.Rows) != 3 || page.Rows[0].StartBlock != 21 {
+		t.Fatalf("unexpected progress page %+v", page.Rows)
+	}
+
+	// finish the first two ranges, then reset them along with an unscheduled one
+	for i := 0; i < 2; i++ {
+		prog, err := store.NextRange(ctx, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		prog.Success = StatusFinished
+		prog.ValidatorPasses = 1
+		if err := store.UpdateProgress(ctx, nil, prog); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var reset map[string]int
+	if code := adminRequest(t, h, http.MethodPost, "/reset?start=5&end=25", &reset); code != http.StatusOK {
+		t.Fatalf("reset returned %d", code)
+	}
+	if reset["reset"] != 3 {
+		t.Fatalf("expected 3 ranges reset, got %d", reset["reset"])
+	}
+	next, err := store.NextRange(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.StartBlock != 1 || next.ValidatorPasses != 0 {
+		t.Fatalf("expected first range to be executed again, got %+v", next)
+	}
+	if code := adminRequest(t, h, http.MethodPost, "/reset?start=25&end=5", nil); code != http.StatusBadRequest {
+		t.Fatalf("expected inverted range to be rejected, got %d", code)
+	}
+	// validation passes are queued by a running sprint only
+	if code := adminRequest(t, h, http.MethodPost, "/validate?start=0&end=10", nil); code != http.StatusConflict {
+		t.Fatalf("expected validate to conflict while stopped, got %d", code)
+	}
+}
+
+// records whether ranges were inserted or validated
+type recordingManager struct {
+	headManager
+	inserted, validated int
+}
+
+func (m *recordingManager) Insert(ctx context.Context, d db.Session, startBlock int, endBlock int, eventData *EventBatch) error {
+	m.inserted++
+	return nil
+}
+
+func (m *recordingManager) Validate(ctx context.Context, d db.Session, startBlock int, endBlock int, eventData *EventBatch) (bool, error) {
+	m.validated++
+	return true, nil
+}
+
+func TestResetRangeReplacesEvents(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryProgressStore()
+	s := newLaneTestSprint(t, store)
+	m := &recordingManager{headManager: 100}
+	s.m = m
+	if err := s.schedule(ctx); err != nil {
+		t.Fatal(err)
+	}
+	prog, err := store.NextRange(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := &EventBatch{progressLog: prog}
+	if err := s.uploadBatch(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+	if m.inserted != 1 || m.validated != 0 {
+		t.Fatalf("expected new range to be inserted, got %d inserts and %d validations", m.inserted, m.validated)
+	}
+	if _, err := s.ResetRange(ctx, "", prog.StartBlock, prog.EndBlock); err != nil {
+		t.Fatal(err)
+	}
+	prog, err = store.NextRange(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prog.EndTs.IsZero() {
+		t.Fatal("expected reset range to keep its end time")
+	}
+	batch = &EventBatch{progressLog: prog}
+	if err := s.uploadBatch(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+	if m.inserted != 1 || m.validated != 1 {
+		t.Fatalf("expected reset range to be validated, got %d inserts and %d validations", m.inserted, m.validated)
+	}
+}
+
+func TestStoreMax(t *testing.T) {
+	s := newLaneTestSprint(t, NewMemoryProgressStore())
+	s.lastSuccessfulBlock.Store(50)
+	storeMax(&s.lastSuccessfulBlock, 20)
+	if got := s.lastSuccessfulBlock.Load(); got != 50 {
+		t.Fatalf("expected head to stay at 50, got %d", got)
+	}
+	storeMax(&s.lastSuccessfulBlock, 60)
+	if got := s.lastSuccessfulBlock.Load(); got != 60 {
+		t.Fatalf("expected head to move to 60, got %d", got)
+	}
+}
@@ -0,0 +1,94 @@
+package sprint
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"gfx.cafe/open/jrpc"
+	"golang.org/x/sync/errgroup"
+)
+
+// Error fragments returned by providers that do not accept JSON-RPC batches. Providers limiting the
+// size of batches, e.g. "batch too large", accept smaller ones and are not matched.
+var batchRejectedErrors = []string{
+	"batch requests are not supported",
+	"batch request not supported",
+	"batch calls are not supported",
+	"batching is not supported",
+	// servers answering a batch with nothing at all
+	"empty response",
+}
+
+// JSON-RPC error code of requests the server could not read, which servers without batch support
+// answer batches with
+const invalidRequestErrorCode = -32600
+
+// batches are tried again after this long, in case the rejection was transient
+const batchRetryInterval = 10 * time.Minute
+
+func isBatchRejected(err error) bool {
+	if err == nil {
+		return false
+	}
+	// other JSON-RPC errors are errors of the calls, not of the batch
+	if code, ok := rpcErrorCode(err); ok && code != invalidRequestErrorCode {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	for _, frag := range batchRejectedErrors {
+		if strings.Contains(msg, frag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sends the calls as JSON-RPC batches of at most maxBatchSize calls. Errors of individual calls are
+// set on their element, the returned error is only set when a batch could not be sent at all.
+// Once the provider rejects a batch every call is sent on its own for batchRetryInterval.
+func (t *blockCache) batchCall(ctx context.Context, elems []*jrpc.BatchElem) error {
+	if t.maxBatchSize <= 1 || t.batchDisabled() {
+		return t.singleCalls(ctx, elems)
+	}
+	wg, ctx := errgroup.WithContext(ctx)
+	for start := 0; start < len(elems); start += t.maxBatchSize {
+		end := start + t.maxBatchSize
+		if end > len(elems) {
+			end = len(elems)
+		}
+		chunk := elems[start:end]
+		wg.Go(func() error {
+			t.acquireWorker()
+			err := t.c.BatchCall(ctx, chunk...)
+			t.releaseWorker()
+			if err == nil || !isBatchRejected(err) {
+				return err
+			}
+			t.noBatchUntil.Store(time.Now().Add(batchRetryInterval).UnixNano())
+			for _, el := range chunk {
+				el.Error = nil
+			}
+			return t.singleCalls(ctx, chunk)
+		})
+	}
+	return wg.Wait()
+}
+
+func (t *blockCache) batchDisabled() bool {
+	return time.Now().UnixNano() < t.noBatchUntil.Load()
+}
+
+func (t *blockCache) singleCalls(ctx context.Context, elems []*jrpc.BatchElem) error {
+	wg := errgroup.Group{}
+	for _, el := range elems {
+		el := el
+		wg.Go(func() error {
+			t.acquireWorker()
+			defer t.releaseWorker()
+			el.Error = t.c.Do(ctx, el.Result, el.Method, el.Params)
+			return nil
+		})
+	}
+	return wg.Wait()
+}
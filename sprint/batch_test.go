@@ -0,0 +1,60 @@
+package sprint
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"gfx.cafe/open/ghost/hexutil"
+	"gfx.cafe/open/jrpc"
+)
+
+func TestIsBatchRejected(t *testing.T) {
+	cases := map[string]bool{
+		"batch requests are not supported": true,
+		"batch too large":                  false,
+		"invalid request":                  false,
+		"query returned more than 10000":   false,
+		"429 Too Many Requests":            false,
+	}
+	for msg, want := range cases {
+		if got := isBatchRejected(errors.New(msg)); got != want {
+			t.Errorf("isBatchRejected(%q) = %v, want %v", msg, got, want)
+		}
+	}
+	if !isBatchRejected(codeError{code: -32600, msg: "Batch requests are not supported"}) {
+		t.Error("expected a rejected batch to be detected by its code")
+	}
+	if isBatchRejected(codeError{code: -32000, msg: "batch requests are not supported for eth_call"}) {
+		t.Error("expected errors of other codes to be errors of the calls")
+	}
+}
+
+func TestBatchRetried(t *testing.T) {
+	ctx := context.Background()
+	chain := newChainConn()
+	chain.setBlock(1, 1)
+	chain.batchErr = codeError{code: -32600, msg: "batch requests are not supported"}
+	cache := NewBlockCacheWithSize(ctx, chain, 1, 0)
+	cache.maxBatchSize = 10
+	call := func() {
+		t.Helper()
+		var blk BlockInfo
+		el := &jrpc.BatchElem{Method: "eth_getBlockByNumber", Params: []any{hexutil.Uint64(1)}, Result: &blk}
+		if err := cache.batchCall(ctx, []*jrpc.BatchElem{el}); err != nil || el.Error != nil {
+			t.Fatalf("expected the call to be sent on its own, got %v %v", err, el.Error)
+		}
+	}
+	call()
+	call()
+	if n := chain.callCount("batch"); n != 1 {
+		t.Fatalf("expected batching to stop after a rejection, got %d batches", n)
+	}
+	// batches are tried again once the interval passed
+	cache.noBatchUntil.Store(time.Now().Add(-time.Second).UnixNano())
+	call()
+	if n := chain.callCount("batch"); n != 2 {
+		t.Fatalf("expected a batch to be tried again, got %d batches", n)
+	}
+}
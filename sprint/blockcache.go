@@ -3,6 +3,8 @@ package sprint
 import (
 	"context"
 	"fmt"
+	"sync"
+	"sync/atomic"
 
 	"gfx.cafe/open/ghost/hexutil"
 	"gfx.cafe/open/jrpc"
@@ -24,20 +26,48 @@ type TransactionInfo struct {
 
 type BlockInfo struct {
 	Number       *uint256.Int                     `json:"number"`
+	Hash         common.Hash                      `json:"hash"`
+	ParentHash   common.Hash                      `json:"parentHash"`
 	Timestamp    *uint256.Int                     `json:"timestamp"`
 	Transactions []*TransactionInfo               `json:"transactions"`
 	TxMap        map[common.Hash]*TransactionInfo `json:"-"`
 }
 
+// BlockHeader is the subset of block fields sprint needs to track the canonical chain
+type BlockHeader struct {
+	Number     *uint256.Int `json:"number"`
+	Hash       common.Hash  `json:"hash"`
+	ParentHash common.Hash  `json:"parentHash"`
+	Timestamp  *uint256.Int `json:"timestamp"`
+}
+
 type blockCache struct {
 	c          jrpc.Conn
 	workerChan chan struct{}
+	blocks     *blockLRU
+	// fetches in flight by block number, so concurrent fetches of the same block are deduplicated
+	inflightMu sync.Mutex
+	inflight   map[int]*blockCall
+	// set once the provider rejects eth_getBlockReceipts
+	noBlockReceipts atomic.Bool
+	// calls per JSON-RPC batch, batching is disabled below 2
+	maxBatchSize int
+	// unix nanoseconds until which calls are not batched, after the provider rejected a batch
+	noBatchUntil atomic.Int64
 }
 
 func NewBlockCache(ctx context.Context, c jrpc.Conn, workers int) *blockCache {
+	return NewBlockCacheWithSize(ctx, c, workers, defaultBlockCacheSize)
+}
+
+// NewBlockCacheWithSize creates a block cache holding up to size blocks. A size of 0 or less only
+// deduplicates concurrent fetches.
+func NewBlockCacheWithSize(ctx context.Context, c jrpc.Conn, workers int, size int) *blockCache {
 	o := &blockCache{
 		c:          c,
 		workerChan: make(chan struct{}, workers),
+		blocks:     newBlockLRU(size),
+		inflight:   make(map[int]*blockCall),
 	}
 	for i := 0; i < workers; i++ {
 		o.workerChan <- struct{}{}
@@ -53,8 +83,152 @@ func (t *blockCache) releaseWorker() {
 	t.workerChan <- struct{}{}
 }
 
+// Returns the block with transactions at the given number, from the cache when possible. Cached
+// blocks are shared between callers and must not be modified.
 // Meant to be used concurrently from caller
 func (t *blockCache) BlockAt(ctx context.Context, block int) (*BlockInfo, error) {
+	if blk, ok := t.blocks.get(block); ok {
+		return blk, nil
+	}
+	generation := t.blocks.currentGeneration()
+	call, owner := t.claim(block, generation)
+	if !owner {
+		return call.wait(ctx)
+	}
+	blk, err := t.fetchBlock(ctx, block)
+	t.finish(block, call, blk, err)
+	return blk, err
+}
+
+// blockCall is a fetch of a block that concurrent callers wait on
+type blockCall struct {
+	generation uint64
+	done       chan struct{}
+	blk        *BlockInfo
+	err        error
+}
+
+func (c *blockCall) wait(ctx context.Context) (*BlockInfo, error) {
+	select {
+	case <-c.done:
+		return c.blk, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Returns the fetch of a block in flight, or starts one when there is none and reports that the caller
+// owns it and must finish it. Fetches started before an invalidation are not joined, since they may
+// return blocks of the reorged chain
+func (t *blockCache) claim(block int, generation uint64) (*blockCall, bool) {
+	t.inflightMu.Lock()
+	defer t.inflightMu.Unlock()
+	if call, ok := t.inflight[block]; ok && call.generation == generation {
+		return call, false
+	}
+	call := &blockCall{generation: generation, done: make(chan struct{})}
+	t.inflight[block] = call
+	return call, true
+}
+
+// Caches the result of a fetch and wakes callers waiting on it
+func (t *blockCache) finish(block int, call *blockCall, blk *BlockInfo, err error) {
+	if err == nil {
+		t.blocks.add(block, blk, call.generation)
+	}
+	t.inflightMu.Lock()
+	if t.inflight[block] == call {
+		delete(t.inflight, block)
+	}
+	t.inflightMu.Unlock()
+	call.blk, call.err = blk, err
+	close(call.done)
+}
+
+// Returns a cached block by hash, without fetching it
+func (t *blockCache) CachedBlockByHash(hash common.Hash) (*BlockInfo, bool) {
+	return t.blocks.getByHash(hash)
+}
+
+// Drops cached blocks at or above the given block, after a reorg was detected from it
+func (t *blockCache) InvalidateFrom(block int) {
+	t.blocks.invalidateFrom(block)
+}
+
+// Stats returns the cache hit and miss counts
+func (t *blockCache) Stats() BlockCacheStats {
+	return t.blocks.statistics()
+}
+
+// Returns the blocks at the given numbers, fetching the blocks that are not cached in JSON-RPC batches.
+// Blocks already being fetched by another caller are waited on rather than fetched again. Cached
+// blocks are shared between callers and must not be modified
+func (t *blockCache) BlocksAt(ctx context.Context, blocks []int) (map[int]*BlockInfo, error) {
+	res := make(map[int]*BlockInfo, len(blocks))
+	generation := t.blocks.currentGeneration()
+	var missing []int
+	var owned, joined []*blockCall
+	joinedBlocks := make([]int, 0)
+	for _, block := range blocks {
+		if blk, ok := t.blocks.get(block); ok {
+			res[block] = blk
+			continue
+		}
+		call, owner := t.claim(block, generation)
+		if owner {
+			missing = append(missing, block)
+			owned = append(owned, call)
+		} else {
+			joinedBlocks = append(joinedBlocks, block)
+			joined = append(joined, call)
+		}
+	}
+	if len(missing) > 0 {
+		elems := make([]*jrpc.BatchElem, len(missing))
+		for i, block := range missing {
+			elems[i] = &jrpc.BatchElem{
+				Method: "eth_getBlockByNumber",
+				Params: []any{hexutil.Uint64(block), true},
+				Result: &BlockInfo{},
+			}
+		}
+		err := t.batchCall(ctx, elems)
+		var firstErr error
+		for i, block := range missing {
+			// every claimed fetch is finished, so callers waiting on them are woken
+			blkErr := err
+			if blkErr == nil {
+				blkErr = elems[i].Error
+			}
+			var blk *BlockInfo
+			if blkErr == nil {
+				blk = elems[i].Result.(*BlockInfo)
+				blkErr = prepareBlock(blk, block)
+			}
+			if blkErr != nil {
+				blk = nil
+			}
+			t.finish(block, owned[i], blk, blkErr)
+			if blkErr != nil && firstErr == nil {
+				firstErr = blkErr
+			}
+			res[block] = blk
+		}
+		if firstErr != nil {
+			return nil, firstErr
+		}
+	}
+	for i, call := range joined {
+		blk, err := call.wait(ctx)
+		if err != nil {
+			return nil, err
+		}
+		res[joinedBlocks[i]] = blk
+	}
+	return res, nil
+}
+
+func (t *blockCache) fetchBlock(ctx context.Context, block int) (*BlockInfo, error) {
 	t.acquireWorker()
 	defer t.releaseWorker()
 	blk := &BlockInfo{}
@@ -62,37 +236,163 @@ func (t *blockCache) BlockAt(ctx context.Context, block int) (*BlockInfo, error)
 	if err != nil {
 		return nil, err
 	}
+	return blk, prepareBlock(blk, block)
+}
+
+// Checks a fetched block and fills in missing transaction fields
+func prepareBlock(blk *BlockInfo, block int) error {
 	if blk.Number == nil {
-		return nil, fmt.Errorf("nil block")
+		return fmt.Errorf("nil block")
 	}
 	num := int(blk.Number.Uint64())
 	if num != block {
-		return nil, fmt.Errorf("block number doesnt match")
+		return fmt.Errorf("block number doesnt match")
 	}
 	blk.TxMap = make(map[common.Hash]*TransactionInfo)
 	for _, tx := range blk.Transactions {
-		if tx.To == nil {
-			tx.To = &common.Address{}
+		fillTransaction(tx)
+		blk.TxMap[tx.Hash] = tx
+	}
+	return nil
+}
+
+func fillTransaction(tx *TransactionInfo) {
+	if tx.To == nil {
+		tx.To = &common.Address{}
+	}
+	if tx.SenderNonce == nil {
+		tx.SenderNonce = &uint256.Int{}
+	}
+	if tx.Value == nil {
+		tx.Value = &uint256.Int{}
+	}
+	if tx.Gas == nil {
+		tx.Gas = &uint256.Int{}
+	}
+	if tx.GasPrice == nil {
+		tx.GasPrice = &uint256.Int{}
+	}
+	if tx.MaxFeePerGas == nil {
+		tx.MaxFeePerGas = &uint256.Int{}
+	}
+	if tx.MaxPriorityFeePerGas == nil {
+		tx.MaxPriorityFeePerGas = &uint256.Int{}
+	}
+}
+
+// transaction as returned by eth_getTransactionByHash, which also names its block
+type blockTransaction struct {
+	TransactionInfo
+	BlockHash *common.Hash `json:"blockHash"`
+}
+
+// Returns the blocks at the given numbers holding only the given transactions. Fetches each block's
+// header and then each transaction by hash, in JSON-RPC batches when batching is enabled. The blocks
+// are not cached since they only hold some of their transactions.
+// Meant to be used concurrently from caller
+func (t *blockCache) PartialBlocksAt(ctx context.Context, blockSet map[int][]common.Hash) (map[int]*BlockInfo, error) {
+	numbers := make([]int, 0, len(blockSet))
+	elems := make([]*jrpc.BatchElem, 0, len(blockSet))
+	for block := range blockSet {
+		numbers = append(numbers, block)
+		elems = append(elems, &jrpc.BatchElem{
+			Method: "eth_getBlockByNumber",
+			Params: []any{hexutil.Uint64(block), false},
+			Result: &BlockHeader{},
+		})
+	}
+	type txRef struct {
+		block int
+		hash  common.Hash
+		elem  *jrpc.BatchElem
+	}
+	var txs []*txRef
+	for _, block := range numbers {
+		seen := make(map[common.Hash]struct{}, len(blockSet[block]))
+		for _, hash := range blockSet[block] {
+			if _, ok := seen[hash]; ok {
+				continue
+			}
+			seen[hash] = struct{}{}
+			ref := &txRef{block: block, hash: hash, elem: &jrpc.BatchElem{
+				Method: "eth_getTransactionByHash",
+				Params: []any{hash},
+				Result: &blockTransaction{},
+			}}
+			txs = append(txs, ref)
+			elems = append(elems, ref.elem)
 		}
-		if tx.SenderNonce == nil {
-			tx.SenderNonce = &uint256.Int{}
+	}
+	err := t.batchCall(ctx, elems)
+	if err != nil {
+		return nil, err
+	}
+	blocks := make(map[int]*BlockInfo, len(numbers))
+	for i, block := range numbers {
+		if elems[i].Error != nil {
+			return nil, elems[i].Error
 		}
-		if tx.Value == nil {
-			tx.Value = &uint256.Int{}
+		hdr := elems[i].Result.(*BlockHeader)
+		if hdr.Number == nil {
+			return nil, fmt.Errorf("nil block")
 		}
-		if tx.Gas == nil {
-			tx.Gas = &uint256.Int{}
+		if int(hdr.Number.Uint64()) != block {
+			return nil, fmt.Errorf("block number doesnt match")
 		}
-		if tx.GasPrice == nil {
-			tx.GasPrice = &uint256.Int{}
+		blocks[block] = &BlockInfo{
+			Number:     hdr.Number,
+			Hash:       hdr.Hash,
+			ParentHash: hdr.ParentHash,
+			Timestamp:  hdr.Timestamp,
+			TxMap:      make(map[common.Hash]*TransactionInfo, len(blockSet[block])),
 		}
-		if tx.MaxFeePerGas == nil {
-			tx.MaxFeePerGas = &uint256.Int{}
+	}
+	for _, ref := range txs {
+		if ref.elem.Error != nil {
+			return nil, ref.elem.Error
 		}
-		if tx.MaxPriorityFeePerGas == nil {
-			tx.MaxPriorityFeePerGas = &uint256.Int{}
+		blk := blocks[ref.block]
+		tx := ref.elem.Result.(*blockTransaction)
+		// the chain may have reorged between fetching the header and the transaction
+		if tx.BlockHash == nil || *tx.BlockHash != blk.Hash {
+			return nil, fmt.Errorf("transaction %s is not in block %d", ref.hash, ref.block)
 		}
-		blk.TxMap[tx.Hash] = tx
+		fillTransaction(&tx.TransactionInfo)
+		blk.Transactions = append(blk.Transactions, &tx.TransactionInfo)
+		blk.TxMap[ref.hash] = &tx.TransactionInfo
+	}
+	return blocks, nil
+}
+
+// Meant to be used concurrently from caller
+func (t *blockCache) HeaderAt(ctx context.Context, block int) (*BlockHeader, error) {
+	t.acquireWorker()
+	defer t.releaseWorker()
+	hdr := &BlockHeader{}
+	err := t.c.Do(ctx, hdr, "eth_getBlockByNumber", []any{hexutil.Uint64(block), false})
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Number == nil {
+		return nil, fmt.Errorf("nil block")
+	}
+	if int(hdr.Number.Uint64()) != block {
+		return nil, fmt.Errorf("block number doesnt match")
+	}
+	return hdr, nil
+}
+
+// Fetches the header at a block tag such as "finalized" or "safe"
+func (t *blockCache) HeaderByTag(ctx context.Context, tag string) (*BlockHeader, error) {
+	t.acquireWorker()
+	defer t.releaseWorker()
+	hdr := &BlockHeader{}
+	err := t.c.Do(ctx, hdr, "eth_getBlockByNumber", []any{tag, false})
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Number == nil {
+		return nil, fmt.Errorf("nil block for tag %s", tag)
 	}
-	return blk, nil
+	return hdr, nil
 }
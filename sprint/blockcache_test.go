@@ -0,0 +1,91 @@
+package sprint
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"gfx.cafe/open/ghost"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestStageBlocksRefetchStale(t *testing.T) {
+	for _, batchSize := range []int{0, 10} {
+		ctx := context.Background()
+		chain := newChainConn()
+		tx := common.Hash{0xaa}
+		chain.setBlock(5, 1).Transactions = []*TransactionInfo{{Hash: tx}}
+		s := &Sprint{c: &SprintConfig{MaxBatchSize: batchSize}, blockCache: NewBlockCacheWithSize(ctx, chain, 1, 10)}
+		s.blockCache.maxBatchSize = batchSize
+		if _, err := s.blockCache.BlockAt(ctx, 5); err != nil {
+			t.Fatal(err)
+		}
+		// the block is reorged after it was cached, with the transaction included again
+		reorged := chain.setBlock(5, 2)
+		reorged.Transactions = []*TransactionInfo{{Hash: tx}}
+		logs := []*ghost.ErigonLog{{BlockNumber: 5, BlockHash: reorged.Hash, TxHash: tx}}
+		blocks, err := s.getStageBlockInfo(ctx, logs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if blocks[5].Hash != reorged.Hash {
+			t.Fatalf("batch size %d: expected the reorged block to be fetched, got %s", batchSize, blocks[5].Hash)
+		}
+		if blk, _ := s.blockCache.BlockAt(ctx, 5); blk.Hash != reorged.Hash {
+			t.Fatalf("batch size %d: expected the reorged block to be cached, got %s", batchSize, blk.Hash)
+		}
+		// logs of a chain the node is not on
+		logs[0].BlockHash = common.Hash{3}
+		if _, err := s.getStageBlockInfo(ctx, logs); err == nil {
+			t.Fatalf("batch size %d: expected logs not matching their block to fail", batchSize)
+		}
+	}
+}
+
+func TestBlocksAtDedup(t *testing.T) {
+	ctx := context.Background()
+	chain := newChainConn()
+	for n := 1; n <= 4; n++ {
+		chain.setBlock(n, 1)
+	}
+	chain.gate = make(chan struct{})
+	cache := NewBlockCacheWithSize(ctx, chain, 4, 10)
+	cache.maxBatchSize = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, err := cache.BlockAt(ctx, 2)
+		errs <- err
+	}()
+	// wait for the single fetch to start before the batch claims the other blocks
+	for chain.callCount("eth_getBlockByNumber") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	go func() {
+		defer wg.Done()
+		blocks, err := cache.BlocksAt(ctx, []int{1, 2, 3, 4})
+		if err == nil && len(blocks) != 4 {
+			err = fmt.Errorf("expected 4 blocks, got %d", len(blocks))
+		}
+		errs <- err
+	}()
+	for chain.callCount("batch") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(chain.gate)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// every block is fetched once, by the first caller to claim it
+	if got := chain.callCount("eth_getBlockByNumber"); got != 4 {
+		t.Fatalf("expected 4 block fetches, got %d", got)
+	}
+}
@@ -0,0 +1,129 @@
+package sprint
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"gfx.cafe/open/ghost"
+)
+
+// BlockHashLog records the canonical hash of a block ingested by sprint. Validators walk these
+// against the chain to find where a reorg forked off, rather than re-querying whole ranges.
+//
+// SQL progress stores keep rows in the progress table name suffixed with "_blocks":
+//
+//	CREATE TABLE <progress_table>_blocks (
+//		lane         TEXT NOT NULL DEFAULT '',
+//		block_number BIGINT NOT NULL,
+//		block_hash   TEXT NOT NULL,
+//		parent_hash  TEXT NOT NULL,
+//		PRIMARY KEY (lane, block_number)
+//	);
+type BlockHashLog struct {
+	// Lane of the range the block was ingested in, see StageProgressLog.Lane
+	Lane        string `db:"lane" json:"lane"`
+	BlockNumber int    `db:"block_number" json:"block_number"`
+	BlockHash   string `db:"block_hash" json:"block_hash"`
+	ParentHash  string `db:"parent_hash" json:"parent_hash"`
+}
+
+func blockTableName(progressTable string) string {
+	return progressTable + "_blocks"
+}
+
+// Returns the first block in the range that must be re-queried, and false when every stored block in
+// the range is still canonical
+func (s *Sprint) findForkBlock(ctx context.Context, lane string, startBlock, endBlock int) (int, bool, error) {
+	stored, err := s.store.BlockHashes(ctx, lane, startBlock, endBlock)
+	if err != nil {
+		return 0, false, err
+	}
+	isCanonical := func(h *BlockHashLog) (bool, error) {
+		hdr, err := s.blockCache.HeaderAt(ctx, h.BlockNumber)
+		if err != nil {
+			return false, err
+		}
+		return hdr.Hash.Hex() == h.BlockHash, nil
+	}
+	// a block hash commits to all of its ancestors, so if the end of the range is still canonical
+	// then nothing before it can have been reorged out
+	if n := len(stored); n > 0 && stored[n-1].BlockNumber == endBlock {
+		ok, err := isCanonical(stored[n-1])
+		if err != nil {
+			return 0, false, err
+		}
+		if ok {
+			return endBlock + 1, false, nil
+		}
+		stored = stored[:n-1]
+	}
+	// for the same reason canonical blocks form a prefix of the stored hashes, so we can binary
+	// search for the last stored block that is still on chain
+	lo, hi := 0, len(stored)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		ok, err := isCanonical(stored[mid])
+		if err != nil {
+			return 0, false, err
+		}
+		if ok {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	// no stored block is known to be canonical (or the range predates hash tracking), so the
+	// whole range must be re-queried
+	if lo == 0 {
+		return startBlock, true, nil
+	}
+	return stored[lo-1].BlockNumber + 1, true, nil
+}
+
+func batchBlockHashes(batch *EventBatch) []*BlockHashLog {
+	hashes := make([]*BlockHashLog, 0, len(batch.Blocks)+1)
+	for num, blk := range batch.Blocks {
+		hashes = append(hashes, &BlockHashLog{
+			BlockNumber: num,
+			BlockHash:   blk.Hash.Hex(),
+			ParentHash:  blk.ParentHash.Hex(),
+		})
+	}
+	// always track the end of the range, since it anchors every block before it
+	if hdr := batch.endHeader; hdr != nil {
+		if _, ok := batch.Blocks[batch.progressLog.EndBlock]; !ok {
+			hashes = append(hashes, &BlockHashLog{
+				BlockNumber: batch.progressLog.EndBlock,
+				BlockHash:   hdr.Hash.Hex(),
+				ParentHash:  hdr.ParentHash.Hex(),
+			})
+		}
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		return hashes[i].BlockNumber < hashes[j].BlockNumber
+	})
+	return hashes
+}
+
+// Checks that the logs, blocks and end header of a range come from the same chain, returning the
+// first block that does not. The chain may reorg between the calls fetching them
+func checkBlockHashes(logs []*ghost.ErigonLog, blocks map[int]*BlockInfo, endHeader *BlockHeader) (int, error) {
+	for _, l := range logs {
+		blk, ok := blocks[int(l.BlockNumber)]
+		if !ok {
+			return int(l.BlockNumber), fmt.Errorf("missing block: %d", l.BlockNumber)
+		}
+		if l.BlockHash != blk.Hash {
+			return int(l.BlockNumber), fmt.Errorf("log block hash %s does not match block %d hash %s", l.BlockHash, l.BlockNumber, blk.Hash)
+		}
+	}
+	if endHeader == nil {
+		return 0, nil
+	}
+	end := int(endHeader.Number.Uint64())
+	if blk, ok := blocks[end]; ok && blk.Hash != endHeader.Hash {
+		return end, fmt.Errorf("end block %d hash %s does not match header hash %s", end, blk.Hash, endHeader.Hash)
+	}
+	return 0, nil
+}
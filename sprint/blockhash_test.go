@@ -0,0 +1,199 @@
+package sprint
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+
+	"gfx.cafe/open/ghost"
+	"gfx.cafe/open/ghost/hexutil"
+	"gfx.cafe/open/jrpc"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/holiman/uint256"
+)
+
+// chainConn serves blocks of a fake chain by number
+type chainConn struct {
+	mu       sync.Mutex
+	blocks   map[int]*BlockInfo
+	receipts map[common.Hash]*ReceiptInfo
+	calls    map[string]int
+	// whether eth_getBlockReceipts is implemented
+	blockReceipts bool
+	// when set, calls wait for it to be closed before they are served
+	gate chan struct{}
+	// when set, batches are rejected with it
+	batchErr error
+}
+
+func newChainConn() *chainConn {
+	return &chainConn{blocks: make(map[int]*BlockInfo), receipts: make(map[common.Hash]*ReceiptInfo), calls: make(map[string]int)}
+}
+
+// Sets the receipt of a successful transaction in a block
+func (c *chainConn) setReceipt(blk *BlockInfo, tx common.Hash) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.receipts[tx] = &ReceiptInfo{
+		TransactionHash: tx,
+		BlockHash:       blk.Hash,
+		BlockNumber:     blk.Number,
+		Status:          uint256.NewInt(1),
+	}
+}
+
+// Sets the block at a number, whose hash is derived from the fork it is on
+func (c *chainConn) setBlock(number int, fork byte) *BlockInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	blk := &BlockInfo{
+		Number:    uint256.NewInt(uint64(number)),
+		Hash:      common.Hash{fork, byte(number >> 8), byte(number)},
+		Timestamp: uint256.NewInt(uint64(number) * 12),
+	}
+	c.blocks[number] = blk
+	return blk
+}
+
+// Returns the number of calls of a method
+func (c *chainConn) callCount(method string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls[method]
+}
+
+func (c *chainConn) Do(ctx context.Context, result any, method string, params any) error {
+	c.mu.Lock()
+	c.calls[method]++
+	gate := c.gate
+	c.mu.Unlock()
+	if gate != nil {
+		<-gate
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch method {
+	case "eth_getBlockByNumber":
+		number := int(params.([]any)[0].(hexutil.Uint64))
+		blk, ok := c.blocks[number]
+		if !ok {
+			return fmt.Errorf("unknown block %d", number)
+		}
+		return roundtrip(blk, result)
+	case "eth_getBlockReceipts":
+		if !c.blockReceipts {
+			break
+		}
+		number := int(params.([]any)[0].(hexutil.Uint64))
+		var all []*ReceiptInfo
+		for _, r := range c.receipts {
+			if int(r.BlockNumber.Uint64()) == number {
+				all = append(all, r)
+			}
+		}
+		return roundtrip(all, result)
+	case "eth_getTransactionReceipt":
+		return roundtrip(c.receipts[params.([]any)[0].(common.Hash)], result)
+	}
+	return codeError{code: -32601, msg: fmt.Sprintf("the method %s does not exist/is not available", method)}
+}
+
+// Decodes the JSON encoding of v into result, as a server response would be
+func roundtrip(v, result any) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, result)
+}
+
+func (c *chainConn) BatchCall(ctx context.Context, b ...*jrpc.BatchElem) error {
+	c.mu.Lock()
+	c.calls["batch"]++
+	batchErr := c.batchErr
+	c.mu.Unlock()
+	if batchErr != nil {
+		return batchErr
+	}
+	for _, el := range b {
+		el.Error = c.Do(ctx, el.Result, el.Method, el.Params)
+	}
+	return nil
+}
+
+func (c *chainConn) Close() error { return nil }
+
+func (c *chainConn) Closed() <-chan struct{} { return nil }
+
+func TestFindForkBlock(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name string
+		// blocks of the range that were reorged out after their hashes were stored
+		reorged   []int
+		fork      int
+		forked    bool
+		endStored bool
+	}{
+		{name: "no fork", endStored: true, fork: 21, forked: false},
+		{name: "fork at the end block", reorged: []int{20}, endStored: true, fork: 17, forked: true},
+		{name: "fork in the middle", reorged: []int{14, 16, 20}, endStored: true, fork: 13, forked: true},
+		{name: "fork at the start", reorged: []int{10, 12, 14, 16, 20}, endStored: true, fork: 10, forked: true},
+		{name: "end not stored", reorged: []int{16}, endStored: false, fork: 15, forked: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			chain := newChainConn()
+			store := NewMemoryProgressStore()
+			var stored []*BlockHashLog
+			for _, n := range []int{10, 12, 14, 16, 20} {
+				if n == 20 && !tc.endStored {
+					continue
+				}
+				blk := chain.setBlock(n, 1)
+				stored = append(stored, &BlockHashLog{BlockNumber: n, BlockHash: blk.Hash.Hex()})
+			}
+			if err := store.StoreBlockHashes(ctx, nil, "", 10, 20, stored); err != nil {
+				t.Fatal(err)
+			}
+			for n := 10; n <= 20; n++ {
+				if _, ok := chain.blocks[n]; !ok {
+					chain.setBlock(n, 1)
+				}
+			}
+			for _, n := range tc.reorged {
+				chain.setBlock(n, 2)
+			}
+			s := &Sprint{store: store, blockCache: NewBlockCacheWithSize(ctx, chain, 1, 0)}
+			fork, forked, err := s.findForkBlock(ctx, "", 10, 20)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fork != tc.fork || forked != tc.forked {
+				t.Fatalf("expected fork at %d (%v), got %d (%v)", tc.fork, tc.forked, fork, forked)
+			}
+		})
+	}
+}
+
+func TestCheckBlockHashes(t *testing.T) {
+	chain := newChainConn()
+	blocks := map[int]*BlockInfo{5: chain.setBlock(5, 1), 9: chain.setBlock(9, 1)}
+	end := &BlockHeader{Number: uint256.NewInt(9), Hash: blocks[9].Hash}
+	logs := []*ghost.ErigonLog{{BlockNumber: 5, BlockHash: blocks[5].Hash}, {BlockNumber: 9, BlockHash: blocks[9].Hash}}
+	if _, err := checkBlockHashes(logs, blocks, end); err != nil {
+		t.Fatal(err)
+	}
+	// the log was queried from a chain the block is no longer on
+	logs[0].BlockHash = common.Hash{2}
+	if block, err := checkBlockHashes(logs, blocks, end); err == nil || block != 5 {
+		t.Fatalf("expected mismatch at block 5, got %d %v", block, err)
+	}
+	logs[0].BlockHash = blocks[5].Hash
+	// the end header was fetched before a reorg of the end block
+	end.Hash = common.Hash{2}
+	if block, err := checkBlockHashes(logs, blocks, end); err == nil || block != 9 {
+		t.Fatalf("expected mismatch at block 9, got %d %v", block, err)
+	}
+}
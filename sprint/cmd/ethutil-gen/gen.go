@@ -0,0 +1,560 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/format"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+)
+
+// Config selects what is generated from an ABI
+type Config struct {
+	// Package name of the generated Go files
+	Package string
+	// Raw names of the events to generate, every non-anonymous event of the ABI if empty
+	Events []string
+	// Prepended to the table name of every event
+	TablePrefix string
+}
+
+// Output is the generated code of an ABI
+type Output struct {
+	// manager.Event implementations, regenerated whenever the ABI changes
+	Events []byte
+	// manager.EventUploader inserting the events into their tables, a starting point to edit
+	Uploader []byte
+	// CREATE TABLE statements of the event tables
+	Schema []byte
+}
+
+// Generate generates the code of the events of a JSON ABI. Compiler artifacts holding the ABI in an
+// "abi" field, such as those of hardhat and foundry, are accepted as well
+func Generate(input []byte, c Config) (*Output, error) {
+	if !isIdentifier(c.Package) {
+		return nil, fmt.Errorf("invalid package name %q", c.Package)
+	}
+	abiJSON, err := selectEvents(input, c.Events)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := abi.JSON(bytes.NewReader(abiJSON))
+	if err != nil {
+		return nil, fmt.Errorf("invalid abi: %w", err)
+	}
+	g := &generator{
+		c:       c,
+		imports: make(map[string]struct{}),
+		tuples:  make(map[string]*tupleModel),
+	}
+	m := &fileModel{Package: c.Package, ABI: quoteABI(abiJSON)}
+	names := make([]string, 0, len(parsed.Events))
+	for name := range parsed.Events {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ev := parsed.Events[name]
+		// anonymous events have no topic0 for the manager to match logs by
+		if ev.Anonymous {
+			continue
+		}
+		em, err := g.event(&ev)
+		if err != nil {
+			return nil, fmt.Errorf("event %s: %w", ev.RawName, err)
+		}
+		m.Events = append(m.Events, em)
+	}
+	if len(m.Events) == 0 {
+		return nil, errors.New("abi has no events to generate")
+	}
+	err = checkNames(m.Events)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range g.tupleOrder {
+		m.Tuples = append(m.Tuples, g.tuples[t])
+	}
+	for imp := range g.imports {
+		if strings.Contains(strings.Split(imp, "/")[0], ".") {
+			m.ModImports = append(m.ModImports, imp)
+		} else {
+			m.StdImports = append(m.StdImports, imp)
+		}
+	}
+	sort.Strings(m.StdImports)
+	sort.Strings(m.ModImports)
+	for _, ev := range m.Events {
+		m.HasIndexed = m.HasIndexed || ev.Indexed
+		m.HasJSON = m.HasJSON || ev.JSON
+	}
+
+	out := &Output{}
+	out.Events, err = render(eventsTemplate, m)
+	if err != nil {
+		return nil, err
+	}
+	out.Uploader, err = render(uploaderTemplate, m)
+	if err != nil {
+		return nil, err
+	}
+	var schema bytes.Buffer
+	err = schemaTemplate.Execute(&schema, m)
+	if err != nil {
+		return nil, err
+	}
+	out.Schema = schema.Bytes()
+	return out, nil
+}
+
+type fileModel struct {
+	Package string
+	ABI     string
+	// imports of the events file besides those it always has
+	StdImports []string
+	ModImports []string
+	Events     []*eventModel
+	Tuples     []*tupleModel
+	// whether the helpers decoding topics and encoding JSON columns are used
+	HasIndexed bool
+	HasJSON    bool
+}
+
+type eventModel struct {
+	// Key of the event in the parsed ABI, which differs from RawName for overloaded events
+	Name      string
+	RawName   string
+	Signature string
+	Type      string
+	Row       string
+	Table     string
+	// table name quoted for the schema, since event names such as Order are SQL keywords
+	QuotedTable string
+	Topics      int
+	// whether any indexed argument is decoded from its topic, rather than read as a hash
+	Indexed bool
+	Data    bool
+	// whether any column holds JSON
+	JSON   bool
+	Fields []*fieldModel
+}
+
+type fieldModel struct {
+	// name of the ABI argument
+	Arg     string
+	Name    string
+	Type    string
+	Column  string
+	SQLType string
+	Indexed bool
+	// expression of the decoded value, reading the raw topics, the topics map or the vals slice
+	Decode string
+	// type of the column value in the row struct, and expression converting the field to it
+	RowType string
+	Value   string
+	// the column value is the JSON encoding of the field
+	JSON bool
+}
+
+type tupleModel struct {
+	Name   string
+	Fields []*tupleField
+	// Go types of the fields, to tell apart different tuples with the same name
+	shape string
+}
+
+type tupleField struct {
+	Name string
+	Type string
+	// key of the field in JSON columns
+	JSONName string
+}
+
+type generator struct {
+	c          Config
+	imports    map[string]struct{}
+	tuples     map[string]*tupleModel
+	tupleOrder []string
+}
+
+// identifiers of the event structs and row columns that arguments are renamed away from
+var (
+	reservedFields  = []string{"Address", "BlockNumber", "TxHash", "LogIndex", "Copy", "Process", "Table", "EventHash", "GetLogIndex"}
+	reservedColumns = []string{"address", "block_number", "tx_hash", "log_index", "timestamp"}
+)
+
+func (g *generator) event(ev *abi.Event) (*eventModel, error) {
+	typeName := abi.ToCamelCase(ev.Name)
+	em := &eventModel{
+		Name:      ev.Name,
+		RawName:   ev.RawName,
+		Signature: ev.Sig,
+		Type:      typeName,
+		Row:       lowerFirst(typeName) + "Row",
+		Table:     g.c.TablePrefix + toSnake(ev.Name),
+		Topics:    1,
+	}
+	em.QuotedTable = quoteIdentifier(em.Table)
+	fieldNames := append([]string(nil), reservedFields...)
+	columns := append([]string(nil), reservedColumns...)
+	data := 0
+	for _, arg := range ev.Inputs {
+		f := &fieldModel{
+			Arg:     arg.Name,
+			Name:    unique(abi.ToCamelCase(arg.Name), "Arg", fieldNames),
+			Column:  unique(toSnake(arg.Name), "_arg", columns),
+			Indexed: arg.Indexed,
+		}
+		fieldNames = append(fieldNames, f.Name)
+		columns = append(columns, f.Column)
+		t := arg.Type
+		// indexed arguments of dynamic types only have the hash of their value in the topic
+		if arg.Indexed && isHashedTopic(t) {
+			t = abi.Type{T: abi.HashTy, Size: 32}
+		}
+		var err error
+		f.Type, err = g.goType(t, typeName+f.Name)
+		if err != nil {
+			return nil, fmt.Errorf("argument %s: %w", arg.Name, err)
+		}
+		f.SQLType, f.RowType, f.Value, f.JSON = g.column(t, "e."+f.Name)
+		switch {
+		case arg.Indexed && isHashedTopic(arg.Type):
+			f.Decode = fmt.Sprintf("raw.Topics[%d]", em.Topics)
+			em.Topics++
+		case arg.Indexed:
+			em.Topics++
+			em.Indexed = true
+			f.Decode = fmt.Sprintf("topics[%q].(%s)", arg.Name, f.Type)
+		default:
+			em.Data = true
+			f.Decode = g.decodeData(t, f.Type, data)
+			data++
+		}
+		em.JSON = em.JSON || f.JSON
+		em.Fields = append(em.Fields, f)
+	}
+	return em, nil
+}
+
+// Go type of an ABI type, as the abi package decodes it. Tuples become named structs
+func (g *generator) goType(t abi.Type, tupleHint string) (string, error) {
+	switch t.T {
+	case abi.AddressTy:
+		return "common.Address", nil
+	case abi.HashTy:
+		return "common.Hash", nil
+	case abi.BoolTy:
+		return "bool", nil
+	case abi.StringTy:
+		return "string", nil
+	case abi.BytesTy:
+		return "[]byte", nil
+	case abi.FixedBytesTy:
+		return fmt.Sprintf("[%d]byte", t.Size), nil
+	case abi.IntTy, abi.UintTy:
+		switch t.Size {
+		case 8, 16, 32, 64:
+			if t.T == abi.IntTy {
+				return fmt.Sprintf("int%d", t.Size), nil
+			}
+			return fmt.Sprintf("uint%d", t.Size), nil
+		}
+		g.imports["math/big"] = struct{}{}
+		return "*big.Int", nil
+	case abi.SliceTy:
+		elem, err := g.goType(*t.Elem, tupleHint)
+		if err != nil {
+			return "", err
+		}
+		return "[]" + elem, nil
+	case abi.ArrayTy:
+		elem, err := g.goType(*t.Elem, tupleHint)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("[%d]%s", t.Size, elem), nil
+	case abi.TupleTy:
+		return g.tuple(t, tupleHint)
+	}
+	return "", fmt.Errorf("unsupported type %s", t.String())
+}
+
+func (g *generator) tuple(t abi.Type, hint string) (string, error) {
+	tm := &tupleModel{}
+	var shape []string
+	for i, elem := range t.TupleElems {
+		name := abi.ToCamelCase(t.TupleRawNames[i])
+		typ, err := g.goType(*elem, hint+name)
+		if err != nil {
+			return "", err
+		}
+		tm.Fields = append(tm.Fields, &tupleField{Name: name, Type: typ, JSONName: toSnake(t.TupleRawNames[i])})
+		shape = append(shape, name+" "+typ)
+	}
+	tm.shape = strings.Join(shape, ";")
+	// prefer the struct name of the contract source, unless another tuple already took it
+	tm.Name = abi.ToCamelCase(t.TupleRawName)
+	if prev, ok := g.tuples[tm.Name]; tm.Name == "" || ok && prev.shape != tm.shape {
+		tm.Name = hint
+	}
+	if prev, ok := g.tuples[tm.Name]; ok {
+		if prev.shape != tm.shape {
+			return "", fmt.Errorf("tuple types conflict on name %s", tm.Name)
+		}
+		return tm.Name, nil
+	}
+	g.tuples[tm.Name] = tm
+	g.tupleOrder = append(g.tupleOrder, tm.Name)
+	return tm.Name, nil
+}
+
+// Expression decoding the value at position i of the unpacked log data
+func (g *generator) decodeData(t abi.Type, goType string, i int) string {
+	if hasTuple(t) {
+		// the abi package decodes tuples into anonymous structs, which are copied into the named ones
+		return fmt.Sprintf("*abi.ConvertType(vals[%d], new(%s)).(*%s)", i, goType, goType)
+	}
+	return fmt.Sprintf("vals[%d].(%s)", i, goType)
+}
+
+// SQL type of the column of an ABI type, along with the row field type and the expression of its
+// value. Addresses and hashes are stored as hex, like sprint stores block hashes, and integers that
+// do not fit a BIGINT as NUMERIC
+func (g *generator) column(t abi.Type, field string) (sqlType, rowType, value string, isJSON bool) {
+	switch t.T {
+	case abi.AddressTy, abi.HashTy:
+		return "TEXT", "string", field + ".Hex()", false
+	case abi.BoolTy:
+		return "BOOLEAN", "bool", field, false
+	case abi.StringTy:
+		return "TEXT", "string", field, false
+	case abi.BytesTy:
+		return "BYTEA", "[]byte", field, false
+	case abi.FixedBytesTy:
+		g.imports["github.com/ethereum/go-ethereum/common/hexutil"] = struct{}{}
+		return "TEXT", "string", "hexutil.Encode(" + field + "[:])", false
+	case abi.IntTy, abi.UintTy:
+		// bits needed by the value as a signed integer
+		bits := t.Size
+		if t.T == abi.UintTy {
+			bits++
+		}
+		switch {
+		case bits <= 16:
+			sqlType = "SMALLINT"
+		case bits <= 32:
+			sqlType = "INTEGER"
+		case bits <= 64:
+			sqlType = "BIGINT"
+		case t.Size == 64:
+			// database/sql drivers reject uint64 values with the high bit set
+			g.imports["strconv"] = struct{}{}
+			return "NUMERIC(20,0)", "string", "strconv.FormatUint(" + field + ", 10)", false
+		default:
+			return "NUMERIC(78,0)", "string", field + ".String()", false
+		}
+		switch t.Size {
+		case 8, 16, 32, 64:
+			return sqlType, fmt.Sprintf("%s%d", intKind(t), t.Size), field, false
+		}
+		// sizes such as int24 are decoded as big integers
+		return sqlType, "int64", field + ".Int64()", false
+	}
+	// arrays, slices and tuples
+	g.imports["encoding/json"] = struct{}{}
+	return "JSONB", "string", field, true
+}
+
+func intKind(t abi.Type) string {
+	if t.T == abi.IntTy {
+		return "int"
+	}
+	return "uint"
+}
+
+func isHashedTopic(t abi.Type) bool {
+	switch t.T {
+	case abi.StringTy, abi.BytesTy, abi.SliceTy, abi.ArrayTy, abi.TupleTy:
+		return true
+	}
+	return false
+}
+
+func hasTuple(t abi.Type) bool {
+	switch t.T {
+	case abi.TupleTy:
+		return true
+	case abi.SliceTy, abi.ArrayTy:
+		return hasTuple(*t.Elem)
+	}
+	return false
+}
+
+// Returns the entries of the ABI that are selected events, as a JSON array
+func selectEvents(input []byte, events []string) ([]byte, error) {
+	input = bytes.TrimSpace(input)
+	if len(input) > 0 && input[0] == '{' {
+		var artifact struct {
+			ABI json.RawMessage `json:"abi"`
+		}
+		err := json.Unmarshal(input, &artifact)
+		if err != nil {
+			return nil, fmt.Errorf("invalid abi: %w", err)
+		}
+		if artifact.ABI == nil {
+			return nil, errors.New("invalid abi: object has no abi field")
+		}
+		input = artifact.ABI
+	}
+	var entries []json.RawMessage
+	err := json.Unmarshal(input, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("invalid abi: %w", err)
+	}
+	want := make(map[string]bool, len(events))
+	for _, name := range events {
+		want[name] = false
+	}
+	selected := make([]json.RawMessage, 0, len(entries))
+	for _, entry := range entries {
+		var head struct {
+			Type string `json:"type"`
+			Name string `json:"name"`
+		}
+		err := json.Unmarshal(entry, &head)
+		if err != nil {
+			return nil, fmt.Errorf("invalid abi: %w", err)
+		}
+		if head.Type != "event" {
+			continue
+		}
+		if _, ok := want[head.Name]; !ok && len(events) > 0 {
+			continue
+		}
+		want[head.Name] = true
+		var compact bytes.Buffer
+		err = json.Compact(&compact, entry)
+		if err != nil {
+			return nil, err
+		}
+		selected = append(selected, compact.Bytes())
+	}
+	for _, name := range events {
+		if !want[name] {
+			return nil, fmt.Errorf("abi has no event %s", name)
+		}
+	}
+	return json.Marshal(selected)
+}
+
+// Rejects events whose generated identifiers collide with each other or with the package's own
+func checkNames(events []*eventModel) error {
+	seen := map[string]string{"Uploader": "", "Events": "", "Tables": "", "NewUploader": "", "eventRow": "", "parsedABI": ""}
+	tables := make(map[string]string, len(events))
+	for _, ev := range events {
+		for _, name := range []string{ev.Type, ev.Row} {
+			if other, ok := seen[name]; ok {
+				if other == "" {
+					return fmt.Errorf("event %s collides with the generated %s", ev.RawName, name)
+				}
+				return fmt.Errorf("events %s and %s both generate %s", other, ev.RawName, name)
+			}
+			seen[name] = ev.RawName
+		}
+		if other, ok := tables[ev.Table]; ok {
+			return fmt.Errorf("events %s and %s both use table %s", other, ev.RawName, ev.Table)
+		}
+		tables[ev.Table] = ev.RawName
+	}
+	return nil
+}
+
+func render(t *template.Template, m *fileModel) ([]byte, error) {
+	var buf bytes.Buffer
+	err := t.Execute(&buf, m)
+	if err != nil {
+		return nil, err
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("generated invalid code: %w", err)
+	}
+	return src, nil
+}
+
+func quoteABI(abiJSON []byte) string {
+	if bytes.IndexByte(abiJSON, '`') < 0 {
+		return "`" + string(abiJSON) + "`"
+	}
+	return strconv.Quote(string(abiJSON))
+}
+
+// Quotes each part of a possibly schema qualified SQL identifier
+func quoteIdentifier(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = `"` + strings.ReplaceAll(part, `"`, `""`) + `"`
+	}
+	return strings.Join(parts, ".")
+}
+
+// Appends suffix to name while it is taken
+func unique(name, suffix string, taken []string) string {
+	for contains(taken, name) {
+		name += suffix
+	}
+	return name
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Converts a camel case name to snake case, e.g. sqrtPriceX96 to sqrt_price_x96 and tokenID to token_id
+func toSnake(name string) string {
+	runes := []rune(strings.Trim(name, "_"))
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if prev != '_' && (unicode.IsLower(prev) || unicode.IsDigit(prev) || unicode.IsUpper(prev) && nextLower) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToLower(s[:1]) + s[1:]
+}
+
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		if r != '_' && !unicode.IsLetter(r) && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return true
+}
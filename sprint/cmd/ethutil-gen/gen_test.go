@@ -0,0 +1,141 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testABI = `{"abi":[
+	{"type":"event","name":"Swap","inputs":[
+		{"name":"sender","type":"address","indexed":true},
+		{"name":"amount0","type":"int256","indexed":false},
+		{"name":"sqrtPriceX96","type":"uint160","indexed":false},
+		{"name":"tick","type":"int24","indexed":false}
+	]},
+	{"type":"event","name":"Order","inputs":[
+		{"name":"address","type":"address","indexed":false},
+		{"name":"order","type":"tuple","internalType":"struct Book.Order","indexed":false,"components":[
+			{"name":"id","type":"uint64"},
+			{"name":"owner","type":"address"}
+		]},
+		{"name":"memo","type":"string","indexed":true},
+		{"name":"book","type":"tuple","internalType":"struct Book.Key","indexed":true,"components":[
+			{"name":"base","type":"address"},
+			{"name":"quote","type":"address"}
+		]}
+	]},
+	{"type":"event","name":"Anon","anonymous":true,"inputs":[]},
+	{"type":"function","name":"swap","inputs":[],"outputs":[]}
+]}`
+
+func TestGenerate(t *testing.T) {
+	out, err := Generate([]byte(testABI), Config{Package: "pool", TablePrefix: "univ3_"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := string(out.Events)
+	for _, want := range []string{
+		"package pool",
+		"type Swap struct",
+		"type BookOrder struct",
+		`Id    uint64         ` + "`json:\"id\"`",
+		// arguments colliding with the event metadata are renamed
+		"AddressArg  common.Address `json:\"address_arg\"`",
+		"e.Sender = topics[\"sender\"].(common.Address)",
+		"e.Order = *abi.ConvertType(vals[1], new(BookOrder)).(*BookOrder)",
+		// indexed strings and tuples only have their hash in the topic
+		"e.Memo = raw.Topics[1]",
+		"e.Book = raw.Topics[2]",
+		"Tick:         e.Tick.Int64(),",
+		"if len(raw.Topics) != 2 || raw.Topics[0] != ev.ID {",
+	} {
+		if !strings.Contains(src, want) {
+			t.Errorf("events missing %q", want)
+		}
+	}
+	if strings.Contains(src, "type Anon ") {
+		t.Error("anonymous event should not be generated")
+	}
+	schema := string(out.Schema)
+	for _, want := range []string{
+		`CREATE TABLE IF NOT EXISTS "univ3_order" (`,
+		`"sqrt_price_x96" NUMERIC(78,0) NOT NULL,`,
+		`"tick" INTEGER NOT NULL,`,
+		`"order" JSONB NOT NULL,`,
+		"PRIMARY KEY (block_number, tx_hash, log_index)",
+	} {
+		if !strings.Contains(schema, want) {
+			t.Errorf("schema missing %q", want)
+		}
+	}
+	if !strings.Contains(string(out.Uploader), "func (u *Uploader) UploadEventSet(") {
+		t.Error("uploader not generated")
+	}
+}
+
+func TestGenerateSelectEvents(t *testing.T) {
+	out, err := Generate([]byte(testABI), Config{Package: "pool", Events: []string{"Swap"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(out.Events), "type Order struct") {
+		t.Error("unselected event was generated")
+	}
+	_, err = Generate([]byte(testABI), Config{Package: "pool", Events: []string{"Mint"}})
+	if err == nil {
+		t.Error("expected error for missing event")
+	}
+	_, err = Generate([]byte(testABI), Config{Package: "pool-v3"})
+	if err == nil {
+		t.Error("expected error for invalid package name")
+	}
+}
+
+func TestToSnake(t *testing.T) {
+	for in, want := range map[string]string{
+		"sqrtPriceX96": "sqrt_price_x96",
+		"tokenID":      "token_id",
+		"amount0":      "amount0",
+		"_from":        "from",
+		"IDToken":      "id_token",
+		"owner_":       "owner",
+	} {
+		if got := toSnake(in); got != want {
+			t.Errorf("toSnake(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// Builds the generated files as a package of the module, so they are checked against the sprint and
+// manager packages they use
+func TestGeneratedCodeBuilds(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds a package")
+	}
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command not found")
+	}
+	out, err := Generate([]byte(testABI), Config{Package: "pool", TablePrefix: "univ3_"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the leading underscore keeps the directory out of ./... patterns of concurrent builds
+	dir, err := os.MkdirTemp(".", "_gen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, src := range map[string][]byte{"events.go": out.Events, "uploader.go": out.Uploader} {
+		if err := os.WriteFile(filepath.Join(dir, name), src, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd := exec.Command(goBin, "vet", "./"+filepath.Base(dir))
+	if msg, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("generated code does not build: %v\n%s", err, msg)
+	}
+}
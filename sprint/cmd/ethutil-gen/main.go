@@ -0,0 +1,83 @@
+// Command ethutil-gen generates manager.Event implementations for the events of a contract ABI,
+// along with the CREATE TABLE statements of their tables and an EventUploader inserting into them.
+//
+//	ethutil-gen -abi IUniswapV3Pool.json -out ./univ3 -table-prefix univ3_
+//
+// writes events.go, schema.sql and uploader.go to ./univ3. events.go and schema.sql are rewritten
+// whenever the command runs, while uploader.go is a starting point that is only written if it does
+// not exist yet, unless -force is set.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func main() {
+	abiPath := flag.String("abi", "", "path of the JSON ABI or compiler artifact, - for stdin")
+	out := flag.String("out", ".", "output directory")
+	pkg := flag.String("pkg", "", "package name, defaults to the name of the output directory")
+	events := flag.String("events", "", "comma separated names of the events to generate, every event if empty")
+	prefix := flag.String("table-prefix", "", "prefix of the table names")
+	force := flag.Bool("force", false, "overwrite an existing uploader.go")
+	flag.Parse()
+	err := run(*abiPath, *out, *pkg, *events, *prefix, *force)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ethutil-gen:", err)
+		os.Exit(1)
+	}
+}
+
+func run(abiPath, out, pkg, events, prefix string, force bool) error {
+	if abiPath == "" {
+		return errors.New("-abi is required")
+	}
+	var input []byte
+	var err error
+	if abiPath == "-" {
+		input, err = io.ReadAll(os.Stdin)
+	} else {
+		input, err = os.ReadFile(abiPath)
+	}
+	if err != nil {
+		return err
+	}
+	if pkg == "" {
+		dir, err := filepath.Abs(out)
+		if err != nil {
+			return err
+		}
+		pkg = strings.ReplaceAll(filepath.Base(dir), "-", "_")
+	}
+	c := Config{Package: pkg, TablePrefix: prefix}
+	if events != "" {
+		c.Events = strings.Split(events, ",")
+	}
+	gen, err := Generate(input, c)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(out, 0o755)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(out, "events.go"), gen.Events, 0o644)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(out, "schema.sql"), gen.Schema, 0o644)
+	if err != nil {
+		return err
+	}
+	uploader := filepath.Join(out, "uploader.go")
+	if _, err := os.Stat(uploader); err == nil && !force {
+		fmt.Fprintln(os.Stderr, "ethutil-gen: keeping existing", uploader)
+		return nil
+	}
+	return os.WriteFile(uploader, gen.Uploader, 0o644)
+}
@@ -0,0 +1,315 @@
+package main
+
+import "text/template"
+
+var eventsTemplate = template.Must(template.New("events").Parse(`// Code generated by ethutil-gen. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+{{- if .HasJSON}}
+	"fmt"
+{{- end}}
+	"strings"
+{{range .StdImports}}	"{{.}}"
+{{end}}
+	"gfx.cafe/open/ghost"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+{{range .ModImports}}	"{{.}}"
+{{end}}	"github.com/tjudice/ethutil/sprint/manager"
+)
+
+const abiJSON = {{.ABI}}
+
+var parsedABI = func() abi.ABI {
+	parsed, err := abi.JSON(strings.NewReader(abiJSON))
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}()
+
+// Events returns an instance of every event of the package, to pass to manager.Manager.AddEventFilter
+func Events() []manager.Event {
+	return []manager.Event{
+{{range .Events}}		&{{.Type}}{},
+{{end}}	}
+}
+
+// Tables lists the tables of the events of the package
+var Tables = []string{
+{{range .Events}}	"{{.Table}}",
+{{end}}}
+
+// eventRow is implemented by the events of the package, see Uploader
+type eventRow interface {
+	manager.Event
+	// Returns the row inserted into the table of the event
+	row(info *manager.EventInfo) (any, error)
+	key() eventKey
+}
+
+// eventKey identifies the row of an event in its table
+type eventKey struct {
+	BlockNumber uint64 ` + "`" + `db:"block_number"` + "`" + `
+	TxHash      string ` + "`" + `db:"tx_hash"` + "`" + `
+	LogIndex    int    ` + "`" + `db:"log_index"` + "`" + `
+}
+{{if .HasIndexed}}
+// Decodes the indexed arguments whose topics hold their value. The topics of strings, bytes, arrays and
+// tuples only hold a hash, which ParseTopicsIntoMap fails on for tuples, so they are read directly
+func parseTopics(args abi.Arguments, topics []common.Hash) (map[string]any, error) {
+	var static abi.Arguments
+	var staticTopics []common.Hash
+	i := 0
+	for _, arg := range args {
+		if !arg.Indexed {
+			continue
+		}
+		switch arg.Type.T {
+		case abi.StringTy, abi.BytesTy, abi.SliceTy, abi.ArrayTy, abi.TupleTy:
+		default:
+			static = append(static, arg)
+			staticTopics = append(staticTopics, topics[i])
+		}
+		i++
+	}
+	out := make(map[string]any, len(static))
+	return out, abi.ParseTopicsIntoMap(out, static, staticTopics)
+}
+{{end}}{{if .HasJSON}}
+func jsonColumn(v any) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+{{end}}{{range .Tuples}}
+type {{.Name}} struct {
+{{range .Fields}}	{{.Name}} {{.Type}} ` + "`" + `json:"{{.JSONName}}"` + "`" + `
+{{end}}}
+{{end}}{{range .Events}}
+// {{.Type}} is the {{.Signature}} event, uploaded to the {{.Table}} table
+type {{.Type}} struct {
+	Address     common.Address ` + "`" + `json:"address"` + "`" + `
+	BlockNumber uint64         ` + "`" + `json:"block_number"` + "`" + `
+	TxHash      common.Hash    ` + "`" + `json:"tx_hash"` + "`" + `
+	LogIndex    int            ` + "`" + `json:"log_index"` + "`" + `
+{{range .Fields}}	{{.Name}} {{.Type}} ` + "`" + `json:"{{.Column}}"` + "`" + `
+{{end}}}
+
+var _ manager.Event = (*{{.Type}})(nil)
+
+func (e *{{.Type}}) Copy() manager.Event {
+	return &{{.Type}}{}
+}
+
+// Process decodes the log. Logs with the same signature but a different number of indexed
+// arguments, such as ERC-721 transfers for an ERC-20 Transfer event, or that do not decode as the
+// event's arguments are skipped
+func (e *{{.Type}}) Process(l manager.FilterUpdater, raw *ghost.ErigonLog) (bool, error) {
+	ev := parsedABI.Events[{{printf "%q" .Name}}]
+	if len(raw.Topics) != {{.Topics}} || raw.Topics[0] != ev.ID {
+		return false, nil
+	}
+{{- if .Indexed}}
+	topics, err := parseTopics(ev.Inputs, raw.Topics[1:])
+	if err != nil {
+		return false, nil
+	}
+{{- end}}
+{{- if .Data}}
+	vals, err := ev.Inputs.NonIndexed().Unpack(raw.Data)
+	if err != nil {
+		return false, nil
+	}
+{{- end}}
+	e.Address = raw.Address
+	e.BlockNumber = raw.BlockNumber
+	e.TxHash = raw.TxHash
+	e.LogIndex = int(raw.Index)
+{{range .Fields}}	e.{{.Name}} = {{.Decode}}
+{{end}}	return true, nil
+}
+
+func (e *{{.Type}}) Table() string {
+	return "{{.Table}}"
+}
+
+func (e *{{.Type}}) EventHash() common.Hash {
+	return parsedABI.Events[{{printf "%q" .Name}}].ID
+}
+
+func (e *{{.Type}}) GetLogIndex() int {
+	return e.LogIndex
+}
+
+type {{.Row}} struct {
+	BlockNumber uint64 ` + "`" + `db:"block_number"` + "`" + `
+	TxHash      string ` + "`" + `db:"tx_hash"` + "`" + `
+	LogIndex    int    ` + "`" + `db:"log_index"` + "`" + `
+	Address     string ` + "`" + `db:"address"` + "`" + `
+	Timestamp   uint64 ` + "`" + `db:"timestamp"` + "`" + `
+{{range .Fields}}	{{.Name}} {{.RowType}} ` + "`" + `db:"{{.Column}}"` + "`" + `
+{{end}}}
+
+func (e *{{.Type}}) row(info *manager.EventInfo) (any, error) {
+	r := &{{.Row}}{
+		BlockNumber: e.BlockNumber,
+		TxHash:      e.TxHash.Hex(),
+		LogIndex:    e.LogIndex,
+		Address:     e.Address.Hex(),
+		Timestamp:   info.Timestamp,
+{{range .Fields}}{{if not .JSON}}		{{.Name}}: {{.Value}},
+{{end}}{{end}}	}
+{{- if .JSON}}
+	var err error
+{{- end}}
+{{- range .Fields}}{{if .JSON}}
+	r.{{.Name}}, err = jsonColumn({{.Value}})
+	if err != nil {
+		return nil, fmt.Errorf("error encoding {{.Arg}}: %w", err)
+	}
+{{- end}}{{end}}
+	return r, nil
+}
+
+func (e *{{.Type}}) key() eventKey {
+	return eventKey{BlockNumber: e.BlockNumber, TxHash: e.TxHash.Hex(), LogIndex: e.LogIndex}
+}
+{{end}}`))
+
+var uploaderTemplate = template.Must(template.New("uploader").Parse(`package {{.Package}}
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/tjudice/ethutil/sprint/manager"
+	"github.com/upper/db/v4"
+)
+
+// Uploader is a manager.EventUploader inserting the events of the package into the tables of
+// schema.sql. It was generated by ethutil-gen as a starting point: addresses added through
+// manager.FilterUpdater are not persisted, and validation only compares the keys of stored rows.
+type Uploader struct {
+	// Addresses whose events are uploaded, in addition to the manager's allowed addresses
+	Addresses []common.Address
+}
+
+var (
+	_ manager.EventUploader     = (*Uploader)(nil)
+	_ manager.LaneEventUploader = (*Uploader)(nil)
+)
+
+func NewUploader(addrs ...common.Address) *Uploader {
+	return &Uploader{Addresses: addrs}
+}
+
+func (u *Uploader) GetActiveAddresses(ctx context.Context, d db.Session, block int) ([]common.Address, error) {
+	return u.Addresses, nil
+}
+
+func (u *Uploader) UploadEventSet(ctx context.Context, d db.Session, eventInfo []*manager.EventInfo) error {
+	rows := make(map[string][]any)
+	for _, info := range eventInfo {
+		ev, ok := info.EventLog.(eventRow)
+		if !ok {
+			return fmt.Errorf("unexpected event %T", info.EventLog)
+		}
+		row, err := ev.row(info)
+		if err != nil {
+			return err
+		}
+		rows[ev.Table()] = append(rows[ev.Table()], row)
+	}
+	for table, tableRows := range rows {
+		b := d.SQL().InsertInto(table).Batch(1000)
+		go func(tableRows []any) {
+			defer b.Done()
+			for _, row := range tableRows {
+				b.Values(row)
+			}
+		}(tableRows)
+		err := b.Wait()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *Uploader) ValidateEventSet(ctx context.Context, d db.Session, startBlock, endBlock int, eventInfo []*manager.EventInfo) (bool, error) {
+	return u.ValidateTableEventSet(ctx, d, Tables, startBlock, endBlock, eventInfo)
+}
+
+// ValidateTableEventSet compares the keys of the rows stored in each table for the range against
+// the keys of the events
+func (u *Uploader) ValidateTableEventSet(ctx context.Context, d db.Session, tables []string, startBlock, endBlock int, eventInfo []*manager.EventInfo) (bool, error) {
+	want := make(map[string][]eventKey, len(tables))
+	for _, info := range eventInfo {
+		ev, ok := info.EventLog.(eventRow)
+		if !ok {
+			return false, fmt.Errorf("unexpected event %T", info.EventLog)
+		}
+		want[ev.Table()] = append(want[ev.Table()], ev.key())
+	}
+	for _, table := range tables {
+		var stored []eventKey
+		err := d.SQL().Select("block_number", "tx_hash", "log_index").From(table).
+			Where("block_number >= ? AND block_number <= ?", startBlock, endBlock).
+			OrderBy("block_number", "log_index").All(&stored)
+		if err != nil {
+			return false, err
+		}
+		keys := want[table]
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].BlockNumber != keys[j].BlockNumber {
+				return keys[i].BlockNumber < keys[j].BlockNumber
+			}
+			return keys[i].LogIndex < keys[j].LogIndex
+		})
+		if len(keys) != len(stored) {
+			return false, nil
+		}
+		for i := range keys {
+			if keys[i] != stored[i] {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+func (u *Uploader) DeleteEventRange(ctx context.Context, d db.Session, startBlock, endBlock int) error {
+	return u.DeleteTableEventRange(ctx, d, Tables, startBlock, endBlock)
+}
+
+func (u *Uploader) DeleteTableEventRange(ctx context.Context, d db.Session, tables []string, startBlock, endBlock int) error {
+	for _, table := range tables {
+		_, err := d.SQL().DeleteFrom(table).Where("block_number >= ? AND block_number <= ?", startBlock, endBlock).ExecContext(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+`))
+
+var schemaTemplate = template.Must(template.New("schema").Parse(`-- Code generated by ethutil-gen. DO NOT EDIT.
+{{range .Events}}
+-- {{.Signature}}
+CREATE TABLE IF NOT EXISTS {{.QuotedTable}} (
+	block_number BIGINT NOT NULL,
+	tx_hash TEXT NOT NULL,
+	log_index INTEGER NOT NULL,
+	address TEXT NOT NULL,
+	timestamp BIGINT NOT NULL,
+{{range .Fields}}	"{{.Column}}" {{.SQLType}} NOT NULL,
+{{end}}	PRIMARY KEY (block_number, tx_hash, log_index)
+);
+{{end}}`))
@@ -2,23 +2,92 @@ package sprint
 
 import (
 	"context"
+	"errors"
+	"sync"
 	"time"
 
 	"gfx.cafe/open/ghost"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
 	"tuxpa.in/a/zlog/log"
 )
 
 type EventBatch struct {
 	progressLog *StageProgressLog
-	Events      []*ghost.ErigonLog
-	Blocks      map[int]*BlockInfo
+	// first block covered by the batch. Validators only re-query from the block a reorg forked off at
+	fromBlock int
+	// sub-ranges the range was bisected into when the provider rejected it as too large
+	ranges []stageFilterRange
+	// filters the logs were queried with, across every sub-range
+	filters []ethereum.FilterQuery
+	// header of the last block in the range, used to anchor the stored block hashes
+	endHeader *BlockHeader
+	// set by validators when the stored block hashes are still canonical and nothing was re-queried
+	canonical bool
+	// whether the range was at or below the finalized block when it was fetched
+	finalized bool
+	// whether the batch came from a finalization or forced pass rather than a spaced validator
+	finalizing bool
+	// whether the range is backfilled below the main lane, see Backfill
+	backfill bool
+	// set when the range could not be fetched within the retry policy
+	err    error
+	Events []*ghost.ErigonLog
+	Blocks map[int]*BlockInfo
+	// receipts of the transactions that emitted Events, keyed by transaction hash. Only set
+	// when SprintConfig.FetchReceipts is enabled
+	Receipts map[common.Hash]*ReceiptInfo
+}
+
+// Filters returns the filters the batch's logs were queried with, one set per sub-range queried. Empty
+// when nothing was queried, such as for validated ranges whose blocks were still canonical
+func (b *EventBatch) Filters() []ethereum.FilterQuery {
+	return b.filters
+}
+
+// Replaces the fetched contents of the batch with those of a fresh fetch of its range
+func (b *EventBatch) refetched(fresh *EventBatch) {
+	b.ranges = fresh.ranges
+	b.filters = fresh.filters
+	b.endHeader = fresh.endHeader
+	b.Events = fresh.Events
+	b.Blocks = fresh.Blocks
+	b.Receipts = fresh.Receipts
+}
+
+// Lane returns the lane of the batch's range, empty for the main lane. See StageProgressLog.Lane.
+// Ranges of HistoryLane query the main lane's filters, so they are reported as the main lane
+func (b *EventBatch) Lane() string {
+	// batches built outside of sprint have no range
+	if b.progressLog == nil || b.progressLog.Lane == HistoryLane {
+		return ""
+	}
+	return b.progressLog.Lane
+}
+
+// Backfill reports whether the batch's range is backfilled below the main lane, in HistoryLane or in
+// the lane of an event group that joins the main lane. Such ranges commit independently of the main
+// lane, which may already have committed the blocks above them, so addresses their events discover
+// are missing from those blocks.
+func (b *EventBatch) Backfill() bool {
+	return b.backfill
 }
 
 type task struct {
 	finished         chan *EventBatch
+	validation       bool
+	finalizing       bool
 	StageProgressLog *StageProgressLog
 }
 
+// kind labels the task in metrics
+func (t *task) kind() string {
+	if t.validation {
+		return "validate"
+	}
+	return "execute"
+}
+
 type executionQueue struct {
 	s               *Sprint
 	taskQueue       chan *task
@@ -29,66 +98,176 @@ type executionQueue struct {
 	// validation must also be done in order since a factory event that is reorged out/in
 	// may have later effects on events
 	validationSequence chan chan *EventBatch
+	// closed to let the queue finish its queued tasks and exit
+	draining  chan struct{}
+	drainOnce sync.Once
 }
 
-func (s *Sprint) newExecutionQueue() *executionQueue {
+func (s *Sprint) newExecutionQueue(size int) *executionQueue {
 	return &executionQueue{
 		s:                  s,
-		taskQueue:          make(chan *task, s.c.ExecutionQueueSize),
+		taskQueue:          make(chan *task, size),
 		validationQueue:    make(chan *task, s.c.ValidatorQueueSize),
-		uploadSequence:     make(chan chan *EventBatch, s.c.ExecutionQueueSize),
+		uploadSequence:     make(chan chan *EventBatch, size),
 		validationSequence: make(chan chan *EventBatch, s.c.ValidatorQueueSize),
+		draining:           make(chan struct{}),
 	}
 }
 
+// Runs workers and the upload/validation sequencers until the context is cancelled, or until drain is
+// called and every queued task has been executed and committed
 func (e *executionQueue) run(ctx context.Context, numWorkers int) error {
+	wg := sync.WaitGroup{}
 	// adds all workers so they can process tasks
 	for i := 0; i < numWorkers; i++ {
-		e.addWorker(ctx)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.runWorker(ctx)
+		}()
 	}
+	wg.Add(1)
 	go func() {
-		for {
+		defer wg.Done()
+		e.runValidationSequencer(ctx)
+	}()
+	e.runUploadSequencer(ctx)
+	wg.Wait()
+	return ctx.Err()
+}
+
+// Allows the queue to be run again after it was drained
+func (e *executionQueue) resetDrain() {
+	e.draining = make(chan struct{})
+	e.drainOnce = sync.Once{}
+}
+
+// Stops the queue once all queued tasks are finished. No tasks may be added after calling drain
+func (e *executionQueue) drain() {
+	e.drainOnce.Do(func() {
+		close(e.draining)
+	})
+}
+
+func (e *executionQueue) runValidationSequencer(ctx context.Context) {
+	for {
+		var validationWait chan *EventBatch
+		select {
+		case <-ctx.Done():
+			return
+		case validationWait = <-e.validationSequence:
+		case <-e.draining:
 			select {
-			case <-ctx.Done():
+			case validationWait = <-e.validationSequence:
+			default:
 				return
-			case validationWait := <-e.validationSequence:
-				// ensure we sequence the validator results correctly. First channel wait will take in
-				// the sequenced task, the second waits for the results
-				batch := <-validationWait
-				// we cannot validate future ranges until all past ranges are validated, so must loop here
-				for {
-					err := e.s.validateBatch(ctx, batch)
-					if err != nil {
-						log.Println(err)
-						continue
-					}
-					break
-				}
-				// update sprint validator progress
-				e.s.updateValidatorProgress(batch.progressLog.ValidatorPasses, batch.progressLog.EndBlock)
 			}
 		}
-	}()
+		// ensure we sequence the validator results correctly. First channel wait will take in
+		// the sequenced task, the second waits for the results
+		var batch *EventBatch
+		select {
+		case <-ctx.Done():
+			return
+		case batch = <-validationWait:
+		}
+		// we cannot validate future ranges until all past ranges are validated, so must retry here
+		if batch.err == nil && e.s.hasLane(batch.progressLog.Lane) {
+			batch.err = e.commitWithRetry(ctx, "validation_upload", batch, e.s.validateBatch, e.s.refetchValidation)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		// validation of ranges in removed lanes is dropped along with their progress
+		if !e.s.hasLane(batch.progressLog.Lane) {
+			continue
+		}
+		if batch.err != nil {
+			// the range stays finished, a later pass will validate it again
+			e.s.releaseValidation(ctx, batch)
+			continue
+		}
+		// update sprint validator progress. Finalization and forced passes are not tied to a validator
+		if !batch.finalizing {
+			e.s.updateValidatorProgress(batch.progressLog.ValidatorPasses, batch.progressLog.EndBlock)
+		}
+	}
+}
+
+func (e *executionQueue) runUploadSequencer(ctx context.Context) {
+	// start block of the range that last failed in each lane. Ranges queued behind it cannot be
+	// uploaded, since they may depend on its events
+	parkedFrom := make(map[string]int)
 	for {
+		var uploadWait chan *EventBatch
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
-		case uploadWait := <-e.uploadSequence:
-			// ensure we sequence the validator results correctly. First channel wait will take in
-			// the sequenced task, the second waits for the results
-			batch := <-uploadWait
-			// we cannot insert future ranges until all past ranges are inserted
-			for {
-				err := e.s.uploadBatch(ctx, batch)
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-				break
+			return
+		case uploadWait = <-e.uploadSequence:
+		case <-e.draining:
+			select {
+			case uploadWait = <-e.uploadSequence:
+			default:
+				return
+			}
+		}
+		// ensure we sequence the validator results correctly. First channel wait will take in
+		// the sequenced task, the second waits for the results
+		var batch *EventBatch
+		select {
+		case <-ctx.Done():
+			return
+		case batch = <-uploadWait:
+		}
+		// ranges of removed lanes are dropped along with their progress
+		if !e.s.hasLane(batch.progressLog.Lane) {
+			continue
+		}
+		if from, ok := parkedFrom[batch.progressLog.Lane]; ok && batch.progressLog.StartBlock > from {
+			e.s.releaseRange(ctx, batch.progressLog)
+			continue
+		}
+		// we cannot insert future ranges until all past ranges are inserted
+		if batch.err == nil {
+			batch.err = e.commitWithRetry(ctx, "upload", batch, e.s.uploadBatch, e.s.refetchUpload)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if batch.err != nil {
+			e.s.parkRange(ctx, batch)
+			parkedFrom[batch.progressLog.Lane] = batch.progressLog.StartBlock
+			continue
+		}
+		delete(parkedFrom, batch.progressLog.Lane)
+		// update sprint progress. Ranges reset with ResetRange lie below the head, which never moves back
+		if l := e.s.lane(batch.progressLog.Lane); l != nil {
+			storeMax(&l.head, int64(batch.progressLog.EndBlock))
+		} else if batch.progressLog.Lane == "" {
+			storeMax(&e.s.lastSuccessfulBlock, int64(batch.progressLog.EndBlock))
+		}
+	}
+}
+
+// Commits a batch, retrying failures according to the sprint retry policy. Batches the manager
+// rejects with ErrStaleFilters are fetched again with refetch before they are retried
+func (e *executionQueue) commitWithRetry(ctx context.Context, kind string, batch *EventBatch, commit, refetch func(context.Context, *EventBatch) error) error {
+	for attempt := 1; ; attempt++ {
+		err := commit(ctx, batch)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		if errors.Is(err, ErrStaleFilters) {
+			if ferr := refetch(ctx, batch); ferr != nil {
+				err = ferr
 			}
-			// update sprint progress
-			e.s.lastSuccessfulBlock.Store(int64(batch.progressLog.EndBlock))
 		}
+		log.Err(err).Int("start_block", batch.progressLog.StartBlock).Int("end_block", batch.progressLog.EndBlock).
+			Int("attempt", attempt).Msg("error committing range")
+		if !e.s.c.Retry.wait(ctx, attempt) {
+			return err
+		}
+		e.s.c.Metrics.incRetries(kind)
 	}
 }
 
@@ -106,7 +285,7 @@ func (e *executionQueue) addTask(ctx context.Context, taskParams *StageProgressL
 	}
 }
 
-func (e *executionQueue) addValidationTask(ctx context.Context, taskParams *StageProgressLog) {
+func (e *executionQueue) addValidationTask(ctx context.Context, taskParams *StageProgressLog, finalizing bool) {
 	// create response channel for validation goroutine to read on completion
 	finished := make(chan *EventBatch, 1)
 	// update start timestamp for logging in progress table
@@ -116,25 +295,40 @@ func (e *executionQueue) addValidationTask(ctx context.Context, taskParams *Stag
 	// send task to task queue with response channel included for sending on completion
 	e.validationQueue <- &task{
 		finished:         finished,
+		validation:       true,
+		finalizing:       finalizing,
 		StageProgressLog: taskParams,
 	}
 }
 
-func (e *executionQueue) addWorker(ctx context.Context) {
-	go func() {
-		for {
+func (e *executionQueue) runWorker(ctx context.Context) {
+	for {
+		var t *task
+		select {
+		case <-ctx.Done():
+			return
+		case t = <-e.taskQueue:
+		case t = <-e.validationQueue:
+		case <-e.draining:
+			// finish anything still queued before exiting
 			select {
-			case <-ctx.Done():
+			case t = <-e.taskQueue:
+			case t = <-e.validationQueue:
+			default:
 				return
-			case task := <-e.taskQueue:
-				// must ensure tasks are sequenced correctly when scheduling
-				res := e.s.executeTask(ctx, task)
-				task.finished <- res
-			case task := <-e.validationQueue:
-				// must ensure tasks are sequenced correctly when scheduling
-				res := e.s.validateTask(ctx, task)
-				task.finished <- res
 			}
 		}
-	}()
+		// must ensure tasks are sequenced correctly when scheduling
+		var res *EventBatch
+		if t.validation {
+			res = e.s.validateTask(ctx, t)
+		} else {
+			res = e.s.executeTask(ctx, t)
+		}
+		// tasks are abandoned when the context is cancelled mid-fetch
+		if res == nil {
+			return
+		}
+		t.finished <- res
+	}
 }
@@ -5,8 +5,10 @@ go 1.20
 require (
 	gfx.cafe/open/ghost v0.2.14
 	gfx.cafe/open/jrpc v0.2.15
+	gfx.cafe/open/websocket v1.9.2
 	github.com/ethereum/go-ethereum v1.12.2
 	github.com/holiman/uint256 v1.2.3
+	github.com/prometheus/client_golang v1.16.0
 	github.com/tjudice/util/go/concurrency v0.0.0-20230808051618-6f8b291fb035
 	github.com/upper/db/v4 v4.6.0
 	golang.org/x/sync v0.3.0
@@ -14,10 +16,11 @@ require (
 )
 
 require (
-	gfx.cafe/open/websocket v1.9.2 // indirect
 	gfx.cafe/util/go/bufpool v0.0.0-20230319135926-e85529146a9f // indirect
 	gfx.cafe/util/go/generic v0.0.0-20230502013805-237fcc25d586 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/btcsuite/btcd/btcec/v2 v2.3.2 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/deckarep/golang-set v1.8.0 // indirect
 	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.1.0 // indirect
@@ -25,15 +28,23 @@ require (
 	github.com/go-faster/jx v1.0.0 // indirect
 	github.com/go-stack/stack v1.8.1 // indirect
 	github.com/goccy/go-json v0.10.2 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
 	github.com/klauspost/compress v1.16.7 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.18 // indirect
+	github.com/mattn/go-sqlite3 v1.14.17 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.4 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/prometheus/client_model v0.3.0 // indirect
+	github.com/prometheus/common v0.42.0 // indirect
+	github.com/prometheus/procfs v0.10.1 // indirect
 	github.com/rs/zerolog v1.29.0 // indirect
 	github.com/segmentio/asm v1.2.0 // indirect
+	github.com/segmentio/fasthash v1.0.3 // indirect
 	github.com/stretchr/testify v1.8.4 // indirect
 	github.com/tjudice/util/go/generic v0.0.0-20230808051618-6f8b291fb035 // indirect
 	golang.org/x/crypto v0.11.0 // indirect
 	golang.org/x/sys v0.10.0 // indirect
+	google.golang.org/protobuf v1.30.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,104 @@
+package sprint
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"tuxpa.in/a/zlog/log"
+)
+
+// HistoryLane is the lane blocks below the head window are backfilled in when
+// SprintConfig.BackfillWorkers is set. Its ranges query the main lane's filters, and are reported to
+// managers as the main lane.
+const HistoryLane = "@history"
+
+// default number of stages below the chain head the main lane starts at when history is split off
+const defaultHeadWindowStages = 10
+
+func (s *Sprint) historyEnabled() bool {
+	return s.c.BackfillWorkers > 0
+}
+
+func (s *Sprint) headWindow() uint64 {
+	if s.c.HeadWindow > 0 {
+		return s.c.HeadWindow
+	}
+	return defaultHeadWindowStages * (s.c.BlocksPerStage + 1)
+}
+
+// Splits the blocks from StartBlock up to the head window off into the history lane the first time
+// the main lane is scheduled, or resumes the history lane of a previous run. Must hold scheduleMu
+func (s *Sprint) scheduleHistory(ctx context.Context, chainHead uint64) error {
+	if !s.historyEnabled() || s.historyChecked {
+		return nil
+	}
+	existing, err := s.store.Lane(ctx, HistoryLane)
+	if err == nil {
+		s.historyChecked = true
+		// the lane is kept until removed, even once fully backfilled, so its ranges are validated
+		return s.registerLane(ctx, HistoryLane, uint64(existing.StartBlock), false)
+	}
+	if !errors.Is(err, ErrNoProgress) {
+		return err
+	}
+	// the main lane already covers history on sprints that ran before history was split off
+	_, err = s.store.ScheduleHead(ctx, "")
+	if err == nil {
+		s.historyChecked = true
+		return nil
+	}
+	if !errors.Is(err, ErrNoProgress) {
+		return err
+	}
+	s.historyChecked = true
+	window := s.headWindow()
+	if chainHead < s.c.StartBlock+window {
+		return nil
+	}
+	// the main lane is scheduled from the block after the marker's end block
+	joinBlock := chainHead - window + 1
+	marker := &StageProgressLog{
+		PrimaryKey: "lane:" + HistoryLane,
+		Stage:      stageLane,
+		StartBlock: int(s.c.StartBlock),
+		EndBlock:   int(joinBlock) - 1,
+		Success:    StatusFinalized,
+		Msg:        fmt.Sprintf("History split off at %s", time.Now().String()),
+		Lane:       HistoryLane,
+	}
+	rngs := divideStageRanges(s.c.StartBlock, joinBlock-1, s.stageSize.Load())
+	if last := rngs[len(rngs)-1]; last.end < joinBlock-1 {
+		rngs = append(rngs, stageFilterRange{start: last.end + 1, end: joinBlock - 1})
+	}
+	ranges, err := createScheduleLogs(HistoryLane, rngs)
+	if err != nil {
+		return err
+	}
+	err = s.insertScheduledRanges(ctx, append([]*StageProgressLog{marker}, ranges...))
+	if err != nil {
+		return err
+	}
+	log.Info().Uint64("start_block", s.c.StartBlock).Uint64("join_block", joinBlock).Msg("split history off into its own lane")
+	return s.registerLane(ctx, HistoryLane, s.c.StartBlock, false)
+}
+
+// Claims history ranges until BackfillWorkers ranges wait for the history workers or their upload
+// sequence is full, so the lane is not held to one range per execute interval. Never blocks
+func (s *Sprint) queueHistory(ctx context.Context) {
+	q := s.historyQueue
+	if q == nil || s.lane(HistoryLane) == nil {
+		return
+	}
+	for len(q.taskQueue) < s.c.BackfillWorkers && len(q.uploadSequence) < cap(q.uploadSequence) {
+		next, err := s.store.NextRange(ctx, HistoryLane)
+		if err != nil {
+			if !errors.Is(err, ErrNoProgress) {
+				log.Err(err).Msg("error getting next history range")
+			}
+			return
+		}
+		q.addTask(ctx, next)
+	}
+}
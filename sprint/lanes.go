@@ -0,0 +1,287 @@
+package sprint
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"tuxpa.in/a/zlog/log"
+)
+
+// LaneManager is implemented by managers whose event groups can be added while sprint is running.
+// Groups added at runtime are backfilled in their own lane, so groups that are already caught up are
+// not queried again.
+type LaneManager interface {
+	// Returns the filters of the event groups backfilled in the given lane
+	GetLaneFilters(lane string, blockStart, blockEnd int) []ethereum.FilterQuery
+	// Called once when the manager is handed to a sprint. Lanes for groups added afterwards are
+	// scheduled through the given LaneScheduler
+	AttachLanes(ctx context.Context, ls LaneScheduler) error
+}
+
+// LaneScheduler schedules backfill lanes for event groups, see Sprint.AddLane
+type LaneScheduler interface {
+	IsActive() bool
+	AddLane(ctx context.Context, lane string, startBlock uint64) (uint64, error)
+	RemoveLane(ctx context.Context, lane string) error
+}
+
+var ErrDuplicateLane = errors.New("lane is already scheduled")
+
+// NeverJoins is returned by AddLane for lanes that follow the chain head on their own, see
+// SprintConfig.LanePerGroup
+const NeverJoins = math.MaxUint64
+
+// end block of the lane row of lanes that follow the chain head
+const laneFollowsHead = -1
+
+type lane struct {
+	name string
+	// first block of the lane
+	startBlock uint64
+	// whether the lane follows the chain head rather than joining the main lane once backfilled
+	follows bool
+	// end block of the latest uploaded range
+	head atomic.Int64
+}
+
+// IsActive reports whether Run is executing
+func (s *Sprint) IsActive() bool {
+	return s.isActive.Load()
+}
+
+// AddLane backfills an event group from startBlock up to the first block the main lane has not
+// scheduled yet, and returns that block. The main lane should include the group's filters from the
+// returned block onwards. When the main lane has not reached startBlock yet, nothing is backfilled
+// and startBlock is returned.
+//
+// With SprintConfig.LanePerGroup set, the lane instead keeps its own progress from startBlock up to
+// the chain head, and NeverJoins is returned.
+//
+// Lanes are persisted, so adding a lane that was added on a previous run resumes it and returns the
+// same block as before.
+func (s *Sprint) AddLane(ctx context.Context, lane string, startBlock uint64) (uint64, error) {
+	if lane == "" {
+		return 0, errors.New("lane name must not be empty")
+	}
+	if lane == HistoryLane {
+		return 0, fmt.Errorf("lane name %s is reserved", HistoryLane)
+	}
+	// hold the schedule lock so the main lane cannot move past the join block while we add the lane
+	s.scheduleMu.Lock()
+	defer s.scheduleMu.Unlock()
+	if s.hasLane(lane) {
+		return 0, ErrDuplicateLane
+	}
+	existing, err := s.store.Lane(ctx, lane)
+	if err == nil {
+		if existing.EndBlock == laneFollowsHead {
+			err := s.registerLane(ctx, lane, uint64(existing.StartBlock), true)
+			return NeverJoins, err
+		}
+		if existing.EndBlock >= existing.StartBlock {
+			err := s.registerLane(ctx, lane, uint64(existing.StartBlock), false)
+			if err != nil {
+				return 0, err
+			}
+		}
+		return uint64(existing.EndBlock + 1), nil
+	}
+	if !errors.Is(err, ErrNoProgress) {
+		return 0, err
+	}
+	// records the blocks the lane covers so the join block survives restarts. The row is never
+	// executed or validated itself
+	marker := &StageProgressLog{
+		PrimaryKey: "lane:" + lane,
+		Stage:      stageLane,
+		StartBlock: int(startBlock),
+		EndBlock:   laneFollowsHead,
+		Success:    StatusFinalized,
+		Msg:        fmt.Sprintf("Lane added at %s", time.Now().String()),
+		Lane:       lane,
+	}
+	// lanes following the head are scheduled alongside the main lane
+	if s.c.LanePerGroup {
+		err := s.insertScheduledRanges(ctx, []*StageProgressLog{marker})
+		if err != nil {
+			return 0, err
+		}
+		log.Info().Str("lane", lane).Uint64("start_block", startBlock).Msg("added lane")
+		return NeverJoins, s.registerLane(ctx, lane, startBlock, true)
+	}
+	scheduleHead, err := s.currentScheduleHead(ctx)
+	if err != nil {
+		return 0, err
+	}
+	joinBlock := scheduleHead + 1
+	if startBlock >= joinBlock {
+		joinBlock = startBlock
+	}
+	marker.EndBlock = int(joinBlock) - 1
+	toSchedule := []*StageProgressLog{marker}
+	if startBlock < joinBlock {
+		rngs := divideStageRanges(startBlock, joinBlock-1, s.stageSize.Load())
+		// the main lane picks up a trailing block on its next schedule, but a lane is scheduled once
+		if last := rngs[len(rngs)-1]; last.end < joinBlock-1 {
+			rngs = append(rngs, stageFilterRange{start: last.end + 1, end: joinBlock - 1})
+		}
+		ranges, err := createScheduleLogs(lane, rngs)
+		if err != nil {
+			return 0, err
+		}
+		toSchedule = append(toSchedule, ranges...)
+	}
+	err = s.insertScheduledRanges(ctx, toSchedule)
+	if err != nil {
+		return 0, err
+	}
+	if startBlock < joinBlock {
+		err := s.registerLane(ctx, lane, startBlock, false)
+		if err != nil {
+			return 0, err
+		}
+	}
+	log.Info().Str("lane", lane).Uint64("start_block", startBlock).Uint64("join_block", joinBlock).Msg("added lane")
+	return joinBlock, nil
+}
+
+// RemoveLane stops executing a lane and deletes its progress. Ranges of the lane that are in flight
+// are dropped rather than uploaded. Events that were already uploaded are left in place.
+func (s *Sprint) RemoveLane(ctx context.Context, lane string) error {
+	if lane == "" {
+		return errors.New("cannot remove the main lane")
+	}
+	s.scheduleMu.Lock()
+	defer s.scheduleMu.Unlock()
+	s.lanesMu.Lock()
+	for i, l := range s.lanes {
+		if l.name == lane {
+			s.lanes = append(s.lanes[:i], s.lanes[i+1:]...)
+			break
+		}
+	}
+	s.lanesMu.Unlock()
+	return s.store.DeleteLane(ctx, lane)
+}
+
+func (s *Sprint) registerLane(ctx context.Context, name string, startBlock uint64, follows bool) error {
+	l := &lane{
+		name:       name,
+		startBlock: startBlock,
+		follows:    follows,
+	}
+	// resume the head of lanes from a previous run
+	head, err := s.store.SprintHead(ctx, name)
+	switch {
+	case err == nil:
+		l.head.Store(int64(head.EndBlock))
+	case errors.Is(err, ErrNoProgress):
+		l.head.Store(int64(startBlock) - 1)
+	default:
+		return err
+	}
+	s.lanesMu.Lock()
+	defer s.lanesMu.Unlock()
+	s.lanes = append(s.lanes, l)
+	return nil
+}
+
+// Returns a registered lane, or nil for the main lane and lanes that were removed
+func (s *Sprint) lane(name string) *lane {
+	s.lanesMu.Lock()
+	defer s.lanesMu.Unlock()
+	for _, l := range s.lanes {
+		if l.name == name {
+			return l
+		}
+	}
+	return nil
+}
+
+// Reports whether a lane backfills blocks below the main lane, see EventBatch.Backfill
+func (s *Sprint) backfillLane(name string) bool {
+	if name == HistoryLane {
+		return true
+	}
+	l := s.lane(name)
+	return l != nil && !l.follows
+}
+
+// Reports whether ranges of the lane should still be uploaded. The main lane always exists
+func (s *Sprint) hasLane(name string) bool {
+	return name == "" || s.lane(name) != nil
+}
+
+// Returns the main lane followed by every registered lane
+func (s *Sprint) laneNames() []string {
+	s.lanesMu.Lock()
+	defer s.lanesMu.Unlock()
+	names := make([]string, 0, len(s.lanes)+1)
+	names = append(names, "")
+	for _, l := range s.lanes {
+		names = append(names, l.name)
+	}
+	return names
+}
+
+// Returns the lanes that follow the chain head
+func (s *Sprint) followingLanes() []*lane {
+	s.lanesMu.Lock()
+	defer s.lanesMu.Unlock()
+	var res []*lane
+	for _, l := range s.lanes {
+		if l.follows {
+			res = append(res, l)
+		}
+	}
+	return res
+}
+
+// LaneHeads returns the end block of the latest uploaded range of every lane other than the main lane
+func (s *Sprint) LaneHeads() map[string]int64 {
+	s.lanesMu.Lock()
+	defer s.lanesMu.Unlock()
+	heads := make(map[string]int64, len(s.lanes))
+	for _, l := range s.lanes {
+		heads[l.name] = l.head.Load()
+	}
+	return heads
+}
+
+// Schedules ranges of a lane that follows the chain head, from where it was last scheduled up to the head
+func (s *Sprint) scheduleFollowingLane(ctx context.Context, l *lane, chainHead uint64) error {
+	from := l.startBlock
+	head, err := s.store.ScheduleHead(ctx, l.name)
+	if err == nil {
+		from = head + 1
+	} else if !errors.Is(err, ErrNoProgress) {
+		return err
+	}
+	if from > chainHead {
+		return nil
+	}
+	toSchedule, err := createScheduleLogs(l.name, divideStageRanges(from, chainHead, s.stageSize.Load()))
+	if err != nil {
+		return err
+	}
+	if len(toSchedule) == 0 {
+		return nil
+	}
+	return s.insertScheduledRanges(ctx, toSchedule)
+}
+
+func (s *Sprint) stageFilters(lane string, start, stop int) []ethereum.FilterQuery {
+	if lane == "" || lane == HistoryLane {
+		return s.m.GetStageFilters(start, stop)
+	}
+	lm, ok := s.m.(LaneManager)
+	if !ok {
+		return nil
+	}
+	return lm.GetLaneFilters(lane, start, stop)
+}
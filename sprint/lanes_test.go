@@ -0,0 +1,221 @@
+package sprint
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/upper/db/v4"
+)
+
+type headManager uint64
+
+func (h headManager) CurrentBlock() uint64 { return uint64(h) }
+
+func (h headManager) Insert(ctx context.Context, d db.Session, startBlock int, endBlock int, eventData *EventBatch) error {
+	return nil
+}
+
+func (h headManager) Validate(ctx context.Context, d db.Session, startBlock int, endBlock int, eventData *EventBatch) (bool, error) {
+	return false, nil
+}
+
+func (h headManager) GetStageFilters(blockStart, blockEnd int) []ethereum.FilterQuery { return nil }
+
+func newLaneTestSprint(t *testing.T, store ProgressStore) *Sprint {
+	t.Helper()
+	s, err := NewSprintWithStore(context.Background(), nil, nil, &SprintConfig{
+		BlocksPerStage:  9,
+		Workers:         1,
+		ExecuteInterval: 1,
+		StartBlock:      0,
+	}, store, headManager(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestAddLane(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryProgressStore()
+	s := newLaneTestSprint(t, store)
+	if err := s.schedule(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// the main lane is scheduled up to the chain head, so the group is backfilled below it
+	joinBlock, err := s.AddLane(ctx, "pool", 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if joinBlock != 101 {
+		t.Fatalf("expected join block 101, got %d", joinBlock)
+	}
+	if _, err := s.AddLane(ctx, "pool", 40); !errors.Is(err, ErrDuplicateLane) {
+		t.Fatalf("expected ErrDuplicateLane, got %v", err)
+	}
+	laneHead, err := store.ScheduleHead(ctx, "pool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if laneHead != 100 {
+		t.Fatalf("expected lane scheduled up to 100, got %d", laneHead)
+	}
+	next, err := store.NextRange(ctx, "pool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.StartBlock != 40 || next.Lane != "pool" {
+		t.Fatalf("unexpected lane range %+v", next)
+	}
+	// lanes resume with the same join block on the next run
+	restarted := newLaneTestSprint(t, store)
+	joinBlock, err = restarted.AddLane(ctx, "pool", 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if joinBlock != 101 || !restarted.hasLane("pool") {
+		t.Fatalf("expected lane to resume at 101, got %d", joinBlock)
+	}
+	// groups starting above the schedule head need no backfill
+	joinBlock, err = s.AddLane(ctx, "future", 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if joinBlock != 500 || s.hasLane("future") {
+		t.Fatalf("expected no backfill for future group, got join block %d", joinBlock)
+	}
+	if err := s.RemoveLane(ctx, "pool"); err != nil {
+		t.Fatal(err)
+	}
+	if s.hasLane("pool") {
+		t.Fatal("expected lane to be removed")
+	}
+	if _, err := store.Lane(ctx, "pool"); !errors.Is(err, ErrNoProgress) {
+		t.Fatalf("expected lane progress to be deleted, got %v", err)
+	}
+}
+
+func TestLanePerGroup(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryProgressStore()
+	s := newLaneTestSprint(t, store)
+	s.c.LanePerGroup = true
+	joinBlock, err := s.AddLane(ctx, "pool", 90)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if joinBlock != NeverJoins {
+		t.Fatalf("expected lane to never join the main lane, got %d", joinBlock)
+	}
+	if s.backfillLane("pool") {
+		t.Fatal("expected lanes following the head not to be backfilled")
+	}
+	if err := s.schedule(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// the lane is scheduled from its own start block rather than the sprint start block
+	next, err := store.NextRange(ctx, "pool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.StartBlock != 90 || next.EndBlock != 99 {
+		t.Fatalf("unexpected lane range %+v", next)
+	}
+	if heads := s.LaneHeads(); heads["pool"] != 89 {
+		t.Fatalf("expected lane head 89 before any upload, got %d", heads["pool"])
+	}
+	restarted := newLaneTestSprint(t, store)
+	joinBlock, err = restarted.AddLane(ctx, "pool", 90)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if joinBlock != NeverJoins || len(restarted.followingLanes()) != 1 {
+		t.Fatal("expected lane to keep following the head after a restart")
+	}
+}
+
+func TestHistoryLane(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryProgressStore()
+	s, err := NewSprintWithStore(ctx, nil, nil, &SprintConfig{
+		BlocksPerStage:  9,
+		Workers:         1,
+		BackfillWorkers: 1,
+		HeadWindow:      30,
+		ExecuteInterval: 1,
+	}, store, headManager(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.schedule(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// history covers everything below the head window, the main lane the rest
+	historyHead, err := store.ScheduleHead(ctx, HistoryLane)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if historyHead != 70 {
+		t.Fatalf("expected history scheduled up to 70, got %d", historyHead)
+	}
+	next, err := s.getNextRangeToExecute(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Lane != "" || next.StartBlock != 71 {
+		t.Fatalf("expected head workers to start at 71, got %+v", next)
+	}
+	batch := &EventBatch{progressLog: &StageProgressLog{Lane: HistoryLane}}
+	if batch.Lane() != "" {
+		t.Fatalf("expected history batches to be reported as the main lane, got %q", batch.Lane())
+	}
+	// ranges of history commit independently of the main lane above them
+	if !s.backfillLane(HistoryLane) || s.backfillLane("") {
+		t.Fatal("expected only history ranges to be backfilled")
+	}
+	if _, err := s.AddLane(ctx, HistoryLane, 0); err == nil {
+		t.Fatal("expected the history lane name to be reserved")
+	}
+	// restarts resume the history lane rather than splitting history off again
+	restarted, err := NewSprintWithStore(ctx, nil, nil, s.c, store, headManager(200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.schedule(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !restarted.hasLane(HistoryLane) {
+		t.Fatal("expected history lane to be resumed")
+	}
+	if historyHead, _ := store.ScheduleHead(ctx, HistoryLane); historyHead != 70 {
+		t.Fatalf("expected history to stay at 70, got %d", historyHead)
+	}
+}
+
+func TestQueueHistoryFillsWorkers(t *testing.T) {
+	ctx := context.Background()
+	s, err := NewSprintWithStore(ctx, nil, nil, &SprintConfig{
+		BlocksPerStage:  9,
+		Workers:         1,
+		BackfillWorkers: 3,
+		HeadWindow:      20,
+		ExecuteInterval: 1,
+	}, NewMemoryProgressStore(), headManager(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.schedule(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// no workers run, so every claimed range stays queued
+	s.queueHistory(ctx)
+	if n := len(s.historyQueue.taskQueue); n != 3 {
+		t.Fatalf("expected a range per history worker, got %d", n)
+	}
+	s.queueHistory(ctx)
+	if n := len(s.historyQueue.taskQueue); n != 3 {
+		t.Fatalf("expected a full queue to be left alone, got %d", n)
+	}
+}
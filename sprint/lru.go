@@ -0,0 +1,129 @@
+package sprint
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const defaultBlockCacheSize = 256
+
+// BlockCacheStats counts block cache lookups since the sprint was created
+type BlockCacheStats struct {
+	Hits          uint64
+	Misses        uint64
+	Evictions     uint64
+	Invalidations uint64
+	// Number of blocks currently cached
+	Size int
+}
+
+type lruEntry struct {
+	number int
+	block  *BlockInfo
+}
+
+// blockLRU is a bounded least recently used cache of blocks, indexed by number and hash
+type blockLRU struct {
+	mu       sync.Mutex
+	size     int
+	order    *list.List
+	byNumber map[int]*list.Element
+	byHash   map[common.Hash]*list.Element
+	// bumped on every invalidation, so blocks fetched before a reorg are not cached after it
+	generation uint64
+	stats      BlockCacheStats
+}
+
+func newBlockLRU(size int) *blockLRU {
+	return &blockLRU{
+		size:     size,
+		order:    list.New(),
+		byNumber: make(map[int]*list.Element),
+		byHash:   make(map[common.Hash]*list.Element),
+	}
+}
+
+func (c *blockLRU) get(number int) (*BlockInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.byNumber[number]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.order.MoveToFront(el)
+	return el.Value.(*lruEntry).block, true
+}
+
+func (c *blockLRU) getByHash(hash common.Hash) (*BlockInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.byHash[hash]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*lruEntry).block, true
+}
+
+func (c *blockLRU) currentGeneration() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// Caches a block fetched during the given generation. Blocks fetched before an invalidation may be
+// from the reorged chain, so they are dropped
+func (c *blockLRU) add(number int, blk *BlockInfo, generation uint64) {
+	if c.size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if el, ok := c.byNumber[number]; ok {
+		c.remove(el)
+	}
+	el := c.order.PushFront(&lruEntry{number: number, block: blk})
+	c.byNumber[number] = el
+	c.byHash[blk.Hash] = el
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+		c.stats.Evictions++
+	}
+}
+
+// Drops every cached block at or above the given block
+func (c *blockLRU) invalidateFrom(number int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for n, el := range c.byNumber {
+		if n >= number {
+			c.remove(el)
+			c.stats.Invalidations++
+		}
+	}
+}
+
+func (c *blockLRU) remove(el *list.Element) {
+	entry := c.order.Remove(el).(*lruEntry)
+	delete(c.byNumber, entry.number)
+	// the hash index may already point at a newer entry for the same block
+	if cur, ok := c.byHash[entry.block.Hash]; ok && cur == el {
+		delete(c.byHash, entry.block.Hash)
+	}
+}
+
+func (c *blockLRU) statistics() BlockCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Size = c.order.Len()
+	return stats
+}
@@ -0,0 +1,56 @@
+package sprint
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func testBlock(number int) *BlockInfo {
+	return &BlockInfo{Hash: common.BigToHash(big.NewInt(int64(number)))}
+}
+
+func TestBlockLRUEviction(t *testing.T) {
+	c := newBlockLRU(2)
+	c.add(1, testBlock(1), 0)
+	c.add(2, testBlock(2), 0)
+	// touching block 1 makes block 2 the least recently used
+	if _, ok := c.get(1); !ok {
+		t.Fatal("expected block 1 to be cached")
+	}
+	c.add(3, testBlock(3), 0)
+	if _, ok := c.get(2); ok {
+		t.Fatal("expected block 2 to be evicted")
+	}
+	if _, ok := c.getByHash(testBlock(3).Hash); !ok {
+		t.Fatal("expected block 3 to be cached by hash")
+	}
+	stats := c.statistics()
+	if stats.Hits != 1 || stats.Misses != 1 || stats.Evictions != 1 || stats.Size != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestBlockLRUInvalidate(t *testing.T) {
+	c := newBlockLRU(10)
+	for i := 1; i <= 5; i++ {
+		c.add(i, testBlock(i), 0)
+	}
+	generation := c.currentGeneration()
+	c.invalidateFrom(3)
+	if _, ok := c.get(2); !ok {
+		t.Fatal("expected blocks below the fork to stay cached")
+	}
+	if _, ok := c.get(3); ok {
+		t.Fatal("expected blocks from the fork to be dropped")
+	}
+	// blocks fetched before the reorg are not cached after it
+	c.add(4, testBlock(4), generation)
+	if _, ok := c.get(4); ok {
+		t.Fatal("expected stale block to be dropped")
+	}
+	if stats := c.statistics(); stats.Invalidations != 3 {
+		t.Fatalf("expected 3 invalidations, got %d", stats.Invalidations)
+	}
+}
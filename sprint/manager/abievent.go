@@ -0,0 +1,162 @@
+package manager
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"gfx.cafe/open/ghost"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ABIEvent is an Event decoded according to an ABI event fragment, so events can be indexed without
+// writing a type for each of them. Pass the value returned by NewABIEvent to Manager.AddEventFilter;
+// Copy creates the instances logs are decoded into.
+//
+// Fields hold the decoded arguments by name, typed as go-ethereum's abi package decodes them:
+// addresses as common.Address, integers wider than 64 bits as *big.Int, bytes as []byte, tuples as
+// structs and arrays as slices or arrays. Indexed arguments of dynamic types only have their hash in
+// the log, so they are decoded as common.Hash.
+type ABIEvent struct {
+	def   *abi.Event
+	table string
+
+	Address     common.Address `json:"address"`
+	BlockNumber uint64         `json:"block_number"`
+	TxHash      common.Hash    `json:"tx_hash"`
+	LogIndex    int            `json:"log_index"`
+	Fields      map[string]any `json:"fields"`
+}
+
+var _ Event = (*ABIEvent)(nil)
+
+// NewABIEvent parses a JSON ABI event fragment such as
+//
+//	{"type":"event","name":"Transfer","inputs":[{"name":"from","type":"address","indexed":true},...]}
+//
+// Events are uploaded to the given table, which defaults to the lower cased event name.
+func NewABIEvent(fragment []byte, table string) (*ABIEvent, error) {
+	parsed, err := abi.JSON(bytes.NewReader(append(append([]byte("["), fragment...), ']')))
+	if err != nil {
+		return nil, fmt.Errorf("invalid event fragment: %w", err)
+	}
+	if len(parsed.Events) != 1 {
+		return nil, errors.New("fragment must hold exactly one event")
+	}
+	var ev abi.Event
+	for _, e := range parsed.Events {
+		ev = e
+	}
+	return newABIEvent(&ev, table)
+}
+
+// NewABIEventFromABI returns the event with the given name from a full JSON ABI, see NewABIEvent
+func NewABIEventFromABI(abiJSON []byte, name, table string) (*ABIEvent, error) {
+	parsed, err := abi.JSON(bytes.NewReader(abiJSON))
+	if err != nil {
+		return nil, err
+	}
+	ev, ok := parsed.Events[name]
+	if !ok {
+		return nil, fmt.Errorf("abi has no event %s", name)
+	}
+	return newABIEvent(&ev, table)
+}
+
+func newABIEvent(ev *abi.Event, table string) (*ABIEvent, error) {
+	// the manager matches logs to events by topic0, which anonymous events do not have
+	if ev.Anonymous {
+		return nil, fmt.Errorf("event %s is anonymous", ev.Name)
+	}
+	if table == "" {
+		table = strings.ToLower(ev.Name)
+	}
+	return &ABIEvent{def: ev, table: table}, nil
+}
+
+// Signature returns the event signature, e.g. Transfer(address,address,uint256)
+func (e *ABIEvent) Signature() string {
+	return e.def.Sig
+}
+
+func (e *ABIEvent) Copy() Event {
+	return &ABIEvent{def: e.def, table: e.table}
+}
+
+// Process decodes the log into Fields. Logs with the same signature but a different number of
+// indexed arguments, such as ERC-721 transfers for an ERC-20 Transfer fragment, or with data that does
+// not decode as the fragment's arguments are skipped
+func (e *ABIEvent) Process(l FilterUpdater, raw *ghost.ErigonLog) (bool, error) {
+	if len(raw.Topics) == 0 || raw.Topics[0] != e.def.ID {
+		return false, nil
+	}
+	var indexed abi.Arguments
+	for _, arg := range e.def.Inputs {
+		if arg.Indexed {
+			indexed = append(indexed, arg)
+		}
+	}
+	if len(raw.Topics)-1 != len(indexed) {
+		return false, nil
+	}
+	fields := make(map[string]any, len(e.def.Inputs))
+	if len(raw.Data) > 0 {
+		// another contract's event with the same signature, it must not abort the range
+		if err := e.def.Inputs.NonIndexed().UnpackIntoMap(fields, raw.Data); err != nil {
+			return false, nil
+		}
+	}
+	// ParseTopicsIntoMap fails on tuples, so the hashed topics of dynamic types are set here
+	var static abi.Arguments
+	var staticTopics []common.Hash
+	for i, arg := range indexed {
+		if hashedTopic(arg.Type) {
+			fields[arg.Name] = raw.Topics[i+1]
+			continue
+		}
+		static = append(static, arg)
+		staticTopics = append(staticTopics, raw.Topics[i+1])
+	}
+	if err := abi.ParseTopicsIntoMap(fields, static, staticTopics); err != nil {
+		return false, nil
+	}
+	e.Fields = fields
+	e.Address = raw.Address
+	e.BlockNumber = raw.BlockNumber
+	e.TxHash = raw.TxHash
+	e.LogIndex = int(raw.Index)
+	return true, nil
+}
+
+// Reports whether indexed arguments of the type only have their hash in the log
+func hashedTopic(t abi.Type) bool {
+	switch t.T {
+	case abi.StringTy, abi.BytesTy, abi.SliceTy, abi.ArrayTy, abi.TupleTy:
+		return true
+	}
+	return false
+}
+
+func (e *ABIEvent) Table() string {
+	return e.table
+}
+
+func (e *ABIEvent) EventHash() common.Hash {
+	return e.def.ID
+}
+
+func (e *ABIEvent) GetLogIndex() int {
+	return e.LogIndex
+}
+
+// MarshalJSON encodes the event with its name, so events of different tables can share a stream
+func (e *ABIEvent) MarshalJSON() ([]byte, error) {
+	type alias ABIEvent
+	return json.Marshal(struct {
+		Name string `json:"name"`
+		*alias
+	}{Name: e.def.Name, alias: (*alias)(e)})
+}
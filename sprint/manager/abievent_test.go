@@ -0,0 +1,116 @@
+package manager
+
+import (
+	"math/big"
+	"testing"
+
+	"gfx.cafe/open/ghost"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const swapFragment = `{"type":"event","name":"Swap","anonymous":false,"inputs":[
+	{"name":"sender","type":"address","indexed":true},
+	{"name":"amount","type":"uint256","indexed":false},
+	{"name":"path","type":"address[]","indexed":false},
+	{"name":"memo","type":"bytes","indexed":false},
+	{"name":"order","type":"tuple","indexed":false,"components":[
+		{"name":"id","type":"uint64"},
+		{"name":"owner","type":"address"}
+	]}
+]}`
+
+func TestABIEvent(t *testing.T) {
+	ev, err := NewABIEvent([]byte(swapFragment), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Table() != "swap" {
+		t.Fatalf("expected table swap, got %s", ev.Table())
+	}
+	if want := crypto.Keccak256Hash([]byte("Swap(address,uint256,address[],bytes,(uint64,address))")); ev.EventHash() != want {
+		t.Fatalf("expected event hash %s, got %s", want, ev.EventHash())
+	}
+	sender := common.HexToAddress("0x01")
+	path := []common.Address{common.HexToAddress("0x02"), common.HexToAddress("0x03")}
+	order := struct {
+		Id    uint64
+		Owner common.Address
+	}{Id: 7, Owner: common.HexToAddress("0x04")}
+	data, err := ev.def.Inputs.NonIndexed().Pack(big.NewInt(1000), path, []byte("hi"), order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := &ghost.ErigonLog{
+		Topics:      []common.Hash{ev.EventHash(), common.BytesToHash(sender.Bytes())},
+		Data:        data,
+		BlockNumber: 12,
+		Index:       3,
+	}
+	decoded := ev.Copy().(*ABIEvent)
+	ok, err := decoded.Process(newFilterTracker(nil), raw)
+	if err != nil || !ok {
+		t.Fatalf("expected log to decode, got %v %v", ok, err)
+	}
+	if decoded.Fields["sender"] != sender || decoded.Fields["amount"].(*big.Int).Int64() != 1000 {
+		t.Fatalf("unexpected fields %+v", decoded.Fields)
+	}
+	if got := decoded.Fields["path"].([]common.Address); len(got) != 2 || got[1] != path[1] {
+		t.Fatalf("unexpected path %v", got)
+	}
+	if string(decoded.Fields["memo"].([]byte)) != "hi" {
+		t.Fatalf("unexpected memo %v", decoded.Fields["memo"])
+	}
+	if decoded.GetLogIndex() != 3 || ev.Fields != nil {
+		t.Fatal("expected the log to be decoded into the copy only")
+	}
+	// same signature with a different number of indexed arguments
+	raw.Topics = append(raw.Topics, common.Hash{})
+	if ok, err := ev.Copy().Process(newFilterTracker(nil), raw); ok || err != nil {
+		t.Fatalf("expected mismatched topics to be skipped, got %v %v", ok, err)
+	}
+}
+
+const orderFragment = `{"type":"event","name":"Order","anonymous":false,"inputs":[
+	{"name":"maker","type":"address","indexed":true},
+	{"name":"order","type":"tuple","indexed":true,"components":[
+		{"name":"id","type":"uint64"},
+		{"name":"owner","type":"address"}
+	]},
+	{"name":"tag","type":"string","indexed":true},
+	{"name":"amount","type":"uint256","indexed":false}
+]}`
+
+func TestABIEventIndexedTuple(t *testing.T) {
+	ev, err := NewABIEvent([]byte(orderFragment), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	maker := common.HexToAddress("0x01")
+	orderHash := common.Hash{0x0a}
+	tagHash := crypto.Keccak256Hash([]byte("limit"))
+	data, err := ev.def.Inputs.NonIndexed().Pack(big.NewInt(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := &ghost.ErigonLog{
+		Topics: []common.Hash{ev.EventHash(), common.BytesToHash(maker.Bytes()), orderHash, tagHash},
+		Data:   data,
+	}
+	decoded := ev.Copy().(*ABIEvent)
+	ok, err := decoded.Process(newFilterTracker(nil), raw)
+	if err != nil || !ok {
+		t.Fatalf("expected log to decode, got %v %v", ok, err)
+	}
+	if decoded.Fields["maker"] != maker || decoded.Fields["order"] != orderHash || decoded.Fields["tag"] != tagHash {
+		t.Fatalf("unexpected indexed fields %+v", decoded.Fields)
+	}
+	if decoded.Fields["amount"].(*big.Int).Int64() != 5 {
+		t.Fatalf("unexpected amount %v", decoded.Fields["amount"])
+	}
+	// an event with the same signature whose data does not decode
+	raw.Data = []byte{1, 2, 3}
+	if ok, err := ev.Copy().Process(newFilterTracker(nil), raw); ok || err != nil {
+		t.Fatalf("expected undecodable data to be skipped, got %v %v", ok, err)
+	}
+}
@@ -0,0 +1,127 @@
+// Package bus publishes events indexed by sprint to a message bus such as Kafka or NATS, rather than
+// uploading them to a database.
+package bus
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Message is an event published to a Bus
+type Message struct {
+	// Deterministic key of the event, see EventKey. Republished events keep their key, so consumers
+	// of compacted topics see the latest version
+	Key string `json:"key"`
+	// Table of the event, usable as the topic or subject
+	Table string `json:"table"`
+	Block int    `json:"block"`
+	// JSON encoded EventMessage, empty for tombstones
+	Value json.RawMessage `json:"value,omitempty"`
+	// Set when the event was reorged out of the chain and should be retracted
+	Tombstone bool `json:"tombstone,omitempty"`
+}
+
+// Bus publishes messages, e.g. to a Kafka topic or NATS subject
+type Bus interface {
+	// Publishes the messages in order. Messages must not be reordered within a call
+	Publish(ctx context.Context, msgs ...*Message) error
+}
+
+// EventKey returns the key of the event emitted at the given block, transaction and log index
+func EventKey(block int, tx common.Hash, logIndex int) string {
+	return fmt.Sprintf("%d-%s-%d", block, tx.Hex(), logIndex)
+}
+
+// MemoryBus keeps published messages in memory, for tests
+type MemoryBus struct {
+	mu   sync.Mutex
+	msgs []*Message
+}
+
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{}
+}
+
+func (b *MemoryBus) Publish(ctx context.Context, msgs ...*Message) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.msgs = append(b.msgs, msgs...)
+	return nil
+}
+
+// Messages returns every message published so far, in order
+func (b *MemoryBus) Messages() []*Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*Message(nil), b.msgs...)
+}
+
+// FileBus appends published messages to a file as JSON lines
+type FileBus struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+}
+
+// NewFileBus opens the file at path for appending, creating it if it does not exist
+func NewFileBus(path string) (*FileBus, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileBus{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// Publish writes the messages and syncs them to disk before returning
+func (b *FileBus) Publish(ctx context.Context, msgs ...*Message) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	enc := json.NewEncoder(b.w)
+	for _, msg := range msgs {
+		err := enc.Encode(msg)
+		if err != nil {
+			return err
+		}
+	}
+	err := b.w.Flush()
+	if err != nil {
+		return err
+	}
+	return b.f.Sync()
+}
+
+func (b *FileBus) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	err := b.w.Flush()
+	if cerr := b.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// ReadFile returns the messages of a file written by a FileBus
+func ReadFile(path string) ([]*Message, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var msgs []*Message
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		msg := &Message{}
+		err := dec.Decode(msg)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
@@ -0,0 +1,257 @@
+package bus
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/tjudice/ethutil/sprint/manager"
+	"github.com/upper/db/v4"
+	"tuxpa.in/a/zlog/log"
+)
+
+const defaultRetainBlocks = 100_000
+
+type SinkConfig struct {
+	// Addresses whose events are published, in addition to the manager's allowed addresses
+	Addresses []common.Address
+	// Blocks below the highest published block whose events are remembered to validate ranges
+	// against. Ranges below that, or published before the sink was created, are assumed valid.
+	// Defaults to 100000.
+	RetainBlocks int
+}
+
+// EventMessage is the value of a published Message
+type EventMessage struct {
+	Block     int             `json:"block"`
+	Timestamp uint64          `json:"timestamp"`
+	TxHash    common.Hash     `json:"tx_hash"`
+	From      common.Address  `json:"from"`
+	To        *common.Address `json:"to"`
+	LogIndex  int             `json:"log_index"`
+	EventHash common.Hash     `json:"event_hash"`
+	Event     manager.Event   `json:"event"`
+}
+
+type publishedEvent struct {
+	table  string
+	digest [sha256.Size]byte
+}
+
+// EventSink is a manager.EventUploader that publishes events to a Bus. Events reorged out of the
+// chain are retracted with tombstones when a range is validated.
+//
+// Publishing is not part of the sprint transaction, so a range whose transaction fails after its events
+// were published is published again. Messages have deterministic keys, so consumers can deduplicate.
+type EventSink struct {
+	bus Bus
+	c   SinkConfig
+
+	mu sync.Mutex
+	// events published by this sink by block and key
+	published map[int]map[string]publishedEvent
+	// ranges ending below this block cannot be validated, since their events were never indexed or pruned
+	indexedFrom int
+	head        int
+}
+
+var (
+	_ manager.EventUploader     = (*EventSink)(nil)
+	_ manager.LaneEventUploader = (*EventSink)(nil)
+)
+
+func NewEventSink(bus Bus, config SinkConfig) *EventSink {
+	if config.RetainBlocks <= 0 {
+		config.RetainBlocks = defaultRetainBlocks
+	}
+	return &EventSink{
+		bus:         bus,
+		c:           config,
+		published:   make(map[int]map[string]publishedEvent),
+		indexedFrom: -1,
+	}
+}
+
+func (s *EventSink) GetActiveAddresses(ctx context.Context, d db.Session, block int) ([]common.Address, error) {
+	return s.c.Addresses, nil
+}
+
+func (s *EventSink) UploadEventSet(ctx context.Context, d db.Session, eventInfo []*manager.EventInfo) error {
+	msgs, err := newMessages(eventInfo)
+	if err != nil {
+		return err
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	err = s.bus.Publish(ctx, msgs...)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, msg := range msgs {
+		s.index(msg)
+	}
+	s.prune()
+	return nil
+}
+
+func (s *EventSink) ValidateEventSet(ctx context.Context, d db.Session, startBlock, endBlock int, eventInfo []*manager.EventInfo) (bool, error) {
+	return s.validate(ctx, nil, startBlock, endBlock, eventInfo)
+}
+
+func (s *EventSink) ValidateTableEventSet(ctx context.Context, d db.Session, tables []string, startBlock, endBlock int, eventInfo []*manager.EventInfo) (bool, error) {
+	return s.validate(ctx, tables, startBlock, endBlock, eventInfo)
+}
+
+// DeleteEventRange forgets the events of the range. Nothing is published, the events that replace
+// them are published with the same keys and the events that were removed were already retracted
+func (s *EventSink) DeleteEventRange(ctx context.Context, d db.Session, startBlock, endBlock int) error {
+	s.forget(nil, startBlock, endBlock)
+	return nil
+}
+
+func (s *EventSink) DeleteTableEventRange(ctx context.Context, d db.Session, tables []string, startBlock, endBlock int) error {
+	s.forget(tables, startBlock, endBlock)
+	return nil
+}
+
+// Compares the events of a range against those published, retracting published events that are no
+// longer in the range. tables is nil for every table
+func (s *EventSink) validate(ctx context.Context, tables []string, startBlock, endBlock int, eventInfo []*manager.EventInfo) (bool, error) {
+	msgs, err := newMessages(eventInfo)
+	if err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.indexedFrom < 0 || endBlock < s.indexedFrom {
+		log.Debug().Int("start", startBlock).Int("end", endBlock).Msg("range was not published by this sink, assuming valid")
+		return true, nil
+	}
+	current := make(map[string]publishedEvent, len(msgs))
+	for _, msg := range msgs {
+		current[msg.Key] = publishedEvent{table: msg.Table, digest: sha256.Sum256(msg.Value)}
+	}
+	valid := true
+	var tombstones []*Message
+	for block := startBlock; block <= endBlock; block++ {
+		for key, ev := range s.published[block] {
+			if !hasTable(tables, ev.table) {
+				continue
+			}
+			next, ok := current[key]
+			if !ok {
+				valid = false
+				tombstones = append(tombstones, &Message{Key: key, Table: ev.table, Block: block, Tombstone: true})
+				continue
+			}
+			if next.digest != ev.digest {
+				valid = false
+			}
+			delete(current, key)
+		}
+	}
+	// events the published range is missing
+	if len(current) > 0 {
+		valid = false
+	}
+	if len(tombstones) == 0 {
+		return valid, nil
+	}
+	err = s.bus.Publish(ctx, tombstones...)
+	if err != nil {
+		return false, err
+	}
+	for _, msg := range tombstones {
+		delete(s.published[msg.Block], msg.Key)
+	}
+	return valid, nil
+}
+
+func (s *EventSink) forget(tables []string, startBlock, endBlock int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for block := startBlock; block <= endBlock; block++ {
+		for key, ev := range s.published[block] {
+			if hasTable(tables, ev.table) {
+				delete(s.published[block], key)
+			}
+		}
+		if len(s.published[block]) == 0 {
+			delete(s.published, block)
+		}
+	}
+}
+
+func (s *EventSink) index(msg *Message) {
+	if s.indexedFrom < 0 || msg.Block < s.indexedFrom {
+		s.indexedFrom = msg.Block
+	}
+	if msg.Block > s.head {
+		s.head = msg.Block
+	}
+	events, ok := s.published[msg.Block]
+	if !ok {
+		events = make(map[string]publishedEvent)
+		s.published[msg.Block] = events
+	}
+	events[msg.Key] = publishedEvent{table: msg.Table, digest: sha256.Sum256(msg.Value)}
+}
+
+func (s *EventSink) prune() {
+	floor := s.head - s.c.RetainBlocks
+	if floor <= s.indexedFrom {
+		return
+	}
+	for block := range s.published {
+		if block < floor {
+			delete(s.published, block)
+		}
+	}
+	s.indexedFrom = floor
+}
+
+func hasTable(tables []string, table string) bool {
+	if tables == nil {
+		return true
+	}
+	for _, t := range tables {
+		if t == table {
+			return true
+		}
+	}
+	return false
+}
+
+func newMessages(eventInfo []*manager.EventInfo) ([]*Message, error) {
+	msgs := make([]*Message, 0, len(eventInfo))
+	for _, e := range eventInfo {
+		m := &EventMessage{
+			Block:     e.Block,
+			Timestamp: e.Timestamp,
+			LogIndex:  e.EventLog.GetLogIndex(),
+			EventHash: e.EventLog.EventHash(),
+			Event:     e.EventLog,
+		}
+		if tx := e.TransactionInfo; tx != nil {
+			m.TxHash = tx.Hash
+			m.From = tx.From
+			m.To = tx.To
+		}
+		value, err := json.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, &Message{
+			Key:   EventKey(m.Block, m.TxHash, m.LogIndex),
+			Table: e.EventLog.Table(),
+			Block: e.Block,
+			Value: value,
+		})
+	}
+	return msgs, nil
+}
@@ -0,0 +1,106 @@
+package bus
+
+import (
+	"context"
+	"math/big"
+	"path/filepath"
+	"testing"
+
+	"gfx.cafe/open/ghost"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/tjudice/ethutil/sprint"
+	"github.com/tjudice/ethutil/sprint/manager"
+)
+
+type transfer struct {
+	LogIndex int    `json:"log_index"`
+	Amount   uint64 `json:"amount"`
+}
+
+func (t *transfer) Copy() manager.Event { return &transfer{} }
+
+func (t *transfer) Process(l manager.FilterUpdater, raw *ghost.ErigonLog) (bool, error) {
+	return true, nil
+}
+
+func (t *transfer) Table() string { return "transfers" }
+
+func (t *transfer) EventHash() common.Hash { return common.BigToHash(big.NewInt(1)) }
+
+func (t *transfer) GetLogIndex() int { return t.LogIndex }
+
+func newTransfer(block, logIndex int, amount uint64) *manager.EventInfo {
+	return &manager.EventInfo{
+		EventLog:        &transfer{LogIndex: logIndex, Amount: amount},
+		TransactionInfo: &sprint.TransactionInfo{Hash: common.BigToHash(big.NewInt(int64(block)))},
+		Block:           block,
+	}
+}
+
+func TestEventSinkRetractsReorgedEvents(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemoryBus()
+	s := NewEventSink(b, SinkConfig{})
+	original := []*manager.EventInfo{newTransfer(10, 0, 5), newTransfer(10, 1, 6), newTransfer(11, 0, 7)}
+	if err := s.UploadEventSet(ctx, nil, original); err != nil {
+		t.Fatal(err)
+	}
+	valid, err := s.ValidateEventSet(ctx, nil, 10, 11, original)
+	if err != nil || !valid {
+		t.Fatalf("expected unchanged range to be valid, got %v %v", valid, err)
+	}
+	if len(b.Messages()) != 3 {
+		t.Fatalf("expected 3 messages, got %d", len(b.Messages()))
+	}
+	// block 11 was reorged out and an event of block 10 changed
+	reorged := []*manager.EventInfo{newTransfer(10, 0, 5), newTransfer(10, 1, 8)}
+	valid, err = s.ValidateEventSet(ctx, nil, 10, 11, reorged)
+	if err != nil || valid {
+		t.Fatalf("expected reorged range to be invalid, got %v %v", valid, err)
+	}
+	msgs := b.Messages()
+	if len(msgs) != 4 || !msgs[3].Tombstone || msgs[3].Key != EventKey(11, common.BigToHash(big.NewInt(11)), 0) {
+		t.Fatalf("expected a tombstone for the event of block 11, got %+v", msgs[len(msgs)-1])
+	}
+	// the manager deletes and uploads the range again
+	if err := s.DeleteEventRange(ctx, nil, 10, 11); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UploadEventSet(ctx, nil, reorged); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := b.Messages(); msgs[len(msgs)-1].Key != msgs[1].Key {
+		t.Fatal("expected republished events to keep their key")
+	}
+	valid, err = s.ValidateEventSet(ctx, nil, 10, 11, reorged)
+	if err != nil || !valid {
+		t.Fatalf("expected republished range to be valid, got %v %v", valid, err)
+	}
+	// ranges published before the sink existed cannot be compared
+	valid, err = s.ValidateEventSet(ctx, nil, 1, 9, nil)
+	if err != nil || !valid {
+		t.Fatalf("expected unknown range to be assumed valid, got %v %v", valid, err)
+	}
+}
+
+func TestFileBus(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	b, err := NewFileBus(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewEventSink(b, SinkConfig{})
+	if err := s.UploadEventSet(context.Background(), nil, []*manager.EventInfo{newTransfer(10, 0, 5)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Table != "transfers" || msgs[0].Block != 10 || len(msgs[0].Value) == 0 {
+		t.Fatalf("unexpected messages %+v", msgs)
+	}
+}
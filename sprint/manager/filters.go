@@ -0,0 +1,227 @@
+package manager
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"sort"
+	"strconv"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// TopicFilter is implemented by events that are only collected for some values of their indexed
+// arguments, see WithTopics
+type TopicFilter interface {
+	// Values accepted for topics 1 through 3, in order. An empty list accepts any value
+	FilterTopics() [][]common.Hash
+}
+
+// FilterLimits are the largest address and topic lists a provider accepts in a log filter. Filters
+// with longer lists are split into several, 0 means no limit
+type FilterLimits struct {
+	MaxAddresses int
+	// applies to each topic position
+	MaxTopics int
+}
+
+var ErrTooManyTopics = errors.New("cannot add event: topic filters only constrain topics 1 through 3")
+
+type topicEvent struct {
+	Event
+	topics [][]common.Hash
+}
+
+// WithTopics returns the event constrained to the given values of its indexed arguments, which are
+// topics 1 through 3 in order. An empty list accepts any value, so only Transfer events to one of
+// the wallets are collected with:
+//
+//	WithTopics(transfer, nil, AddressTopics(wallets...))
+//
+// Constraints are added to the filters of the event's group, and events not matching them are
+// dropped.
+func WithTopics(ev Event, topics ...[]common.Hash) Event {
+	return &topicEvent{Event: ev, topics: topics}
+}
+
+func (e *topicEvent) FilterTopics() [][]common.Hash {
+	return e.topics
+}
+
+// AddressTopics returns the topics of indexed address arguments
+func AddressTopics(addrs ...common.Address) []common.Hash {
+	out := make([]common.Hash, len(addrs))
+	for i, a := range addrs {
+		out[i] = common.BytesToHash(a.Bytes())
+	}
+	return out
+}
+
+// Returns the topic constraints of an event, sorted and without duplicates or trailing wildcards
+func eventTopics(e Event) ([][]common.Hash, error) {
+	tf, ok := e.(TopicFilter)
+	if !ok {
+		return nil, nil
+	}
+	topics := tf.FilterTopics()
+	for len(topics) > 0 && len(topics[len(topics)-1]) == 0 {
+		topics = topics[:len(topics)-1]
+	}
+	if len(topics) > 3 {
+		return nil, ErrTooManyTopics
+	}
+	out := make([][]common.Hash, len(topics))
+	for i, t := range topics {
+		if len(t) == 0 {
+			continue
+		}
+		out[i] = sortedHashes(t)
+	}
+	return out, nil
+}
+
+// Whether the topics of a log satisfy an event's constraints
+func matchTopics(constraints [][]common.Hash, topics []common.Hash) bool {
+	for i, accepted := range constraints {
+		if accepted == nil {
+			continue
+		}
+		if i+1 >= len(topics) {
+			return false
+		}
+		idx := sort.Search(len(accepted), func(j int) bool {
+			return bytes.Compare(accepted[j][:], topics[i+1][:]) >= 0
+		})
+		if idx == len(accepted) || accepted[idx] != topics[i+1] {
+			return false
+		}
+	}
+	return true
+}
+
+// filterSource is a group queried for a range, with the addresses it is queried for
+type filterSource struct {
+	grp   *EventGroup
+	addrs []common.Address
+}
+
+// Builds the filters querying the events of the groups. Events are queried together when their
+// groups are queried for the same addresses and they have the same topic constraints, and filters
+// with address or topic lists longer than the limits are split
+func buildFilters(srcs []filterSource, limits FilterLimits, startBlock, endBlock int) []ethereum.FilterQuery {
+	var merged []*ethereum.FilterQuery
+	byKey := make(map[string]*ethereum.FilterQuery)
+	for _, src := range srcs {
+		addrs := sortedAddresses(src.addrs)
+		for _, h := range src.grp.EventHashes {
+			topics := src.grp.Topics[h]
+			key := filterKey(addrs, topics)
+			f, ok := byKey[key]
+			if !ok {
+				f = &ethereum.FilterQuery{
+					Addresses: addrs,
+					Topics:    append([][]common.Hash{nil}, topics...),
+					FromBlock: big.NewInt(int64(startBlock)),
+					ToBlock:   big.NewInt(int64(endBlock)),
+				}
+				byKey[key] = f
+				merged = append(merged, f)
+			}
+			f.Topics[0] = append(f.Topics[0], h)
+		}
+	}
+	out := make([]ethereum.FilterQuery, 0, len(merged))
+	for _, f := range merged {
+		out = append(out, splitFilter(*f, limits)...)
+	}
+	return out
+}
+
+// Splits a filter into filters whose address and topic lists are within the limits, querying every
+// combination of the parts
+func splitFilter(f ethereum.FilterQuery, limits FilterLimits) []ethereum.FilterQuery {
+	out := make([]ethereum.FilterQuery, 0, 1)
+	for _, addrs := range chunk(f.Addresses, limits.MaxAddresses) {
+		part := f
+		part.Addresses = addrs
+		part.Topics = nil
+		out = append(out, part)
+	}
+	for i, topics := range f.Topics {
+		chunks := chunk(topics, limits.MaxTopics)
+		split := make([]ethereum.FilterQuery, 0, len(out)*len(chunks))
+		for _, q := range out {
+			for _, c := range chunks {
+				part := q
+				part.Topics = append(make([][]common.Hash, 0, len(f.Topics)), q.Topics[:i]...)
+				part.Topics = append(part.Topics, c)
+				split = append(split, part)
+			}
+		}
+		out = split
+	}
+	return out
+}
+
+// Splits a list into parts of at most size elements. Empty lists, which match anything, are kept
+func chunk[T any](list []T, size int) [][]T {
+	if size <= 0 || len(list) <= size {
+		return [][]T{list}
+	}
+	var out [][]T
+	for len(list) > size {
+		out = append(out, list[:size:size])
+		list = list[size:]
+	}
+	return append(out, list)
+}
+
+func filterKey(addrs []common.Address, topics [][]common.Hash) string {
+	var b bytes.Buffer
+	// lists are prefixed with their length, so keys of different lists never collide
+	b.WriteString(strconv.Itoa(len(addrs)) + ":")
+	for _, a := range addrs {
+		b.Write(a[:])
+	}
+	for _, t := range topics {
+		b.WriteString(strconv.Itoa(len(t)) + ":")
+		for _, h := range t {
+			b.Write(h[:])
+		}
+	}
+	return b.String()
+}
+
+func sortedAddresses(addrs []common.Address) []common.Address {
+	if len(addrs) == 0 {
+		return nil
+	}
+	out := append([]common.Address(nil), addrs...)
+	sort.Slice(out, func(i, j int) bool {
+		return bytes.Compare(out[i][:], out[j][:]) < 0
+	})
+	n := 1
+	for i := 1; i < len(out); i++ {
+		if out[i] != out[n-1] {
+			out[n] = out[i]
+			n++
+		}
+	}
+	return out[:n]
+}
+
+func sortedHashes(hashes []common.Hash) []common.Hash {
+	out := append([]common.Hash(nil), hashes...)
+	sort.Slice(out, func(i, j int) bool {
+		return bytes.Compare(out[i][:], out[j][:]) < 0
+	})
+	n := 0
+	for i := range out {
+		if i == 0 || out[i] != out[n-1] {
+			out[n] = out[i]
+			n++
+		}
+	}
+	return out[:n]
+}
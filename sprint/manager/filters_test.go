@@ -0,0 +1,102 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const transferFragment = `{"type":"event","name":"Transfer","anonymous":false,"inputs":[
+	{"name":"from","type":"address","indexed":true},
+	{"name":"to","type":"address","indexed":true},
+	{"name":"value","type":"uint256","indexed":false}
+]}`
+
+const approvalFragment = `{"type":"event","name":"Approval","anonymous":false,"inputs":[
+	{"name":"owner","type":"address","indexed":true},
+	{"name":"spender","type":"address","indexed":true},
+	{"name":"value","type":"uint256","indexed":false}
+]}`
+
+func TestStageFiltersTopics(t *testing.T) {
+	transfer, err := NewABIEvent([]byte(transferFragment), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	approval, err := NewABIEvent([]byte(approvalFragment), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	swap, err := NewABIEvent([]byte(swapFragment), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wallets := []common.Address{common.HexToAddress("0x01"), common.HexToAddress("0x02"), common.HexToAddress("0x03")}
+	m := NewManager(nil, nil)
+	if err := m.AddEventFilter("transfers", nil, WithTopics(transfer, nil, AddressTopics(wallets...)), approval); err != nil {
+		t.Fatal(err)
+	}
+	// events of groups without addresses or constraints share a filter
+	if err := m.AddEventFilter("swaps", nil, swap); err != nil {
+		t.Fatal(err)
+	}
+	fqs := m.GetStageFilters(1, 10)
+	if len(fqs) != 2 {
+		t.Fatalf("expected 2 filters, got %d", len(fqs))
+	}
+	for _, f := range fqs {
+		switch len(f.Topics) {
+		case 1:
+			if len(f.Topics[0]) != 2 {
+				t.Fatalf("expected approvals and swaps to share a filter, got %v", f.Topics)
+			}
+		case 3:
+			if f.Topics[0][0] != transfer.EventHash() || f.Topics[1] != nil || len(f.Topics[2]) != 3 {
+				t.Fatalf("unexpected transfer filter %v", f.Topics)
+			}
+		default:
+			t.Fatalf("unexpected filter %v", f.Topics)
+		}
+	}
+	m.SetFilterLimits(FilterLimits{MaxTopics: 2})
+	fqs = m.GetStageFilters(1, 10)
+	if len(fqs) != 3 {
+		t.Fatalf("expected the transfer filter to be split, got %d filters", len(fqs))
+	}
+	grp := m.eventGroups["transfers"]
+	to := AddressTopics(wallets[1])[0]
+	if !matchTopics(grp.Topics[transfer.EventHash()], []common.Hash{transfer.EventHash(), {}, to}) {
+		t.Fatal("expected transfer to a wallet to match")
+	}
+	if matchTopics(grp.Topics[transfer.EventHash()], []common.Hash{transfer.EventHash(), to, {}}) {
+		t.Fatal("expected transfer from a wallet not to match")
+	}
+}
+
+func TestSplitFilter(t *testing.T) {
+	f := buildFilters([]filterSource{{
+		grp:   &EventGroup{EventHashes: []common.Hash{{1}, {2}, {3}}},
+		addrs: []common.Address{{1}, {2}, {3}, {4}, {5}},
+	}}, FilterLimits{MaxAddresses: 2, MaxTopics: 2}, 1, 10)
+	// 3 address parts for each of 2 topic parts
+	if len(f) != 6 {
+		t.Fatalf("expected 6 filters, got %d", len(f))
+	}
+	seen := make(map[common.Address]map[common.Hash]bool)
+	for _, q := range f {
+		if len(q.Addresses) > 2 || len(q.Topics[0]) > 2 {
+			t.Fatalf("filter exceeds limits %+v", q)
+		}
+		for _, a := range q.Addresses {
+			if seen[a] == nil {
+				seen[a] = make(map[common.Hash]bool)
+			}
+			for _, h := range q.Topics[0] {
+				seen[a][h] = true
+			}
+		}
+	}
+	if len(seen) != 5 || len(seen[common.Address{5}]) != 3 {
+		t.Fatalf("split filters do not cover every address and topic %v", seen)
+	}
+}
@@ -0,0 +1,238 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gfx.cafe/open/ghost/hexutil"
+	"gfx.cafe/open/jrpc"
+	"gfx.cafe/open/websocket"
+	"gfx.cafe/open/websocket/wsjson"
+	"github.com/tjudice/ethutil/sprint"
+	"tuxpa.in/a/zlog/log"
+)
+
+type HeadTrackerConfig struct {
+	// Websocket endpoint to subscribe to newHeads on. When empty, or while the subscription is down,
+	// the head is polled with eth_blockNumber instead, unless the tracker has no rpc connection.
+	WSURL string
+	// Interval between eth_blockNumber polls. Defaults to 2s.
+	PollInterval time.Duration
+	// Time without a new head after which the tracker is considered stalled. A stalled subscription
+	// is dropped and the head is polled until it resubscribes. Defaults to 1m.
+	StallTimeout time.Duration
+	// Time spent polling after the subscription fails before resubscribing. Defaults to 30s.
+	ResubscribeInterval time.Duration
+}
+
+// NewHeadsTracker is a HeadTracker that follows the chain head through a newHeads subscription,
+// polling eth_blockNumber when the subscription is unavailable.
+type NewHeadsTracker struct {
+	rpc jrpc.Conn
+	c   HeadTrackerConfig
+
+	head atomic.Uint64
+	// unix nanoseconds of when the head last advanced
+	lastAdvance atomic.Int64
+	stalled     atomic.Bool
+
+	mu     sync.Mutex
+	onHead []func(block uint64)
+}
+
+var errStalled = errors.New("no new head within stall timeout")
+
+// NewHeadTracker creates a tracker that polls through rpc and subscribes through config.WSURL. Call
+// Run to start tracking the head. rpc may be nil when config.WSURL is set, the tracker then waits
+// for the resubscribe interval instead of polling while the subscription is down.
+func NewHeadTracker(rpc jrpc.Conn, config HeadTrackerConfig) *NewHeadsTracker {
+	if config.PollInterval <= 0 {
+		config.PollInterval = 2 * time.Second
+	}
+	if config.StallTimeout <= 0 {
+		config.StallTimeout = time.Minute
+	}
+	if config.ResubscribeInterval <= 0 {
+		config.ResubscribeInterval = 30 * time.Second
+	}
+	h := &NewHeadsTracker{
+		rpc: rpc,
+		c:   config,
+	}
+	h.lastAdvance.Store(time.Now().UnixNano())
+	return h
+}
+
+// CurrentBlock returns the latest head seen
+func (h *NewHeadsTracker) CurrentBlock() uint64 {
+	return h.head.Load()
+}
+
+// Lag returns the time since the head last advanced
+func (h *NewHeadsTracker) Lag() time.Duration {
+	return time.Since(time.Unix(0, h.lastAdvance.Load()))
+}
+
+// Stalled reports whether the head has not advanced within the stall timeout
+func (h *NewHeadsTracker) Stalled() bool {
+	return h.Lag() > h.c.StallTimeout
+}
+
+// OnHead registers a callback run whenever the head advances, e.g. HeadTrigger(s.TriggerSchedule) so
+// new ranges are scheduled without waiting for the schedule interval. Callbacks must not block.
+func (h *NewHeadsTracker) OnHead(fn func(block uint64)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.onHead = append(h.onHead, fn)
+}
+
+// HeadTrigger adapts a callback that does not need the head, such as Sprint.TriggerSchedule, to OnHead
+func HeadTrigger(fn func()) func(block uint64) {
+	return func(uint64) {
+		fn()
+	}
+}
+
+// Run tracks the head until the context is cancelled
+func (h *NewHeadsTracker) Run(ctx context.Context) error {
+	if h.rpc == nil && h.c.WSURL == "" {
+		return errors.New("head tracker needs an rpc connection or a websocket url")
+	}
+	for {
+		if h.c.WSURL != "" {
+			err := h.subscribe(ctx)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Err(err).Str("url", h.c.WSURL).Msg("newHeads subscription failed")
+			err = h.poll(ctx, h.c.ResubscribeInterval)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			continue
+		}
+		// nothing to resubscribe to, so poll for good
+		return h.poll(ctx, 0)
+	}
+}
+
+func (h *NewHeadsTracker) setHead(block uint64) {
+	for {
+		curr := h.head.Load()
+		// heads at or below the current one are reorgs or duplicates, the scheduler only moves forward
+		if block <= curr {
+			return
+		}
+		if h.head.CompareAndSwap(curr, block) {
+			break
+		}
+	}
+	h.lastAdvance.Store(time.Now().UnixNano())
+	if h.stalled.CompareAndSwap(true, false) {
+		log.Info().Uint64("head", block).Msg("head tracker recovered")
+	}
+	h.mu.Lock()
+	callbacks := h.onHead
+	h.mu.Unlock()
+	for _, fn := range callbacks {
+		fn(block)
+	}
+}
+
+func (h *NewHeadsTracker) checkStall() {
+	if h.Stalled() && h.stalled.CompareAndSwap(false, true) {
+		log.Warn().Uint64("head", h.CurrentBlock()).Dur("lag", h.Lag()).Msg("head tracker stalled")
+	}
+}
+
+// Polls eth_blockNumber, returning after d has passed. Polls until the context is cancelled if d is 0.
+// Without an rpc connection it only waits
+func (h *NewHeadsTracker) poll(ctx context.Context, d time.Duration) error {
+	var deadline <-chan time.Time
+	if d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	ticker := time.NewTicker(h.c.PollInterval)
+	defer ticker.Stop()
+	for {
+		if h.rpc != nil {
+			var head hexutil.Uint64
+			err := h.rpc.Do(ctx, &head, "eth_blockNumber", nil)
+			if err != nil {
+				log.Err(err).Msg("error polling head")
+			} else {
+				h.setHead(uint64(head))
+			}
+		}
+		h.checkStall()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+type subscriptionMessage struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+	Params struct {
+		Subscription string              `json:"subscription"`
+		Result       *sprint.BlockHeader `json:"result"`
+	} `json:"params"`
+}
+
+// Follows newHeads until the subscription fails or stalls
+func (h *NewHeadsTracker) subscribe(ctx context.Context) error {
+	conn, _, err := websocket.Dial(ctx, h.c.WSURL, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	// headers are small, but leave room for chains with large extra data
+	conn.SetReadLimit(1 << 20)
+	err = wsjson.Write(ctx, conn, map[string]any{
+		"jsonrpc": "2.0",
+		"id":      1,
+		"method":  "eth_subscribe",
+		"params":  []any{"newHeads"},
+	})
+	if err != nil {
+		return err
+	}
+	for {
+		// bound every read by the stall timeout so a silent subscription is dropped
+		readCtx, cancel := context.WithTimeout(ctx, h.c.StallTimeout)
+		msg := &subscriptionMessage{}
+		err := wsjson.Read(readCtx, conn, msg)
+		cancel()
+		if err != nil {
+			if ctx.Err() == nil && errors.Is(readCtx.Err(), context.DeadlineExceeded) {
+				h.checkStall()
+				return errStalled
+			}
+			return err
+		}
+		if msg.Error != nil {
+			return fmt.Errorf("eth_subscribe: %d %s", msg.Error.Code, msg.Error.Message)
+		}
+		// the first message only confirms the subscription
+		if msg.Method != "eth_subscription" || msg.Params.Result == nil || msg.Params.Result.Number == nil {
+			continue
+		}
+		h.setHead(msg.Params.Result.Number.Uint64())
+	}
+}
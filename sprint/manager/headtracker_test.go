@@ -0,0 +1,172 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gfx.cafe/open/ghost/hexutil"
+	"gfx.cafe/open/jrpc"
+	"gfx.cafe/open/websocket"
+	"gfx.cafe/open/websocket/wsjson"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// headConn answers eth_blockNumber with its head, or fails when the head is 0
+type headConn struct {
+	head atomic.Uint64
+}
+
+func (c *headConn) Do(ctx context.Context, result any, method string, params any) error {
+	head := c.head.Load()
+	if method != "eth_blockNumber" || head == 0 {
+		return errors.New("unavailable")
+	}
+	*result.(*hexutil.Uint64) = hexutil.Uint64(head)
+	return nil
+}
+
+func (c *headConn) BatchCall(ctx context.Context, b ...*jrpc.BatchElem) error {
+	return errors.New("unavailable")
+}
+
+func (c *headConn) Close() error { return nil }
+
+func (c *headConn) Closed() <-chan struct{} { return nil }
+
+// Runs the tracker until the test ends, returning the heads it reports
+func runTracker(t *testing.T, h *NewHeadsTracker) <-chan uint64 {
+	heads := make(chan uint64, 16)
+	h.OnHead(func(block uint64) {
+		heads <- block
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- h.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; !errors.Is(err, context.Canceled) {
+			t.Errorf("expected the tracker to stop with the context, got %v", err)
+		}
+	})
+	return heads
+}
+
+func waitHead(t *testing.T, heads <-chan uint64, want uint64) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case head := <-heads:
+			if head == want {
+				return
+			}
+			if head > want {
+				t.Fatalf("expected head %d, got %d", want, head)
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for head %d", want)
+		}
+	}
+}
+
+func TestHeadTrackerPoll(t *testing.T) {
+	conn := &headConn{}
+	conn.head.Store(10)
+	h := NewHeadTracker(conn, HeadTrackerConfig{PollInterval: 5 * time.Millisecond})
+	var triggers atomic.Int64
+	h.OnHead(HeadTrigger(func() { triggers.Add(1) }))
+	heads := runTracker(t, h)
+	waitHead(t, heads, 10)
+	conn.head.Store(12)
+	waitHead(t, heads, 12)
+	// heads never move back on reorgs
+	conn.head.Store(11)
+	time.Sleep(50 * time.Millisecond)
+	if h.CurrentBlock() != 12 {
+		t.Fatalf("expected head 12, got %d", h.CurrentBlock())
+	}
+	if got := triggers.Load(); got != 2 {
+		t.Fatalf("expected 2 triggers, got %d", got)
+	}
+	if h.Stalled() {
+		t.Fatal("expected the tracker not to be stalled")
+	}
+}
+
+func TestHeadTrackerResubscribe(t *testing.T) {
+	// polling fails, or there is nothing to poll, so heads only come from subscriptions
+	for name, rpc := range map[string]jrpc.Conn{"polling fails": &headConn{}, "without rpc": nil} {
+		t.Run(name, func(t *testing.T) {
+			testHeadTrackerResubscribe(t, rpc)
+		})
+	}
+	if err := NewHeadTracker(nil, HeadTrackerConfig{}).Run(context.Background()); err == nil {
+		t.Fatal("expected a tracker without rpc or websocket url to fail")
+	}
+}
+
+func testHeadTrackerResubscribe(t *testing.T, rpc jrpc.Conn) {
+	var connections atomic.Int64
+	var wg sync.WaitGroup
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wg.Add(1)
+		defer wg.Done()
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		ctx := context.Background()
+		var req map[string]any
+		if err := wsjson.Read(ctx, conn, &req); err != nil || req["method"] != "eth_subscribe" {
+			t.Errorf("expected eth_subscribe, got %v %v", req, err)
+			return
+		}
+		wsjson.Write(ctx, conn, map[string]any{"jsonrpc": "2.0", "id": 1, "result": "0x1"})
+		head := "0x10"
+		if connections.Add(1) > 1 {
+			head = "0x20"
+		}
+		wsjson.Write(ctx, conn, map[string]any{
+			"jsonrpc": "2.0",
+			"method":  "eth_subscription",
+			"params": map[string]any{
+				"subscription": "0x1",
+				"result":       map[string]any{"number": head, "hash": common.Hash{1}, "parentHash": common.Hash{2}, "timestamp": "0x3"},
+			},
+		})
+		if head == "0x10" {
+			// the first subscription fails after its first head
+			return
+		}
+		// the second one stays open until the tracker stops
+		for wsjson.Read(ctx, conn, &req) == nil {
+		}
+	}))
+	// cleanups run in reverse, so the tracker stops before the server
+	t.Cleanup(func() {
+		srv.Close()
+		wg.Wait()
+	})
+	h := NewHeadTracker(rpc, HeadTrackerConfig{
+		WSURL:               "ws" + strings.TrimPrefix(srv.URL, "http"),
+		PollInterval:        5 * time.Millisecond,
+		ResubscribeInterval: 20 * time.Millisecond,
+		StallTimeout:        time.Second,
+	})
+	heads := runTracker(t, h)
+	waitHead(t, heads, 16)
+	waitHead(t, heads, 32)
+	if got := connections.Load(); got != 2 {
+		t.Fatalf("expected 2 subscriptions, got %d", got)
+	}
+}
@@ -3,7 +3,9 @@ package manager
 import (
 	"context"
 	"errors"
-	"math/big"
+	"fmt"
+	"sort"
+	"sync"
 
 	"gfx.cafe/open/ghost"
 	"github.com/ethereum/go-ethereum"
@@ -35,19 +37,86 @@ type EventUploader interface {
 	DeleteEventRange(ctx context.Context, d db.Session, startBlock, endBlock int) error
 }
 
+// LaneEventUploader is implemented by uploaders that can validate and delete the events of a subset
+// of event tables. Event groups added with a start block are backfilled in their own lane, whose
+// ranges only contain the group's events, so they must be validated against the group's tables alone.
+// Ranges of the main lane are then validated against the tables of the groups that joined it.
+type LaneEventUploader interface {
+	ValidateTableEventSet(ctx context.Context, d db.Session, tables []string, startBlock, endBlock int, eventInfo []*EventInfo) (bool, error)
+	DeleteTableEventRange(ctx context.Context, d db.Session, tables []string, startBlock, endBlock int) error
+}
+
+// AddressRecorder is implemented by uploaders that persist the addresses events add through
+// FilterUpdater.AddAddress, such as contracts created by a factory, so GetActiveAddresses can return
+// them for later ranges. Addresses are recorded in the transaction of the range that added them.
+// Once an AddressRegistry is set with Manager.SetAddressRegistry, the registry is authoritative and
+// addresses are no longer recorded with the uploader.
+type AddressRecorder interface {
+	RecordAddresses(ctx context.Context, d db.Session, addrs []*ActiveAddress) error
+}
+
+// ActiveAddress is an address added by an event, whose events are collected from the block of the event
+type ActiveAddress struct {
+	Address common.Address `json:"address"`
+	Block   int            `json:"block"`
+	// Table of the event that added the address
+	Table string `json:"table"`
+	// Address of the contract that emitted the event, e.g. the factory that created the address
+	Factory common.Address `json:"factory"`
+	// Group of the event that added the address
+	Group string `json:"group"`
+}
+
 var ErrDuplicateEvent = errors.New("cannot add event: duplicate event hash")
 
+var ErrLaneUploader = errors.New("cannot add event group with a start block: uploader does not implement LaneEventUploader")
+
+// ErrBackfillDiscovery is returned for ranges backfilled below the main lane whose events add
+// addresses, see sprint.EventBatch.Backfill. The main lane may have committed the blocks above without
+// the addresses' events, so groups whose events add addresses must be added with AddEventFilter, and
+// sprint run without sprint.SprintConfig.BackfillWorkers.
+var ErrBackfillDiscovery = errors.New("events of backfilled ranges cannot add addresses")
+
 type Manager struct {
-	poller         HeadTracker
+	poller HeadTracker
+	// guards the event groups, which may change while sprint is running
+	mu             sync.RWMutex
 	events         map[common.Hash]Event
 	eventGroups    map[string]*EventGroup
+	eventGroupIDs  map[common.Hash]string
 	allowAddresses []common.Address
+	filterLimits   FilterLimits
 	uploader       EventUploader
+	lanes          sprint.LaneScheduler
+	// subscribers and the notifications of batches waiting for their transaction to commit
+	subMu     sync.Mutex
+	deliverMu sync.Mutex
+	subs      []*Subscription
+	pending   map[*sprint.EventBatch]*Notification
+	// registry of discovered addresses, its committed addresses by group, addresses discovered by
+	// batches that have not committed yet, and the registry changes of those batches
+	regMu           sync.RWMutex
+	registry        AddressRegistry
+	discovered      map[string]map[common.Address]*ActiveAddress
+	hints           map[string]map[common.Address]*ActiveAddress
+	pendingRegistry map[*sprint.EventBatch]*registryChange
 }
 
 type EventGroup struct {
 	EventHashes []common.Hash
 	Addresses   []common.Address
+	// Values accepted for topics 1 through 3 of the events constrained with WithTopics, by event hash
+	Topics map[common.Hash][][]common.Hash
+	// First block the group is queried from. 0 for groups added with AddEventFilter
+	StartBlock uint64
+	// First block the group is queried from in the main lane. Blocks between StartBlock and
+	// ActiveFrom are backfilled in the group's lane. sprint.NeverJoins for groups with their own lane
+	ActiveFrom uint64
+	// Lane backfilling the group, empty if the group was never backfilled
+	Lane string
+	// whether the group was added with a start block and so is tracked by the sprint lanes
+	fromBlock bool
+	tables    []string
 }
 
 type HeadTracker interface {
@@ -62,49 +131,207 @@ type FilterUpdater interface {
 
 func NewManager(poller HeadTracker, uploader EventUploader) *Manager {
 	return &Manager{
-		poller:      poller,
-		events:      make(map[common.Hash]Event),
-		eventGroups: make(map[string]*EventGroup),
-		uploader:    uploader,
+		poller:        poller,
+		events:        make(map[common.Hash]Event),
+		eventGroups:   make(map[string]*EventGroup),
+		eventGroupIDs: make(map[common.Hash]string),
+		uploader:      uploader,
 	}
 }
 
+// GetStageFilters returns the filters of the groups in the main lane. Events of groups queried for the
+// same addresses share filters, see FilterLimits
 func (m *Manager) GetStageFilters(startBlock, endBlock int) []ethereum.FilterQuery {
-	fqs := make([]ethereum.FilterQuery, 0, len(m.eventGroups))
-	for _, grp := range m.eventGroups {
-		fqs = append(fqs, ethereum.FilterQuery{
-			Addresses: grp.Addresses,
-			Topics: [][]common.Hash{
-				grp.EventHashes,
-			},
-			FromBlock: big.NewInt(int64(startBlock)),
-			ToBlock:   big.NewInt(int64(endBlock)),
-		})
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ids := make([]string, 0, len(m.eventGroups))
+	for groupID, grp := range m.eventGroups {
+		// groups join the main lane once their backfill is scheduled
+		if grp.ActiveFrom > uint64(endBlock) {
+			continue
+		}
+		ids = append(ids, groupID)
 	}
-	return fqs
+	sort.Strings(ids)
+	srcs := make([]filterSource, len(ids))
+	for i, groupID := range ids {
+		grp := m.eventGroups[groupID]
+		srcs[i] = filterSource{grp: grp, addrs: m.groupAddresses(groupID, grp, endBlock)}
+	}
+	return buildFilters(srcs, m.filterLimits, startBlock, endBlock)
+}
+
+// GetLaneFilters returns the filters of the group backfilled in the given lane
+func (m *Manager) GetLaneFilters(lane string, startBlock, endBlock int) []ethereum.FilterQuery {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	grp, ok := m.eventGroups[lane]
+	if !ok || grp.Lane != lane {
+		return nil
+	}
+	srcs := []filterSource{{grp: grp, addrs: m.groupAddresses(lane, grp, endBlock)}}
+	return buildFilters(srcs, m.filterLimits, startBlock, endBlock)
+}
+
+// SetFilterLimits sets the largest address and topic lists of the filters the manager returns
+func (m *Manager) SetFilterLimits(limits FilterLimits) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.filterLimits = limits
 }
 
+// AddEventFilter adds an event group that is queried from the sprint start block. Groups cannot be
+// added this way while sprint is running, use AddEventFilterFrom instead
 func (m *Manager) AddEventFilter(groupID string, addrs []common.Address, evs ...Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.lanes != nil && m.lanes.IsActive() {
+		return sprint.ErrSprintActive
+	}
+	grp, err := m.newEventGroup(groupID, addrs, evs)
+	if err != nil {
+		return err
+	}
+	m.addEventGroup(groupID, grp, evs)
+	return nil
+}
+
+// AddEventFilterFrom adds an event group that is queried from startBlock, and may be called while
+// sprint is running. If sprint has already scheduled past startBlock, the blocks up to its schedule
+// head are backfilled in a lane named after the group, and the group joins the main lane above it.
+// With sprint.SprintConfig.LanePerGroup set, the group instead keeps its own lane and progress from
+// startBlock up to the chain head. The uploader must implement LaneEventUploader. Backfilled ranges
+// fail with ErrBackfillDiscovery when the group's events add addresses.
+//
+// Lanes are persisted by sprint, so groups should be added with the same id and start block on every
+// run. Adding a group for the first time backfills it, without re-indexing the other groups.
+func (m *Manager) AddEventFilterFrom(ctx context.Context, groupID string, startBlock uint64, addrs []common.Address, evs ...Event) error {
+	if _, ok := m.uploader.(LaneEventUploader); !ok {
+		return ErrLaneUploader
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	grp, err := m.newEventGroup(groupID, addrs, evs)
+	if err != nil {
+		return err
+	}
+	grp.StartBlock = startBlock
+	grp.ActiveFrom = startBlock
+	grp.fromBlock = true
+	// the lock is held while the lane is scheduled, so no range past the join block can be
+	// queried without the group
+	if m.lanes != nil {
+		err := m.scheduleLane(ctx, groupID, grp)
+		if err != nil {
+			return err
+		}
+	}
+	m.addEventGroup(groupID, grp, evs)
+	return nil
+}
+
+// RemoveEventFilter removes an event group, and its backfill lane if it has one. Events of the group
+// that were already uploaded are left in place, since finalized ranges are never validated again and
+// the ranges of a removed lane are not validated at all. Delete them from the group's tables if they
+// are no longer needed.
+func (m *Manager) RemoveEventFilter(ctx context.Context, groupID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	grp, ok := m.eventGroups[groupID]
+	if !ok {
+		return errors.New("cannot remove event group: unknown group id")
+	}
+	if grp.fromBlock && m.lanes != nil {
+		err := m.lanes.RemoveLane(ctx, groupID)
+		if err != nil {
+			return err
+		}
+	}
+	for _, h := range grp.EventHashes {
+		delete(m.events, h)
+		delete(m.eventGroupIDs, h)
+	}
+	delete(m.eventGroups, groupID)
+	return nil
+}
+
+// AttachLanes is called by sprint when the manager is handed to it, and schedules the lanes of
+// groups that were added with a start block beforehand
+func (m *Manager) AttachLanes(ctx context.Context, ls sprint.LaneScheduler) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.lanes != nil {
+		return errors.New("manager is already attached to a sprint")
+	}
+	m.lanes = ls
+	for groupID, grp := range m.eventGroups {
+		if !grp.fromBlock {
+			continue
+		}
+		err := m.scheduleLane(ctx, groupID, grp)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Manager) scheduleLane(ctx context.Context, groupID string, grp *EventGroup) error {
+	joinBlock, err := m.lanes.AddLane(ctx, groupID, grp.StartBlock)
+	if err != nil {
+		return err
+	}
+	grp.ActiveFrom = joinBlock
+	if joinBlock > grp.StartBlock {
+		grp.Lane = groupID
+	}
+	return nil
+}
+
+func (m *Manager) newEventGroup(groupID string, addrs []common.Address, evs []Event) (*EventGroup, error) {
 	if _, ok := m.eventGroups[groupID]; ok {
-		return errors.New("cannot add event group: duplicate group id")
+		return nil, errors.New("cannot add event group: duplicate group id")
+	}
+	grp := &EventGroup{
+		EventHashes: make([]common.Hash, 0, len(evs)),
+		Addresses:   addrs,
 	}
-	hashes := make([]common.Hash, 0, len(evs))
+	seen := make(map[string]struct{})
 	for _, e := range evs {
 		// ensures we dont already have an event with the same event sig
 		if _, ok := m.events[e.EventHash()]; ok {
-			return ErrDuplicateEvent
+			return nil, ErrDuplicateEvent
+		}
+		grp.EventHashes = append(grp.EventHashes, e.EventHash())
+		topics, err := eventTopics(e)
+		if err != nil {
+			return nil, err
+		}
+		if len(topics) > 0 {
+			if grp.Topics == nil {
+				grp.Topics = make(map[common.Hash][][]common.Hash)
+			}
+			grp.Topics[e.EventHash()] = topics
+		}
+		if _, ok := seen[e.Table()]; !ok {
+			seen[e.Table()] = struct{}{}
+			grp.tables = append(grp.tables, e.Table())
 		}
-		m.events[e.EventHash()] = e
-		hashes = append(hashes, e.EventHash())
 	}
-	m.eventGroups[groupID] = &EventGroup{
-		EventHashes: hashes,
-		Addresses:   addrs,
+	return grp, nil
+}
+
+func (m *Manager) addEventGroup(groupID string, grp *EventGroup, evs []Event) {
+	for _, e := range evs {
+		m.events[e.EventHash()] = e
+		m.eventGroupIDs[e.EventHash()] = groupID
 	}
-	return nil
+	m.eventGroups[groupID] = grp
 }
 
 func (m *Manager) AllowAddresses(addrs ...common.Address) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	// these addresses wont be filtered out ever
 	m.allowAddresses = append(m.allowAddresses, addrs...)
 }
@@ -120,9 +347,20 @@ func (m *Manager) Insert(ctx context.Context, s db.Session, startBlock, endBlock
 	if err != nil {
 		return err
 	}
+	addrs = append(addrs, m.registeredAddresses(startBlock)...)
+	m.mu.RLock()
 	addrs = append(addrs, m.allowAddresses...)
 	// filters out events that are not relevant to the current sprint
-	filtered, err := m.filterQueriedEvents(addrs, events)
+	filtered, added, err := m.filterQueriedEvents(addrs, events)
+	if err == nil {
+		err = checkBackfillDiscovery(events.Backfill(), added)
+	}
+	if err == nil && m.hasRegistry() {
+		m.addHints(added)
+		// the batch may miss events of addresses discovered since it was queried
+		err = m.checkFilters(events.Filters(), added)
+	}
+	m.mu.RUnlock()
 	if err != nil {
 		return err
 	}
@@ -130,6 +368,20 @@ func (m *Manager) Insert(ctx context.Context, s db.Session, startBlock, endBlock
 	if err := m.uploader.UploadEventSet(ctx, s, filtered); err != nil {
 		return err
 	}
+	if err := m.recordAddresses(ctx, s, added); err != nil {
+		return err
+	}
+	if err := m.updateRegistry(ctx, s, events, nil, added); err != nil {
+		return err
+	}
+	if m.hasSubscribers() {
+		m.stageNotification(events, &Notification{
+			Lane:       events.Lane(),
+			StartBlock: startBlock,
+			EndBlock:   endBlock,
+			Events:     append([]*EventInfo(nil), filtered...),
+		})
+	}
 	return nil
 }
 
@@ -141,14 +393,27 @@ func (m *Manager) Validate(ctx context.Context, s db.Session, startBlock, endBlo
 	if err != nil {
 		return false, err
 	}
+	addrs = append(addrs, m.registeredAddresses(startBlock)...)
+	m.mu.RLock()
 	addrs = append(addrs, m.allowAddresses...)
-	filtered, err := m.filterQueriedEvents(addrs, events)
+	filtered, added, err := m.filterQueriedEvents(addrs, events)
+	if err == nil {
+		err = checkBackfillDiscovery(events.Backfill(), added)
+	}
+	tables := m.validatedTables(events.Lane(), startBlock, endBlock)
+	var removals []registryRemoval
+	if err == nil && m.hasRegistry() {
+		m.addHints(added)
+		err = m.checkFilters(events.Filters(), added)
+		removals = m.registryRemovals(events.Lane(), startBlock, endBlock)
+	}
+	m.mu.RUnlock()
 	if err != nil {
 		return false, err
 	}
 	// checks the newly filtered range (ideally a distance behind head that is safe from chain reorgianizations)
 	// and returns whether or not the newly queried range is identicaly to the previously inserted range
-	isValid, err := m.uploader.ValidateEventSet(ctx, s, startBlock, endBlock, filtered)
+	isValid, err := m.validateEventSet(ctx, s, tables, endBlock, filtered)
 	if err != nil {
 		return false, err
 	}
@@ -158,22 +423,161 @@ func (m *Manager) Validate(ctx context.Context, s db.Session, startBlock, endBlo
 	}
 	// validation fail, delete and reupload
 	log.Debug().Int("start", startBlock).Int("end", endBlock).Msg("reorg detected, deleting and reuploading")
-	err = m.uploader.DeleteEventRange(ctx, s, startBlock, endBlock)
+	// subscribers are told which events the reorg removed, so load them before they are deleted
+	notify := m.hasSubscribers()
+	var removed []*EventInfo
+	if loader, ok := m.uploader.(EventRangeLoader); ok && notify {
+		for _, rng := range tables {
+			rngRemoved, err := loader.LoadEventRange(ctx, s, rng.tables, rng.start, endBlock)
+			if err != nil {
+				return false, err
+			}
+			removed = append(removed, rngRemoved...)
+		}
+	}
+	err = m.deleteEventRange(ctx, s, tables, endBlock)
+	if err != nil {
+		return false, err
+	}
+	err = m.uploader.UploadEventSet(ctx, s, filtered)
 	if err != nil {
 		return false, err
 	}
-	return true, m.uploader.UploadEventSet(ctx, s, filtered)
+	err = m.recordAddresses(ctx, s, added)
+	if err != nil {
+		return false, err
+	}
+	// addresses discovered by the removed events are dropped along with them
+	err = m.updateRegistry(ctx, s, events, removals, added)
+	if err != nil {
+		return false, err
+	}
+	if notify {
+		m.stageNotification(events, revertNotification(events.Lane(), startBlock, endBlock, removed, filtered))
+	}
+	return true, nil
+}
+
+// tableRange is a set of tables whose events a range holds from start on. tables is nil for every
+// table of the uploader
+type tableRange struct {
+	start  int
+	tables []string
+}
+
+// Returns the tables a range of the lane holds events of. Ranges of backfill lanes only hold the
+// events of their group, and ranges of the main lane only hold a group's events from the block it
+// joined at, so the group's backfilled events below it are left alone. Without groups joining the
+// main lane, its ranges are compared across every table of the uploader.
+func (m *Manager) validatedTables(lane string, startBlock, endBlock int) []tableRange {
+	if lane != "" {
+		// the group was removed, nothing left to compare
+		grp, ok := m.eventGroups[lane]
+		if !ok || len(grp.tables) == 0 {
+			return nil
+		}
+		return []tableRange{{start: startBlock, tables: grp.tables}}
+	}
+	joined := false
+	for _, grp := range m.eventGroups {
+		if grp.ActiveFrom != 0 {
+			joined = true
+			break
+		}
+	}
+	if !joined {
+		return []tableRange{{start: startBlock}}
+	}
+	// the earliest block each table is held from
+	starts := make(map[string]int)
+	for _, grp := range m.eventGroups {
+		if grp.ActiveFrom > uint64(endBlock) {
+			continue
+		}
+		start := startBlock
+		if grp.ActiveFrom > uint64(start) {
+			start = int(grp.ActiveFrom)
+		}
+		for _, table := range grp.tables {
+			if curr, ok := starts[table]; !ok || start < curr {
+				starts[table] = start
+			}
+		}
+	}
+	byStart := make(map[int][]string)
+	for table, start := range starts {
+		byStart[start] = append(byStart[start], table)
+	}
+	rngs := make([]tableRange, 0, len(byStart))
+	for start, tables := range byStart {
+		sort.Strings(tables)
+		rngs = append(rngs, tableRange{start: start, tables: tables})
+	}
+	sort.Slice(rngs, func(i, j int) bool { return rngs[i].start < rngs[j].start })
+	return rngs
+}
+
+func (m *Manager) validateEventSet(ctx context.Context, s db.Session, tables []tableRange, endBlock int, filtered []*EventInfo) (bool, error) {
+	for _, rng := range tables {
+		var isValid bool
+		var err error
+		if rng.tables == nil {
+			isValid, err = m.uploader.ValidateEventSet(ctx, s, rng.start, endBlock, filtered)
+		} else {
+			isValid, err = m.uploader.(LaneEventUploader).ValidateTableEventSet(ctx, s, rng.tables, rng.start, endBlock, filtered)
+		}
+		if err != nil || !isValid {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (m *Manager) deleteEventRange(ctx context.Context, s db.Session, tables []tableRange, endBlock int) error {
+	for _, rng := range tables {
+		var err error
+		if rng.tables == nil {
+			err = m.uploader.DeleteEventRange(ctx, s, rng.start, endBlock)
+		} else {
+			err = m.uploader.(LaneEventUploader).DeleteTableEventRange(ctx, s, rng.tables, rng.start, endBlock)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rejects addresses discovered by the events of a backfilled range, see ErrBackfillDiscovery
+func checkBackfillDiscovery(backfill bool, added []*ActiveAddress) error {
+	if !backfill || len(added) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %s added at block %d", ErrBackfillDiscovery, added[0].Address.Hex(), added[0].Block)
+}
+
+// Records addresses with the uploader, unless the address registry keeps them
+func (m *Manager) recordAddresses(ctx context.Context, s db.Session, added []*ActiveAddress) error {
+	recorder, ok := m.uploader.(AddressRecorder)
+	if !ok || len(added) == 0 || m.hasRegistry() {
+		return nil
+	}
+	return recorder.RecordAddresses(ctx, s, added)
 }
 
 type EventInfo struct {
 	EventLog        Event
 	TransactionInfo *sprint.TransactionInfo
-	Block           int
-	Timestamp       uint64
+	// Receipt of the transaction, nil unless sprint fetches receipts
+	Receipt   *sprint.ReceiptInfo
+	Block     int
+	Timestamp uint64
 }
 
-func (m *Manager) filterQueriedEvents(addrs []common.Address, events *sprint.EventBatch) ([]*EventInfo, error) {
+// Returns the events of the batch accepted by the event groups, along with the addresses the events added
+func (m *Manager) filterQueriedEvents(addrs []common.Address, events *sprint.EventBatch) ([]*EventInfo, []*ActiveAddress, error) {
 	filterUpdater := newFilterTracker(addrs)
+	lane := events.Lane()
 	out := make([]*EventInfo, 0, len(events.Events))
 	for _, e := range events.Events {
 		// paranoid check
@@ -185,6 +589,19 @@ func (m *Manager) filterQueriedEvents(addrs []common.Address, events *sprint.Eve
 		if !ok {
 			continue
 		}
+		// backfill lanes only hold the events of their group, and the main lane only holds a
+		// group's events from the block it joined at
+		grp := m.eventGroups[m.eventGroupIDs[e.Topics[0]]]
+		if lane != "" && grp.Lane != lane {
+			continue
+		}
+		if lane == "" && e.BlockNumber < grp.ActiveFrom {
+			continue
+		}
+		// logs of other filters may hold the event with other indexed arguments
+		if !matchTopics(grp.Topics[e.Topics[0]], e.Topics) {
+			continue
+		}
 		// checks if addresses is in set of valid event contract sources
 		if _, ok := filterUpdater.addrs[e.Address]; !ok {
 			continue
@@ -194,21 +611,33 @@ func (m *Manager) filterQueriedEvents(addrs []common.Address, events *sprint.Eve
 		// check to make sure block data is present
 		block, ok := events.Blocks[int(e.BlockNumber)]
 		if !ok {
-			return nil, errors.New("missing block")
+			return nil, nil, errors.New("missing block")
 		}
 		// check to make sure tx data is present in block
 		tx, ok := block.TxMap[e.TxHash]
 		if !ok {
-			return nil, errors.New("missing tx")
+			return nil, nil, errors.New("missing tx")
+		}
+		// receipts are only present when sprint is configured to fetch them
+		var receipt *sprint.ReceiptInfo
+		if events.Receipts != nil {
+			receipt, ok = events.Receipts[e.TxHash]
+			if !ok {
+				return nil, nil, errors.New("missing receipt")
+			}
 		}
 		// set block timestamp, done this way so we dont have to align timestamp and other event info
 		e.Timestamp = block.Timestamp.Uint64()
 		// marshals log info into event struct, determines if the event is valid
 		// and allows the event interface to update the addresses filter
 		// in the case of a new contract event source being added intra-range
+		filterUpdater.block = int(e.BlockNumber)
+		filterUpdater.table = newEvent.Table()
+		filterUpdater.factory = e.Address
+		filterUpdater.group = m.eventGroupIDs[e.Topics[0]]
 		ok, err := newEvent.Process(filterUpdater, e)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		// bad event, dont insert
 		if !ok {
@@ -217,11 +646,12 @@ func (m *Manager) filterQueriedEvents(addrs []common.Address, events *sprint.Eve
 		out = append(out, &EventInfo{
 			EventLog:        newEvent,
 			TransactionInfo: tx,
+			Receipt:         receipt,
 			Block:           int(e.BlockNumber),
 			Timestamp:       block.Timestamp.Uint64(),
 		})
 	}
-	return out, nil
+	return out, filterUpdater.added, nil
 }
 
 func newFilterTracker(addrs []common.Address) *filterTracker {
@@ -236,8 +666,18 @@ func newFilterTracker(addrs []common.Address) *filterTracker {
 
 type filterTracker struct {
 	addrs map[common.Address]struct{}
+	// block, table, address and group of the event being processed, and the addresses added by events
+	block   int
+	table   string
+	factory common.Address
+	group   string
+	added   []*ActiveAddress
 }
 
 func (f *filterTracker) AddAddress(addr common.Address) {
+	if _, ok := f.addrs[addr]; ok {
+		return
+	}
 	f.addrs[addr] = struct{}{}
+	f.added = append(f.added, &ActiveAddress{Address: addr, Block: f.block, Table: f.table, Factory: f.factory, Group: f.group})
 }
@@ -0,0 +1,146 @@
+package manager
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"gfx.cafe/open/ghost"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/holiman/uint256"
+	"github.com/tjudice/ethutil/sprint"
+	"github.com/upper/db/v4"
+	"github.com/upper/db/v4/adapter/sqlite"
+)
+
+// Returns an uploader of the given tables kept in a SQLite database, whose SQL is close enough to
+// Postgres for the queries of the event tables
+func newSQLiteUploader(t *testing.T, tables ...string) (db.Session, *PostgresEventUploader) {
+	sess, err := sqlite.Open(sqlite.ConnectionURL{Database: filepath.Join(t.TempDir(), "events.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sess.Close() })
+	u := NewPostgresEventUploader(PostgresUploaderConfig{Tables: tables})
+	if err := u.CreateTables(context.Background(), sess); err != nil {
+		t.Fatal(err)
+	}
+	return sess, u
+}
+
+// Returns a stored event of a transaction at a block
+func testEventInfo(ev *ABIEvent, block, logIndex int) *EventInfo {
+	ev = ev.Copy().(*ABIEvent)
+	ev.LogIndex = logIndex
+	return &EventInfo{
+		EventLog:        ev,
+		TransactionInfo: &sprint.TransactionInfo{Hash: common.Hash{byte(block)}},
+		Block:           block,
+	}
+}
+
+func TestEventInfoReceipt(t *testing.T) {
+	ev, err := NewABIEvent([]byte(transferFragment), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := common.HexToAddress("0x01")
+	m := NewManager(nil, nil)
+	if err := m.AddEventFilter("tokens", []common.Address{token}, ev); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ev.def.Inputs.NonIndexed().Pack(uint256.NewInt(5).ToBig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := &sprint.TransactionInfo{Hash: common.Hash{0xaa}}
+	batch := &sprint.EventBatch{
+		Events: []*ghost.ErigonLog{{
+			Address:     token,
+			Topics:      []common.Hash{ev.EventHash(), {}, {}},
+			Data:        data,
+			BlockNumber: 5,
+			TxHash:      tx.Hash,
+		}},
+		Blocks: map[int]*sprint.BlockInfo{5: {
+			Timestamp: uint256.NewInt(60),
+			TxMap:     map[common.Hash]*sprint.TransactionInfo{tx.Hash: tx},
+		}},
+	}
+	// receipts are only attached when sprint fetches them
+	infos, _, err := m.filterQueriedEvents([]common.Address{token}, batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Receipt != nil || infos[0].TransactionInfo != tx {
+		t.Fatalf("unexpected events %+v", infos)
+	}
+	receipt := &sprint.ReceiptInfo{TransactionHash: tx.Hash, GasUsed: uint256.NewInt(21000)}
+	batch.Receipts = map[common.Hash]*sprint.ReceiptInfo{tx.Hash: receipt}
+	infos, _, err = m.filterQueriedEvents([]common.Address{token}, batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Receipt != receipt {
+		t.Fatalf("expected the receipt to be attached, got %+v", infos)
+	}
+	// a fetched batch missing the receipt of an event's transaction
+	batch.Receipts = map[common.Hash]*sprint.ReceiptInfo{}
+	if _, _, err := m.filterQueriedEvents([]common.Address{token}, batch); err == nil {
+		t.Fatal("expected a missing receipt to fail")
+	}
+}
+
+func TestMainLaneValidationKeepsBackfill(t *testing.T) {
+	ctx := context.Background()
+	swap, err := NewABIEvent([]byte(swapFragment), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfer, err := NewABIEvent([]byte(transferFragment), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, u := newSQLiteUploader(t, swap.Table(), transfer.Table())
+	m := NewManager(nil, u)
+	if err := m.AddEventFilter("pools", []common.Address{common.HexToAddress("0x01")}, swap); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddEventFilter("tokens", []common.Address{common.HexToAddress("0x02")}, transfer); err != nil {
+		t.Fatal(err)
+	}
+	// a group added with a start block, joining the main lane above the backfilled blocks
+	grp := m.eventGroups["tokens"]
+	grp.ActiveFrom, grp.Lane, grp.fromBlock = 20, "tokens", true
+	// the backfilled event of the group, and an event of the main lane reorged out since
+	if err := u.UploadEventSet(ctx, sess, []*EventInfo{testEventInfo(transfer, 5, 0), testEventInfo(swap, 6, 0)}); err != nil {
+		t.Fatal(err)
+	}
+	reorged, err := m.Validate(ctx, sess, 0, 9, &sprint.EventBatch{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reorged {
+		t.Fatal("expected the reorged main lane event to be detected")
+	}
+	count := func(table string) uint64 {
+		n, err := sess.Collection(table).Find().Count()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if n := count(swap.Table()); n != 0 {
+		t.Fatalf("expected the reorged event to be deleted, got %d rows", n)
+	}
+	if n := count(transfer.Table()); n != 1 {
+		t.Fatalf("expected the backfilled event to be kept, got %d rows", n)
+	}
+	// the range is now valid without touching the backfilled event
+	if reorged, err := m.Validate(ctx, sess, 0, 9, &sprint.EventBatch{}); err != nil || reorged {
+		t.Fatalf("expected the range to be valid, got %v %v", reorged, err)
+	}
+	if n := count(transfer.Table()); n != 1 {
+		t.Fatalf("expected the backfilled event to be kept, got %d rows", n)
+	}
+}
@@ -0,0 +1,477 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/tjudice/ethutil/sprint"
+	"github.com/upper/db/v4"
+)
+
+// AddressRegistry persists the addresses events add through FilterUpdater.AddAddress, such as the
+// contracts created by a factory. See Manager.SetAddressRegistry.
+type AddressRegistry interface {
+	// Returns every address in the registry
+	LoadAddresses(ctx context.Context) ([]*ActiveAddress, error)
+	// Adds addresses in the transaction of the range that discovered them. Addresses the group
+	// already discovered keep the earliest block they were discovered at, along with its entry
+	AddAddresses(ctx context.Context, tx db.Session, addrs []*ActiveAddress) error
+	// Removes the addresses a group discovered between startBlock and endBlock, in the transaction of
+	// the range whose events were deleted
+	RemoveAddresses(ctx context.Context, tx db.Session, group string, startBlock, endBlock int) error
+}
+
+// registryRemoval is a block range whose addresses were removed from a group's registry
+type registryRemoval struct {
+	group                string
+	startBlock, endBlock int
+}
+
+// registry changes made in the transaction of a batch, applied once it commits
+type registryChange struct {
+	removed []registryRemoval
+	added   []*ActiveAddress
+}
+
+// SetAddressRegistry persists addresses discovered by events in the given registry, and loads those
+// it already holds. It must be called before sprint starts.
+//
+// Discovered addresses are active from the block after their discovery, like addresses returned by
+// EventUploader.GetActiveAddresses, and are removed again when a reorg deletes the range that
+// discovered them. Groups that filter by address are queried for the addresses their events
+// discovered as well, so to fetch the events of a factory's children by address, add the children's
+// events to the factory's group. Ranges that were fetched before an address was discovered are
+// fetched again, see sprint.ErrStaleFilters.
+//
+// The registry replaces AddressRecorder: addresses discovered once it is set are only kept in the
+// registry, while those the uploader recorded before are still returned by GetActiveAddresses.
+func (m *Manager) SetAddressRegistry(ctx context.Context, reg AddressRegistry) error {
+	addrs, err := reg.LoadAddresses(ctx)
+	if err != nil {
+		return err
+	}
+	m.regMu.Lock()
+	defer m.regMu.Unlock()
+	m.registry = reg
+	m.discovered = make(map[string]map[common.Address]*ActiveAddress)
+	m.hints = make(map[string]map[common.Address]*ActiveAddress)
+	for _, a := range addrs {
+		addDiscovered(m.discovered, a)
+	}
+	return nil
+}
+
+// DiscoveredAddresses returns the addresses the events of a group discovered, ordered by block
+func (m *Manager) DiscoveredAddresses(group string) []*ActiveAddress {
+	m.regMu.RLock()
+	defer m.regMu.RUnlock()
+	out := make([]*ActiveAddress, 0, len(m.discovered[group]))
+	for _, a := range m.discovered[group] {
+		cp := *a
+		out = append(out, &cp)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Block != out[j].Block {
+			return out[i].Block < out[j].Block
+		}
+		return bytes.Compare(out[i].Address[:], out[j].Address[:]) < 0
+	})
+	return out
+}
+
+func addDiscovered(set map[string]map[common.Address]*ActiveAddress, a *ActiveAddress) {
+	addrs, ok := set[a.Group]
+	if !ok {
+		addrs = make(map[common.Address]*ActiveAddress)
+		set[a.Group] = addrs
+	}
+	if prev, ok := addrs[a.Address]; !ok || a.Block < prev.Block {
+		addrs[a.Address] = a
+	}
+}
+
+func (m *Manager) hasRegistry() bool {
+	m.regMu.RLock()
+	defer m.regMu.RUnlock()
+	return m.registry != nil
+}
+
+// Returns the registered addresses discovered before the given block, which events are accepted from
+func (m *Manager) registeredAddresses(block int) []common.Address {
+	m.regMu.RLock()
+	defer m.regMu.RUnlock()
+	var out []common.Address
+	for _, addrs := range m.discovered {
+		for _, a := range addrs {
+			if a.Block < block {
+				out = append(out, a.Address)
+			}
+		}
+	}
+	return out
+}
+
+// Remembers addresses discovered by a batch that has not committed yet, so the batch and ranges
+// fetched after it query them. Hints outlive failed transactions, which only widens later queries
+func (m *Manager) addHints(added []*ActiveAddress) {
+	if len(added) == 0 {
+		return
+	}
+	m.regMu.Lock()
+	defer m.regMu.Unlock()
+	for _, a := range added {
+		addDiscovered(m.hints, a)
+	}
+}
+
+// Returns the addresses a group is queried for in a range ending at endBlock: its own addresses and
+// those its events discovered up to the end of the range. Groups without addresses match any address
+func (m *Manager) groupAddresses(groupID string, grp *EventGroup, endBlock int) []common.Address {
+	if len(grp.Addresses) == 0 {
+		return nil
+	}
+	m.regMu.RLock()
+	defer m.regMu.RUnlock()
+	if len(m.discovered[groupID]) == 0 && len(m.hints[groupID]) == 0 {
+		return grp.Addresses
+	}
+	seen := make(map[common.Address]struct{}, len(grp.Addresses))
+	for _, a := range grp.Addresses {
+		seen[a] = struct{}{}
+	}
+	var extra []common.Address
+	for _, set := range []map[common.Address]*ActiveAddress{m.discovered[groupID], m.hints[groupID]} {
+		for addr, a := range set {
+			if _, ok := seen[addr]; ok || a.Block > endBlock {
+				continue
+			}
+			seen[addr] = struct{}{}
+			extra = append(extra, addr)
+		}
+	}
+	sort.Slice(extra, func(i, j int) bool {
+		return bytes.Compare(extra[i][:], extra[j][:]) < 0
+	})
+	return append(append([]common.Address(nil), grp.Addresses...), extra...)
+}
+
+// Returns sprint.ErrStaleFilters when a batch was queried with filters missing addresses that groups
+// filtering by address must be queried for: those discovered in committed ranges before the end of a
+// queried range, and those the batch itself discovered. Must be called with m.mu held
+func (m *Manager) checkFilters(filters []ethereum.FilterQuery, added []*ActiveAddress) error {
+	if len(filters) == 0 {
+		return nil
+	}
+	m.regMu.RLock()
+	defer m.regMu.RUnlock()
+	for groupID, grp := range m.eventGroups {
+		if len(grp.Addresses) == 0 || len(grp.EventHashes) == 0 {
+			continue
+		}
+		// addresses queried for the group in each queried block range
+		queried := make(map[[2]uint64]map[common.Address]struct{})
+		for _, f := range filters {
+			if !filterHasTopic(f, grp.EventHashes[0]) || f.FromBlock == nil || f.ToBlock == nil {
+				continue
+			}
+			rng := [2]uint64{f.FromBlock.Uint64(), f.ToBlock.Uint64()}
+			addrs, ok := queried[rng]
+			if !ok {
+				addrs = make(map[common.Address]struct{})
+				queried[rng] = addrs
+			}
+			for _, a := range f.Addresses {
+				addrs[a] = struct{}{}
+			}
+		}
+		for rng, addrs := range queried {
+			for addr, a := range m.discovered[groupID] {
+				if _, ok := addrs[addr]; !ok && uint64(a.Block) <= rng[1] {
+					return fmt.Errorf("group %s missing address %s: %w", groupID, addr.Hex(), sprint.ErrStaleFilters)
+				}
+			}
+			for _, a := range added {
+				if _, ok := addrs[a.Address]; !ok && a.Group == groupID && uint64(a.Block) <= rng[1] {
+					return fmt.Errorf("group %s missing address %s: %w", groupID, a.Address.Hex(), sprint.ErrStaleFilters)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func filterHasTopic(f ethereum.FilterQuery, topic common.Hash) bool {
+	if len(f.Topics) == 0 {
+		return false
+	}
+	for _, t := range f.Topics[0] {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the block ranges of each group whose discovered addresses a lane's range covers. Ranges of
+// the main lane only cover groups from the block they joined it. Must be called with m.mu held
+func (m *Manager) registryRemovals(lane string, startBlock, endBlock int) []registryRemoval {
+	if lane != "" {
+		return []registryRemoval{{group: lane, startBlock: startBlock, endBlock: endBlock}}
+	}
+	var out []registryRemoval
+	for groupID, grp := range m.eventGroups {
+		// groups with their own lane never join the main lane, their addresses are only removed by
+		// reorgs of their lane
+		if grp.ActiveFrom == sprint.NeverJoins || grp.ActiveFrom > uint64(endBlock) {
+			continue
+		}
+		start := startBlock
+		if grp.ActiveFrom > uint64(start) {
+			start = int(grp.ActiveFrom)
+		}
+		out = append(out, registryRemoval{group: groupID, startBlock: start, endBlock: endBlock})
+	}
+	return out
+}
+
+// Persists the registry changes of a batch in its transaction, applying them in memory once it commits
+func (m *Manager) updateRegistry(ctx context.Context, s db.Session, batch *sprint.EventBatch, removed []registryRemoval, added []*ActiveAddress) error {
+	m.regMu.RLock()
+	reg := m.registry
+	m.regMu.RUnlock()
+	if reg == nil || len(removed) == 0 && len(added) == 0 {
+		return nil
+	}
+	for _, r := range removed {
+		err := reg.RemoveAddresses(ctx, s, r.group, r.startBlock, r.endBlock)
+		if err != nil {
+			return err
+		}
+	}
+	if len(added) > 0 {
+		err := reg.AddAddresses(ctx, s, added)
+		if err != nil {
+			return err
+		}
+	}
+	m.regMu.Lock()
+	defer m.regMu.Unlock()
+	if m.pendingRegistry == nil {
+		m.pendingRegistry = make(map[*sprint.EventBatch]*registryChange)
+	}
+	m.pendingRegistry[batch] = &registryChange{removed: removed, added: added}
+	return nil
+}
+
+// Applies the registry changes of a batch once its transaction commits
+func (m *Manager) applyRegistryChange(batch *sprint.EventBatch, err error) {
+	m.regMu.Lock()
+	defer m.regMu.Unlock()
+	change, ok := m.pendingRegistry[batch]
+	delete(m.pendingRegistry, batch)
+	if !ok || err != nil {
+		return
+	}
+	for _, r := range change.removed {
+		for addr, a := range m.discovered[r.group] {
+			if a.Block >= r.startBlock && a.Block <= r.endBlock {
+				delete(m.discovered[r.group], addr)
+			}
+		}
+	}
+	for _, a := range change.added {
+		addDiscovered(m.discovered, a)
+		if hint, ok := m.hints[a.Group][a.Address]; ok && hint.Block >= a.Block {
+			delete(m.hints[a.Group], a.Address)
+		}
+	}
+}
+
+// memoryAddressRegistry keeps addresses in memory. Changes are not rolled back with the transaction
+// and addresses are lost when the process exits, so it is meant for tests and short lived indexers.
+type memoryAddressRegistry struct {
+	mu    sync.Mutex
+	addrs map[string]map[common.Address]*ActiveAddress
+}
+
+// NewMemoryAddressRegistry returns an AddressRegistry that keeps addresses in memory
+func NewMemoryAddressRegistry() AddressRegistry {
+	return &memoryAddressRegistry{addrs: make(map[string]map[common.Address]*ActiveAddress)}
+}
+
+func (r *memoryAddressRegistry) LoadAddresses(ctx context.Context) ([]*ActiveAddress, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var out []*ActiveAddress
+	for _, addrs := range r.addrs {
+		for _, a := range addrs {
+			cp := *a
+			out = append(out, &cp)
+		}
+	}
+	return out, nil
+}
+
+func (r *memoryAddressRegistry) AddAddresses(ctx context.Context, tx db.Session, addrs []*ActiveAddress) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, a := range addrs {
+		cp := *a
+		addDiscovered(r.addrs, &cp)
+	}
+	return nil
+}
+
+func (r *memoryAddressRegistry) RemoveAddresses(ctx context.Context, tx db.Session, group string, startBlock, endBlock int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for addr, a := range r.addrs[group] {
+		if a.Block >= startBlock && a.Block <= endBlock {
+			delete(r.addrs[group], addr)
+		}
+	}
+	return nil
+}
+
+// sqlAddressRegistry keeps addresses in an upper/db session:
+//
+//	CREATE TABLE <table> (
+//		group_id     TEXT NOT NULL,
+//		address      TEXT NOT NULL,
+//		block_number BIGINT NOT NULL,
+//		factory      TEXT NOT NULL,
+//		event_table  TEXT NOT NULL,
+//		PRIMARY KEY (group_id, address)
+//	);
+type sqlAddressRegistry struct {
+	sess    db.Session
+	table   string
+	dialect sprint.SQLDialect
+}
+
+type addressRegistryRow struct {
+	GroupID     string `db:"group_id"`
+	Address     string `db:"address"`
+	BlockNumber int    `db:"block_number"`
+	Factory     string `db:"factory"`
+	EventTable  string `db:"event_table"`
+}
+
+// NewPostgresAddressRegistry returns an AddressRegistry that keeps addresses in the given Postgres table
+func NewPostgresAddressRegistry(sess db.Session, table string) AddressRegistry {
+	return &sqlAddressRegistry{
+		sess:    sess,
+		table:   table,
+		dialect: sprint.DialectPostgres,
+	}
+}
+
+// NewSQLiteAddressRegistry returns an AddressRegistry that keeps addresses in the given SQLite table,
+// creating it if it does not exist
+func NewSQLiteAddressRegistry(ctx context.Context, sess db.Session, table string) (AddressRegistry, error) {
+	r := &sqlAddressRegistry{
+		sess:    sess,
+		table:   table,
+		dialect: sprint.DialectSQLite,
+	}
+	_, err := sess.SQL().ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+table+` (
+		group_id TEXT NOT NULL,
+		address TEXT NOT NULL,
+		block_number INTEGER NOT NULL,
+		factory TEXT NOT NULL,
+		event_table TEXT NOT NULL,
+		PRIMARY KEY (group_id, address)
+	)`)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// use the transaction of the caller when there is one
+func (r *sqlAddressRegistry) session(tx db.Session) db.Session {
+	if tx == nil {
+		return r.sess
+	}
+	return tx
+}
+
+func (r *sqlAddressRegistry) LoadAddresses(ctx context.Context) ([]*ActiveAddress, error) {
+	var rows []*addressRegistryRow
+	err := r.sess.SQL().SelectFrom(r.table).OrderBy("block_number").All(&rows)
+	if err != nil && !errors.Is(err, db.ErrNoMoreRows) {
+		return nil, err
+	}
+	out := make([]*ActiveAddress, len(rows))
+	for i, row := range rows {
+		out[i] = &ActiveAddress{
+			Address: common.HexToAddress(row.Address),
+			Block:   row.BlockNumber,
+			Table:   row.EventTable,
+			Factory: common.HexToAddress(row.Factory),
+			Group:   row.GroupID,
+		}
+	}
+	return out, nil
+}
+
+func (r *sqlAddressRegistry) AddAddresses(ctx context.Context, tx db.Session, addrs []*ActiveAddress) error {
+	least := "LEAST"
+	if r.dialect == sprint.DialectSQLite {
+		least = "MIN"
+	}
+	// addresses already discovered keep the entry of the earliest block, e.g. when a backfill
+	// discovers them again below the block they were first discovered at
+	existing := r.table
+	earlier := "EXCLUDED.block_number < " + existing + ".block_number"
+	b := r.session(tx).SQL().InsertInto(r.table).Amend(func(s string) string {
+		return s + " ON CONFLICT (group_id, address) DO UPDATE SET" +
+			" block_number = " + least + "(" + existing + ".block_number, EXCLUDED.block_number)," +
+			" factory = CASE WHEN " + earlier + " THEN EXCLUDED.factory ELSE " + existing + ".factory END," +
+			" event_table = CASE WHEN " + earlier + " THEN EXCLUDED.event_table ELSE " + existing + ".event_table END"
+	}).Batch(1000)
+	rows := earliestRegistryRows(addrs)
+	go func() {
+		defer b.Done()
+		for _, row := range rows {
+			b.Values(row)
+		}
+	}()
+	return b.Wait()
+}
+
+// Returns a row for each address of a group at the earliest block it was discovered at, since an
+// insert cannot update the same row twice
+func earliestRegistryRows(addrs []*ActiveAddress) []*addressRegistryRow {
+	set := make(map[string]map[common.Address]*ActiveAddress)
+	for _, a := range addrs {
+		addDiscovered(set, a)
+	}
+	rows := make([]*addressRegistryRow, 0, len(addrs))
+	for _, a := range addrs {
+		if set[a.Group][a.Address] != a {
+			continue
+		}
+		rows = append(rows, &addressRegistryRow{
+			GroupID:     a.Group,
+			Address:     a.Address.Hex(),
+			BlockNumber: a.Block,
+			Factory:     a.Factory.Hex(),
+			EventTable:  a.Table,
+		})
+	}
+	return rows
+}
+
+func (r *sqlAddressRegistry) RemoveAddresses(ctx context.Context, tx db.Session, group string, startBlock, endBlock int) error {
+	_, err := r.session(tx).SQL().DeleteFrom(r.table).
+		Where("group_id = ? AND block_number >= ? AND block_number <= ?", group, startBlock, endBlock).
+		ExecContext(ctx)
+	return err
+}
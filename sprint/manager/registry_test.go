@@ -0,0 +1,204 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/tjudice/ethutil/sprint"
+	"github.com/upper/db/v4/adapter/sqlite"
+)
+
+func TestMemoryAddressRegistry(t *testing.T) {
+	testAddressRegistry(t, NewMemoryAddressRegistry())
+}
+
+func TestSQLiteAddressRegistry(t *testing.T) {
+	ctx := context.Background()
+	sess, err := sqlite.Open(sqlite.ConnectionURL{Database: filepath.Join(t.TempDir(), "registry.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	reg, err := NewSQLiteAddressRegistry(ctx, sess, "discovered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testAddressRegistry(t, reg)
+}
+
+func testAddressRegistry(t *testing.T, reg AddressRegistry) {
+	ctx := context.Background()
+	child := common.HexToAddress("0x10")
+	late := common.HexToAddress("0x12")
+	err := reg.AddAddresses(ctx, nil, []*ActiveAddress{
+		{Address: child, Block: 5, Group: "pools"},
+		{Address: common.HexToAddress("0x11"), Block: 9, Group: "pools"},
+		{Address: late, Block: 12, Group: "pools", Table: "late"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the earliest discovery is kept, also when a backfill discovers an address again below it
+	err = reg.AddAddresses(ctx, nil, []*ActiveAddress{
+		{Address: child, Block: 7, Group: "pools"},
+		{Address: late, Block: 8, Group: "pools", Table: "pool_created"},
+		{Address: late, Block: 10, Group: "pools", Table: "late"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.RemoveAddresses(ctx, nil, "pools", 11, 12); err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := reg.LoadAddresses(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := make(map[common.Address]*ActiveAddress)
+	for _, a := range addrs {
+		blocks[a.Address] = a
+	}
+	if len(addrs) != 3 || blocks[child].Block != 5 || blocks[late].Block != 8 || blocks[late].Table != "pool_created" {
+		t.Fatalf("unexpected addresses %+v", addrs)
+	}
+	if err := reg.RemoveAddresses(ctx, nil, "pools", 8, 10); err != nil {
+		t.Fatal(err)
+	}
+	addrs, err = reg.LoadAddresses(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0].Address != child || addrs[0].Block != 5 {
+		t.Fatalf("unexpected addresses %+v", addrs)
+	}
+}
+
+func TestManagerDiscoveredAddresses(t *testing.T) {
+	ctx := context.Background()
+	ev, err := NewABIEvent([]byte(swapFragment), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	factory := common.HexToAddress("0x01")
+	child := common.HexToAddress("0x10")
+	m := NewManager(nil, nil)
+	if err := m.AddEventFilter("pools", []common.Address{factory}, ev); err != nil {
+		t.Fatal(err)
+	}
+	reg := NewMemoryAddressRegistry()
+	if err := m.SetAddressRegistry(ctx, reg); err != nil {
+		t.Fatal(err)
+	}
+	if fqs := m.GetStageFilters(1, 20); len(fqs) != 1 || len(fqs[0].Addresses) != 1 {
+		t.Fatalf("unexpected filters %+v", fqs)
+	}
+	// a batch discovering the child commits
+	batch := &sprint.EventBatch{}
+	added := []*ActiveAddress{{Address: child, Block: 10, Factory: factory, Group: "pools"}}
+	m.addHints(added)
+	if err := m.updateRegistry(ctx, nil, batch, nil, added); err != nil {
+		t.Fatal(err)
+	}
+	m.AfterCommit(ctx, batch, nil)
+	if got := m.DiscoveredAddresses("pools"); len(got) != 1 || got[0].Address != child {
+		t.Fatalf("unexpected discovered addresses %+v", got)
+	}
+	if fqs := m.GetStageFilters(1, 9); len(fqs[0].Addresses) != 1 {
+		t.Fatalf("range before discovery queried for %v", fqs[0].Addresses)
+	}
+	fqs := m.GetStageFilters(11, 20)
+	if len(fqs[0].Addresses) != 2 || fqs[0].Addresses[1] != child {
+		t.Fatalf("range after discovery queried for %v", fqs[0].Addresses)
+	}
+	// ranges queried with or without the child, split in two
+	withoutChild := fqs[0]
+	withoutChild.Addresses = []common.Address{factory}
+	fresh := []ethereum.FilterQuery{withoutChild, fqs[0]}
+	stale := []ethereum.FilterQuery{withoutChild}
+	if err := m.checkFilters(fresh, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.checkFilters(stale, nil); !errors.Is(err, sprint.ErrStaleFilters) {
+		t.Fatalf("expected stale filters, got %v", err)
+	}
+	// a reorg removes the range that discovered the child
+	batch = &sprint.EventBatch{}
+	if err := m.updateRegistry(ctx, nil, batch, m.registryRemovals("", 10, 12), nil); err != nil {
+		t.Fatal(err)
+	}
+	m.AfterCommit(ctx, batch, nil)
+	if got := m.DiscoveredAddresses("pools"); len(got) != 0 {
+		t.Fatalf("expected reorged address to be removed, got %+v", got)
+	}
+	if addrs, _ := reg.LoadAddresses(ctx); len(addrs) != 0 {
+		t.Fatalf("expected reorged address to be removed from the registry, got %+v", addrs)
+	}
+}
+
+func TestMainLaneReorgKeepsLaneAddresses(t *testing.T) {
+	ctx := context.Background()
+	swap, err := NewABIEvent([]byte(swapFragment), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfer, err := NewABIEvent([]byte(transferFragment), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	factory := common.HexToAddress("0x01")
+	m := NewManager(nil, nil)
+	if err := m.AddEventFilter("pools", []common.Address{factory}, swap); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddEventFilter("tokens", []common.Address{factory}, transfer); err != nil {
+		t.Fatal(err)
+	}
+	// a group following the head in its own lane, see sprint.SprintConfig.LanePerGroup
+	lane := m.eventGroups["tokens"]
+	lane.ActiveFrom, lane.Lane, lane.fromBlock = sprint.NeverJoins, "tokens", true
+	reg := NewMemoryAddressRegistry()
+	err = reg.AddAddresses(ctx, nil, []*ActiveAddress{
+		{Address: common.HexToAddress("0x10"), Block: 10, Group: "pools"},
+		{Address: common.HexToAddress("0x11"), Block: 10, Group: "tokens"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetAddressRegistry(ctx, reg); err != nil {
+		t.Fatal(err)
+	}
+	batch := &sprint.EventBatch{}
+	if err := m.updateRegistry(ctx, nil, batch, m.registryRemovals("", 5, 15), nil); err != nil {
+		t.Fatal(err)
+	}
+	m.AfterCommit(ctx, batch, nil)
+	if got := m.DiscoveredAddresses("pools"); len(got) != 0 {
+		t.Fatalf("expected main lane addresses to be removed, got %+v", got)
+	}
+	if got := m.DiscoveredAddresses("tokens"); len(got) != 1 {
+		t.Fatalf("expected lane addresses to be kept, got %+v", got)
+	}
+	if addrs, _ := reg.LoadAddresses(ctx); len(addrs) != 1 || addrs[0].Group != "tokens" {
+		t.Fatalf("expected lane addresses to be kept in the registry, got %+v", addrs)
+	}
+}
+
+func TestBackfillDiscoveryRejected(t *testing.T) {
+	// a factory creating a child in a range of the history lane
+	f := newFilterTracker([]common.Address{common.HexToAddress("0x01")})
+	f.block, f.group = 5, "pools"
+	f.AddAddress(common.HexToAddress("0x10"))
+	if err := checkBackfillDiscovery(true, f.added); !errors.Is(err, ErrBackfillDiscovery) {
+		t.Fatalf("expected backfill discovery to be rejected, got %v", err)
+	}
+	if err := checkBackfillDiscovery(false, f.added); err != nil {
+		t.Fatalf("expected main lane discovery to be accepted, got %v", err)
+	}
+	if err := checkBackfillDiscovery(true, nil); err != nil {
+		t.Fatalf("expected backfill without discovery to be accepted, got %v", err)
+	}
+}
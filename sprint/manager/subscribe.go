@@ -0,0 +1,185 @@
+package manager
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/tjudice/ethutil/sprint"
+	"github.com/upper/db/v4"
+)
+
+// EventRangeLoader is implemented by uploaders that can load the events they stored for a range.
+// Revert notifications only name the removed events when the uploader implements it.
+type EventRangeLoader interface {
+	// Returns the stored events of the given tables between startBlock and endBlock. tables is nil
+	// for every table
+	LoadEventRange(ctx context.Context, d db.Session, tables []string, startBlock, endBlock int) ([]*EventInfo, error)
+}
+
+// Notification describes events of a range that were committed to the database
+type Notification struct {
+	// Lane of the range, empty for the main lane, see sprint.StageProgressLog.Lane
+	Lane       string
+	StartBlock int
+	EndBlock   int
+	// Set when a reorg was detected while validating the range. Events then holds the events
+	// added by the new chain, and Removed the events that are no longer on the chain
+	Revert bool
+	// Events in block and log order
+	Events []*EventInfo
+	// Events removed by a reorg. Only known when the uploader implements EventRangeLoader, otherwise
+	// every event between StartBlock and EndBlock should be considered replaced by Events
+	Removed []*EventInfo
+}
+
+// Subscription receives notifications of committed events, see Manager.Subscribe
+type Subscription struct {
+	m    *Manager
+	c    chan *Notification
+	done chan struct{}
+	once sync.Once
+}
+
+// C returns the channel notifications are delivered on
+func (s *Subscription) C() <-chan *Notification {
+	return s.c
+}
+
+// Unsubscribe stops delivering notifications. The channel is not closed, so consumers should also
+// stop receiving on their own
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(func() {
+		close(s.done)
+		s.m.subMu.Lock()
+		defer s.m.subMu.Unlock()
+		for i, sub := range s.m.subs {
+			if sub == s {
+				s.m.subs = append(s.m.subs[:i], s.m.subs[i+1:]...)
+				break
+			}
+		}
+	})
+}
+
+// Subscribe delivers a notification for every range whose events are inserted, and for every reorg
+// detected while validating a range, once their transaction commits. Notifications of a lane arrive
+// in block order.
+//
+// Notifications are delivered before sprint moves on to the next range, so a subscriber that does
+// not keep up with its buffer holds up sprint.
+func (m *Manager) Subscribe(buffer int) *Subscription {
+	s := &Subscription{
+		m:    m,
+		c:    make(chan *Notification, buffer),
+		done: make(chan struct{}),
+	}
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+	m.subs = append(m.subs, s)
+	return s
+}
+
+func (m *Manager) hasSubscribers() bool {
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+	return len(m.subs) > 0
+}
+
+// Holds a notification until the transaction of its batch commits
+func (m *Manager) stageNotification(batch *sprint.EventBatch, n *Notification) {
+	sortEvents(n.Events)
+	sortEvents(n.Removed)
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+	if m.pending == nil {
+		m.pending = make(map[*sprint.EventBatch]*Notification)
+	}
+	m.pending[batch] = n
+}
+
+// AfterCommit applies the address registry changes and delivers the notification of a batch once its
+// transaction commits, see sprint.CommitHook
+func (m *Manager) AfterCommit(ctx context.Context, batch *sprint.EventBatch, err error) {
+	// ranges fetched after the batch commits are queried for the addresses it discovered
+	m.applyRegistryChange(batch, err)
+	m.subMu.Lock()
+	n, ok := m.pending[batch]
+	delete(m.pending, batch)
+	subs := append([]*Subscription(nil), m.subs...)
+	m.subMu.Unlock()
+	// rolled back notifications are staged again when the batch is retried
+	if !ok || err != nil {
+		return
+	}
+	// deliver one notification at a time, so inserts and reverts reach every subscriber in the same order
+	m.deliverMu.Lock()
+	defer m.deliverMu.Unlock()
+	for _, sub := range subs {
+		select {
+		case sub.c <- n:
+		case <-sub.done:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Builds the revert notification of a range whose events were replaced, naming only the events
+// that changed
+func revertNotification(lane string, startBlock, endBlock int, removed, added []*EventInfo) *Notification {
+	oldKeys := make(map[eventKey]struct{}, len(removed))
+	for _, e := range removed {
+		oldKeys[keyOf(e)] = struct{}{}
+	}
+	newKeys := make(map[eventKey]struct{}, len(added))
+	for _, e := range added {
+		newKeys[keyOf(e)] = struct{}{}
+	}
+	n := &Notification{
+		Lane:       lane,
+		StartBlock: startBlock,
+		EndBlock:   endBlock,
+		Revert:     true,
+	}
+	for _, e := range removed {
+		if _, ok := newKeys[keyOf(e)]; !ok {
+			n.Removed = append(n.Removed, e)
+		}
+	}
+	for _, e := range added {
+		if _, ok := oldKeys[keyOf(e)]; !ok {
+			n.Events = append(n.Events, e)
+		}
+	}
+	return n
+}
+
+type eventKey struct {
+	block    int
+	tx       common.Hash
+	logIndex int
+	event    common.Hash
+}
+
+func keyOf(e *EventInfo) eventKey {
+	k := eventKey{
+		block:    e.Block,
+		logIndex: e.EventLog.GetLogIndex(),
+		event:    e.EventLog.EventHash(),
+	}
+	if e.TransactionInfo != nil {
+		k.tx = e.TransactionInfo.Hash
+	}
+	return k
+}
+
+func sortEvents(events []*EventInfo) {
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].Block != events[j].Block {
+			return events[i].Block < events[j].Block
+		}
+		return events[i].EventLog.GetLogIndex() < events[j].EventLog.GetLogIndex()
+	})
+}
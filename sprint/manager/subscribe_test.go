@@ -0,0 +1,109 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/tjudice/ethutil/sprint"
+)
+
+func TestRevertNotification(t *testing.T) {
+	ev, err := NewABIEvent([]byte(transferFragment), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := func(block, logIndex int, tx byte) *EventInfo {
+		e := ev.Copy().(*ABIEvent)
+		e.LogIndex = logIndex
+		return &EventInfo{EventLog: e, Block: block, TransactionInfo: &sprint.TransactionInfo{Hash: common.Hash{tx}}}
+	}
+	kept := event(10, 0, 1)
+	dropped := event(10, 1, 1)
+	// the same log position in another transaction is another event
+	moved := event(11, 0, 2)
+	added := event(11, 0, 3)
+	n := revertNotification("", 10, 12, []*EventInfo{kept, dropped, moved}, []*EventInfo{event(10, 0, 1), added})
+	if !n.Revert || n.StartBlock != 10 || n.EndBlock != 12 {
+		t.Fatalf("unexpected notification %+v", n)
+	}
+	if len(n.Removed) != 2 || n.Removed[0] != dropped || n.Removed[1] != moved {
+		t.Fatalf("expected only changed events to be removed, got %+v", n.Removed)
+	}
+	if len(n.Events) != 1 || n.Events[0] != added {
+		t.Fatalf("expected only changed events to be added, got %+v", n.Events)
+	}
+}
+
+func TestSubscriptionAfterCommit(t *testing.T) {
+	ctx := context.Background()
+	m := NewManager(nil, nil)
+	sub := m.Subscribe(4)
+	gone := m.Subscribe(0)
+	gone.Unsubscribe()
+	first, second := &sprint.EventBatch{}, &sprint.EventBatch{}
+	n1 := &Notification{StartBlock: 1, EndBlock: 9}
+	n2 := &Notification{StartBlock: 10, EndBlock: 19}
+	m.stageNotification(first, n1)
+	// a rolled back attempt delivers nothing
+	m.AfterCommit(ctx, first, errors.New("rolled back"))
+	select {
+	case n := <-sub.C():
+		t.Fatalf("rolled back notification delivered %+v", n)
+	default:
+	}
+	// the retry stages the notification again, and commits are delivered in commit order
+	m.stageNotification(first, n1)
+	m.stageNotification(second, n2)
+	m.AfterCommit(ctx, first, nil)
+	m.AfterCommit(ctx, second, nil)
+	for _, want := range []*Notification{n1, n2} {
+		select {
+		case n := <-sub.C():
+			if n != want {
+				t.Fatalf("expected range %d, got %d", want.StartBlock, n.StartBlock)
+			}
+		default:
+			t.Fatalf("expected range %d to be delivered", want.StartBlock)
+		}
+	}
+	// a committed batch is only delivered once
+	m.AfterCommit(ctx, second, nil)
+	select {
+	case n := <-sub.C():
+		t.Fatalf("notification delivered twice %+v", n)
+	default:
+	}
+}
+
+func TestRevertNotificationLoadsRemoved(t *testing.T) {
+	ctx := context.Background()
+	ev, err := NewABIEvent([]byte(transferFragment), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, u := newSQLiteUploader(t, ev.Table())
+	m := NewManager(nil, u)
+	if err := m.AddEventFilter("tokens", []common.Address{common.HexToAddress("0x01")}, ev); err != nil {
+		t.Fatal(err)
+	}
+	stored := testEventInfo(ev, 5, 2)
+	if err := u.UploadEventSet(ctx, sess, []*EventInfo{stored}); err != nil {
+		t.Fatal(err)
+	}
+	sub := m.Subscribe(1)
+	// the stored event was reorged out of the range
+	batch := &sprint.EventBatch{}
+	if reorged, err := m.Validate(ctx, sess, 0, 9, batch); err != nil || !reorged {
+		t.Fatalf("expected a reorg, got %v %v", reorged, err)
+	}
+	m.AfterCommit(ctx, batch, nil)
+	n := <-sub.C()
+	if !n.Revert || len(n.Removed) != 1 || len(n.Events) != 0 {
+		t.Fatalf("unexpected notification %+v", n)
+	}
+	if keyOf(n.Removed[0]) != keyOf(stored) || n.Removed[0].EventLog.Table() != ev.Table() {
+		t.Fatalf("expected the stored event to be removed, got %+v", n.Removed[0])
+	}
+}
@@ -0,0 +1,396 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"gfx.cafe/open/ghost"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/tjudice/ethutil/sprint"
+	"github.com/upper/db/v4"
+)
+
+const defaultAddressTable = "active_addresses"
+
+type PostgresUploaderConfig struct {
+	// Tables of every event uploaded. Ranges of the main lane are validated and deleted across all of them,
+	// unless event groups were added with a start block, see LaneEventUploader
+	Tables []string
+	// Table addresses added by events are kept in. Defaults to "active_addresses"
+	AddressTable string
+}
+
+// PostgresEventUploader is an EventUploader keeping each event in a row of its Table, keyed on block,
+// transaction hash and log index. Events are stored as JSON along with their transaction, so any Event
+// can be uploaded. Addresses added by events are kept in the address table with the block they were
+// added at, and are deleted along with the events of their range.
+//
+// The tables can be created with CreateTables:
+//
+//	CREATE TABLE <table> (
+//		block_number BIGINT NOT NULL,
+//		tx_hash      TEXT NOT NULL,
+//		log_index    INTEGER NOT NULL,
+//		event_hash   TEXT NOT NULL,
+//		timestamp    BIGINT NOT NULL,
+//		tx_from      TEXT NOT NULL,
+//		tx_to        TEXT,
+//		data         JSONB NOT NULL,
+//		PRIMARY KEY (block_number, tx_hash, log_index)
+//	);
+//
+//	CREATE TABLE <address_table> (
+//		address      TEXT PRIMARY KEY,
+//		block_number BIGINT NOT NULL,
+//		event_table  TEXT NOT NULL
+//	);
+type PostgresEventUploader struct {
+	c      PostgresUploaderConfig
+	tables map[string]struct{}
+}
+
+var (
+	_ EventUploader     = (*PostgresEventUploader)(nil)
+	_ LaneEventUploader = (*PostgresEventUploader)(nil)
+	_ AddressRecorder   = (*PostgresEventUploader)(nil)
+	_ EventRangeLoader  = (*PostgresEventUploader)(nil)
+)
+
+type postgresEventRow struct {
+	BlockNumber int     `db:"block_number"`
+	TxHash      string  `db:"tx_hash"`
+	LogIndex    int     `db:"log_index"`
+	EventHash   string  `db:"event_hash"`
+	Timestamp   uint64  `db:"timestamp"`
+	TxFrom      string  `db:"tx_from"`
+	TxTo        *string `db:"tx_to"`
+	Data        string  `db:"data"`
+}
+
+// postgresEventKey identifies a stored event, ranges are valid when their keys match in order
+type postgresEventKey struct {
+	BlockNumber int    `db:"block_number"`
+	TxHash      string `db:"tx_hash"`
+	LogIndex    int    `db:"log_index"`
+	EventHash   string `db:"event_hash"`
+}
+
+type postgresAddressRow struct {
+	Address     string `db:"address"`
+	BlockNumber int    `db:"block_number"`
+	EventTable  string `db:"event_table"`
+}
+
+func NewPostgresEventUploader(config PostgresUploaderConfig) *PostgresEventUploader {
+	if config.AddressTable == "" {
+		config.AddressTable = defaultAddressTable
+	}
+	u := &PostgresEventUploader{
+		c:      config,
+		tables: make(map[string]struct{}, len(config.Tables)),
+	}
+	for _, t := range config.Tables {
+		u.tables[t] = struct{}{}
+	}
+	return u
+}
+
+// CreateTables creates the event and address tables if they do not exist
+func (u *PostgresEventUploader) CreateTables(ctx context.Context, sess db.Session) error {
+	for _, table := range u.c.Tables {
+		_, err := sess.SQL().ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+table+` (
+			block_number BIGINT NOT NULL,
+			tx_hash TEXT NOT NULL,
+			log_index INTEGER NOT NULL,
+			event_hash TEXT NOT NULL,
+			timestamp BIGINT NOT NULL,
+			tx_from TEXT NOT NULL,
+			tx_to TEXT,
+			data JSONB NOT NULL,
+			PRIMARY KEY (block_number, tx_hash, log_index)
+		)`)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := sess.SQL().ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+u.c.AddressTable+` (
+		address TEXT PRIMARY KEY,
+		block_number BIGINT NOT NULL,
+		event_table TEXT NOT NULL
+	)`)
+	return err
+}
+
+// GetActiveAddresses returns the addresses added by events before the given block. Addresses added
+// within a range are picked up by the manager as the range's events are processed
+func (u *PostgresEventUploader) GetActiveAddresses(ctx context.Context, d db.Session, block int) ([]common.Address, error) {
+	var rows []*postgresAddressRow
+	err := d.SQL().SelectFrom(u.c.AddressTable).Where("block_number < ?", block).All(&rows)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]common.Address, len(rows))
+	for i, row := range rows {
+		addrs[i] = common.HexToAddress(row.Address)
+	}
+	return addrs, nil
+}
+
+// RecordAddresses keeps the addresses added by events, see AddressRecorder. Addresses keep the earliest
+// block they were added at, also when a range below an already recorded address is backfilled later
+func (u *PostgresEventUploader) RecordAddresses(ctx context.Context, d db.Session, addrs []*ActiveAddress) error {
+	existing := u.c.AddressTable
+	b := d.SQL().InsertInto(u.c.AddressTable).Amend(func(s string) string {
+		return s + " ON CONFLICT (address) DO UPDATE SET block_number = LEAST(" + existing + ".block_number, EXCLUDED.block_number)," +
+			" event_table = CASE WHEN EXCLUDED.block_number < " + existing + ".block_number THEN EXCLUDED.event_table ELSE " + existing + ".event_table END"
+	}).Batch(1000)
+	rows := earliestAddresses(addrs)
+	go func() {
+		defer b.Done()
+		for _, row := range rows {
+			b.Values(row)
+		}
+	}()
+	return b.Wait()
+}
+
+// Returns a row for each address at the earliest block it was added at, since an insert cannot update
+// the same row twice
+func earliestAddresses(addrs []*ActiveAddress) []*postgresAddressRow {
+	byAddress := make(map[common.Address]*postgresAddressRow, len(addrs))
+	rows := make([]*postgresAddressRow, 0, len(addrs))
+	for _, a := range addrs {
+		if row, ok := byAddress[a.Address]; ok {
+			if a.Block < row.BlockNumber {
+				row.BlockNumber, row.EventTable = a.Block, a.Table
+			}
+			continue
+		}
+		row := &postgresAddressRow{
+			Address:     a.Address.Hex(),
+			BlockNumber: a.Block,
+			EventTable:  a.Table,
+		}
+		byAddress[a.Address] = row
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func (u *PostgresEventUploader) UploadEventSet(ctx context.Context, d db.Session, eventInfo []*EventInfo) error {
+	rows := make(map[string][]*postgresEventRow)
+	for _, e := range eventInfo {
+		table := e.EventLog.Table()
+		// events of other tables would never be validated or deleted
+		if _, ok := u.tables[table]; !ok {
+			return fmt.Errorf("event table %s is not one of the uploader's tables", table)
+		}
+		row, err := newPostgresEventRow(e)
+		if err != nil {
+			return err
+		}
+		rows[table] = append(rows[table], row)
+	}
+	for table, tableRows := range rows {
+		b := d.SQL().InsertInto(table).Batch(1000)
+		go func(tableRows []*postgresEventRow) {
+			defer b.Done()
+			for _, row := range tableRows {
+				b.Values(row)
+			}
+		}(tableRows)
+		err := b.Wait()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *PostgresEventUploader) ValidateEventSet(ctx context.Context, d db.Session, startBlock, endBlock int, eventInfo []*EventInfo) (bool, error) {
+	return u.ValidateTableEventSet(ctx, d, u.c.Tables, startBlock, endBlock, eventInfo)
+}
+
+// ValidateTableEventSet compares the events stored in each table for the range against the given
+// events, ordered by block and log index. Only the keys and event hashes of the events are compared
+func (u *PostgresEventUploader) ValidateTableEventSet(ctx context.Context, d db.Session, tables []string, startBlock, endBlock int, eventInfo []*EventInfo) (bool, error) {
+	want := make(map[string][]postgresEventKey, len(tables))
+	for _, e := range eventInfo {
+		if e.TransactionInfo == nil {
+			return false, fmt.Errorf("event at block %d has no transaction", e.Block)
+		}
+		table := e.EventLog.Table()
+		want[table] = append(want[table], postgresEventKey{
+			BlockNumber: e.Block,
+			TxHash:      e.TransactionInfo.Hash.Hex(),
+			LogIndex:    e.EventLog.GetLogIndex(),
+			EventHash:   e.EventLog.EventHash().Hex(),
+		})
+	}
+	for _, table := range tables {
+		var stored []postgresEventKey
+		err := d.SQL().Select("block_number", "tx_hash", "log_index", "event_hash").From(table).
+			Where("block_number >= ? AND block_number <= ?", startBlock, endBlock).
+			OrderBy("block_number", "log_index").All(&stored)
+		if err != nil {
+			return false, err
+		}
+		if !equalEventKeys(want[table], stored) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (u *PostgresEventUploader) DeleteEventRange(ctx context.Context, d db.Session, startBlock, endBlock int) error {
+	return u.DeleteTableEventRange(ctx, d, u.c.Tables, startBlock, endBlock)
+}
+
+// DeleteTableEventRange deletes the events of the tables in the range, along with the addresses
+// their events added
+func (u *PostgresEventUploader) DeleteTableEventRange(ctx context.Context, d db.Session, tables []string, startBlock, endBlock int) error {
+	if len(tables) == 0 {
+		return nil
+	}
+	for _, table := range tables {
+		_, err := d.SQL().DeleteFrom(table).Where("block_number >= ? AND block_number <= ?", startBlock, endBlock).ExecContext(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := d.SQL().DeleteFrom(u.c.AddressTable).Where(db.Cond{
+		"block_number >=": startBlock,
+		"block_number <=": endBlock,
+		"event_table IN":  tables,
+	}).ExecContext(ctx)
+	return err
+}
+
+// LoadEventRange returns the events stored in the tables between startBlock and endBlock, see
+// EventRangeLoader. The events are loaded as StoredEvent, since the uploader does not know their types
+func (u *PostgresEventUploader) LoadEventRange(ctx context.Context, d db.Session, tables []string, startBlock, endBlock int) ([]*EventInfo, error) {
+	if tables == nil {
+		tables = u.c.Tables
+	}
+	var out []*EventInfo
+	for _, table := range tables {
+		var rows []*postgresEventRow
+		err := d.SQL().SelectFrom(table).Where("block_number >= ? AND block_number <= ?", startBlock, endBlock).
+			OrderBy("block_number", "log_index").All(&rows)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			out = append(out, row.eventInfo(table))
+		}
+	}
+	return out, nil
+}
+
+// StoredEvent is an event loaded from the table it was uploaded to, holding the JSON it was stored as
+type StoredEvent struct {
+	table     string
+	eventHash common.Hash
+	logIndex  int
+	// JSON encoding of the event as it was uploaded
+	Data json.RawMessage
+}
+
+var _ Event = (*StoredEvent)(nil)
+
+func (e *StoredEvent) Copy() Event {
+	return &StoredEvent{table: e.table, eventHash: e.eventHash, logIndex: e.logIndex}
+}
+
+// Process rejects every log, stored events are only read back from their table
+func (e *StoredEvent) Process(l FilterUpdater, raw *ghost.ErigonLog) (bool, error) {
+	return false, nil
+}
+
+func (e *StoredEvent) Table() string {
+	return e.table
+}
+
+func (e *StoredEvent) EventHash() common.Hash {
+	return e.eventHash
+}
+
+func (e *StoredEvent) GetLogIndex() int {
+	return e.logIndex
+}
+
+// MarshalJSON returns the JSON the event was stored as
+func (e *StoredEvent) MarshalJSON() ([]byte, error) {
+	if e.Data == nil {
+		return []byte("null"), nil
+	}
+	return e.Data, nil
+}
+
+func (row *postgresEventRow) eventInfo(table string) *EventInfo {
+	tx := &sprint.TransactionInfo{
+		Hash: common.HexToHash(row.TxHash),
+		From: common.HexToAddress(row.TxFrom),
+	}
+	if row.TxTo != nil {
+		to := common.HexToAddress(*row.TxTo)
+		tx.To = &to
+	}
+	return &EventInfo{
+		EventLog: &StoredEvent{
+			table:     table,
+			eventHash: common.HexToHash(row.EventHash),
+			logIndex:  row.LogIndex,
+			Data:      json.RawMessage(row.Data),
+		},
+		TransactionInfo: tx,
+		Block:           row.BlockNumber,
+		Timestamp:       row.Timestamp,
+	}
+}
+
+func newPostgresEventRow(e *EventInfo) (*postgresEventRow, error) {
+	tx := e.TransactionInfo
+	if tx == nil {
+		return nil, fmt.Errorf("event at block %d has no transaction", e.Block)
+	}
+	data, err := json.Marshal(e.EventLog)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding %s event: %w", e.EventLog.Table(), err)
+	}
+	row := &postgresEventRow{
+		BlockNumber: e.Block,
+		TxHash:      tx.Hash.Hex(),
+		LogIndex:    e.EventLog.GetLogIndex(),
+		EventHash:   e.EventLog.EventHash().Hex(),
+		Timestamp:   e.Timestamp,
+		TxFrom:      tx.From.Hex(),
+		Data:        string(data),
+	}
+	if tx.To != nil {
+		to := tx.To.Hex()
+		row.TxTo = &to
+	}
+	return row, nil
+}
+
+// Compares the keys of the events to those stored, which are ordered by block and log index
+func equalEventKeys(events, stored []postgresEventKey) bool {
+	if len(events) != len(stored) {
+		return false
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].BlockNumber != events[j].BlockNumber {
+			return events[i].BlockNumber < events[j].BlockNumber
+		}
+		return events[i].LogIndex < events[j].LogIndex
+	})
+	for i := range events {
+		if events[i] != stored[i] {
+			return false
+		}
+	}
+	return true
+}
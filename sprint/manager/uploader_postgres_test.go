@@ -0,0 +1,84 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/tjudice/ethutil/sprint"
+)
+
+func TestPostgresEventRow(t *testing.T) {
+	ev, err := NewABIEvent([]byte(swapFragment), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev.LogIndex = 4
+	to := common.HexToAddress("0x02")
+	info := &EventInfo{
+		EventLog:        ev,
+		TransactionInfo: &sprint.TransactionInfo{Hash: common.HexToHash("0xaa"), From: common.HexToAddress("0x01"), To: &to},
+		Block:           12,
+		Timestamp:       100,
+	}
+	row, err := newPostgresEventRow(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row.BlockNumber != 12 || row.LogIndex != 4 || row.TxHash != common.HexToHash("0xaa").Hex() || row.Timestamp != 100 {
+		t.Fatalf("unexpected row %+v", row)
+	}
+	if row.TxTo == nil || *row.TxTo != to.Hex() || row.EventHash != ev.EventHash().Hex() {
+		t.Fatalf("unexpected row %+v", row)
+	}
+	info.TransactionInfo = nil
+	if _, err := newPostgresEventRow(info); err == nil {
+		t.Fatal("expected error for event without transaction")
+	}
+}
+
+func TestEqualEventKeys(t *testing.T) {
+	key := func(block, index int) postgresEventKey {
+		return postgresEventKey{BlockNumber: block, LogIndex: index, TxHash: "0x01"}
+	}
+	stored := []postgresEventKey{key(1, 0), key(1, 3), key(2, 1)}
+	if !equalEventKeys([]postgresEventKey{key(2, 1), key(1, 3), key(1, 0)}, stored) {
+		t.Fatal("expected keys to match in any order")
+	}
+	if equalEventKeys([]postgresEventKey{key(1, 0), key(1, 3)}, stored) {
+		t.Fatal("expected missing event to mismatch")
+	}
+	if equalEventKeys([]postgresEventKey{key(1, 0), key(1, 3), key(2, 2)}, stored) {
+		t.Fatal("expected moved event to mismatch")
+	}
+}
+
+func TestFilterTrackerRecordsAddresses(t *testing.T) {
+	existing := common.HexToAddress("0x01")
+	f := newFilterTracker([]common.Address{existing})
+	f.block, f.table = 7, "pool_created"
+	f.AddAddress(existing)
+	f.AddAddress(common.HexToAddress("0x02"))
+	f.block = 8
+	f.AddAddress(common.HexToAddress("0x02"))
+	if len(f.added) != 1 {
+		t.Fatalf("expected one added address, got %d", len(f.added))
+	}
+	if a := f.added[0]; a.Address != common.HexToAddress("0x02") || a.Block != 7 || a.Table != "pool_created" {
+		t.Fatalf("unexpected added address %+v", a)
+	}
+}
+
+func TestEarliestAddresses(t *testing.T) {
+	child := common.HexToAddress("0x02")
+	rows := earliestAddresses([]*ActiveAddress{
+		{Address: child, Block: 9, Table: "late"},
+		{Address: common.HexToAddress("0x03"), Block: 4, Table: "pool_created"},
+		{Address: child, Block: 5, Table: "pool_created"},
+	})
+	if len(rows) != 2 {
+		t.Fatalf("expected one row per address, got %d", len(rows))
+	}
+	if r := rows[0]; r.Address != child.Hex() || r.BlockNumber != 5 || r.EventTable != "pool_created" {
+		t.Fatalf("expected the earliest block to be kept, got %+v", r)
+	}
+}
@@ -0,0 +1,199 @@
+package sprint
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics exposes sprint scheduling, execution and validation metrics as a prometheus.Collector.
+// Set it on SprintConfig.Metrics and register it with a prometheus registry. A Metrics should only
+// be attached to a single sprint. A nil *Metrics records nothing.
+type Metrics struct {
+	s *Sprint
+
+	chainHead      prometheus.Gauge
+	sprintHead     prometheus.Gauge
+	finalizedBlock prometheus.Gauge
+	stageSize      prometheus.Gauge
+	validatorHead  *prometheus.GaugeVec
+	laneHead       *prometheus.GaugeVec
+	queueDepth     *prometheus.GaugeVec
+
+	fetchDuration  *prometheus.HistogramVec
+	uploadDuration *prometheus.HistogramVec
+	eventsPerStage prometheus.Histogram
+	reorgsDetected prometheus.Counter
+	rangeSplits    prometheus.Counter
+	rpcErrors      *prometheus.CounterVec
+	retries        *prometheus.CounterVec
+	failedRanges   *prometheus.CounterVec
+	rateLimited    prometheus.Counter
+	// block cache counters are read from the cache statistics at scrape time
+	blockCache *prometheus.Desc
+	collectors []prometheus.Collector
+}
+
+// NewMetrics creates sprint metrics with the given namespace, e.g. the name of the indexer
+func NewMetrics(namespace string) *Metrics {
+	opts := func(name, help string) prometheus.Opts {
+		return prometheus.Opts{Namespace: namespace, Subsystem: "sprint", Name: name, Help: help}
+	}
+	m := &Metrics{
+		chainHead:      prometheus.NewGauge(prometheus.GaugeOpts(opts("chain_head", "Latest block reported by the head tracker."))),
+		sprintHead:     prometheus.NewGauge(prometheus.GaugeOpts(opts("sprint_head", "End block of the latest uploaded range."))),
+		finalizedBlock: prometheus.NewGauge(prometheus.GaugeOpts(opts("finalized_block", "Latest block at the configured finality tag."))),
+		stageSize:      prometheus.NewGauge(prometheus.GaugeOpts(opts("stage_size_blocks", "Size of newly scheduled stages."))),
+		validatorHead: prometheus.NewGaugeVec(prometheus.GaugeOpts(opts("validator_head", "End block of the latest range validated by each validator.")),
+			[]string{"validator"}),
+		laneHead: prometheus.NewGaugeVec(prometheus.GaugeOpts(opts("lane_head", "End block of the latest uploaded range of each lane other than the main lane.")),
+			[]string{"lane"}),
+		queueDepth: prometheus.NewGaugeVec(prometheus.GaugeOpts(opts("queue_depth", "Number of tasks waiting in each sprint queue.")),
+			[]string{"queue"}),
+		fetchDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: "sprint", Name: "fetch_duration_seconds",
+			Help:    "Time spent fetching logs and blocks for a stage.",
+			Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+		}, []string{"task"}),
+		uploadDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: "sprint", Name: "upload_duration_seconds",
+			Help:    "Time spent committing a stage to the database.",
+			Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+		}, []string{"task"}),
+		eventsPerStage: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: "sprint", Name: "events_per_stage",
+			Help:    "Number of logs returned for an executed stage.",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 10),
+		}),
+		reorgsDetected: prometheus.NewCounter(prometheus.CounterOpts(opts("reorgs_detected_total", "Validated ranges whose events changed."))),
+		rangeSplits:    prometheus.NewCounter(prometheus.CounterOpts(opts("range_splits_total", "Executed ranges bisected due to provider limits."))),
+		rpcErrors: prometheus.NewCounterVec(prometheus.CounterOpts(opts("rpc_errors_total", "RPC errors by the call that failed.")),
+			[]string{"call"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts(opts("retries_total", "Retried operations by task.")),
+			[]string{"task"}),
+		failedRanges: prometheus.NewCounterVec(prometheus.CounterOpts(opts("failed_ranges_total", "Ranges that exhausted their retries by task.")),
+			[]string{"task"}),
+		rateLimited: prometheus.NewCounter(prometheus.CounterOpts(opts("rate_limited_total", "RPC calls rejected by the provider's rate limit."))),
+	}
+	m.blockCache = prometheus.NewDesc(prometheus.BuildFQName(namespace, "sprint", "block_cache_total"),
+		"Block cache lookups by result.", []string{"result"}, nil)
+	m.collectors = []prometheus.Collector{
+		m.chainHead, m.sprintHead, m.finalizedBlock, m.stageSize, m.validatorHead, m.laneHead, m.queueDepth,
+		m.fetchDuration, m.uploadDuration, m.eventsPerStage, m.reorgsDetected, m.rangeSplits, m.rpcErrors, m.retries,
+		m.failedRanges, m.rateLimited,
+	}
+	return m
+}
+
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.blockCache
+	for _, c := range m.collectors {
+		c.Describe(ch)
+	}
+}
+
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	// gauges are read from the sprint at scrape time rather than updated on every change
+	if s := m.s; s != nil {
+		m.chainHead.Set(float64(s.m.CurrentBlock()))
+		m.sprintHead.Set(float64(s.lastSuccessfulBlock.Load()))
+		m.finalizedBlock.Set(float64(s.FinalizedBlock()))
+		m.stageSize.Set(float64(s.stageSize.Load()))
+		for i := range s.validatorBlockStatus {
+			m.validatorHead.WithLabelValues(strconv.Itoa(i + 1)).Set(float64(s.validatorBlockStatus[i].Load()))
+		}
+		// lanes come and go at runtime, so stale lanes are dropped on every scrape
+		m.laneHead.Reset()
+		for name, head := range s.LaneHeads() {
+			m.laneHead.WithLabelValues(name).Set(float64(head))
+		}
+		stats := s.BlockCacheStats()
+		ch <- prometheus.MustNewConstMetric(m.blockCache, prometheus.CounterValue, float64(stats.Hits), "hit")
+		ch <- prometheus.MustNewConstMetric(m.blockCache, prometheus.CounterValue, float64(stats.Misses), "miss")
+		ch <- prometheus.MustNewConstMetric(m.blockCache, prometheus.CounterValue, float64(stats.Evictions), "eviction")
+		ch <- prometheus.MustNewConstMetric(m.blockCache, prometheus.CounterValue, float64(stats.Invalidations), "invalidation")
+		q := s.executionQueue
+		m.queueDepth.WithLabelValues("task").Set(float64(len(q.taskQueue)))
+		m.queueDepth.WithLabelValues("upload").Set(float64(len(q.uploadSequence)))
+		m.queueDepth.WithLabelValues("validation").Set(float64(len(q.validationQueue)))
+		m.queueDepth.WithLabelValues("validation_upload").Set(float64(len(q.validationSequence)))
+		if h := s.historyQueue; h != nil {
+			m.queueDepth.WithLabelValues("history_task").Set(float64(len(h.taskQueue)))
+			m.queueDepth.WithLabelValues("history_upload").Set(float64(len(h.uploadSequence)))
+		}
+	}
+	for _, c := range m.collectors {
+		c.Collect(ch)
+	}
+}
+
+func (m *Metrics) attach(s *Sprint) {
+	if m == nil {
+		return
+	}
+	m.s = s
+}
+
+func (m *Metrics) observeFetch(task string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.fetchDuration.WithLabelValues(task).Observe(d.Seconds())
+}
+
+func (m *Metrics) observeUpload(task string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.uploadDuration.WithLabelValues(task).Observe(d.Seconds())
+}
+
+func (m *Metrics) observeStageEvents(count int) {
+	if m == nil {
+		return
+	}
+	m.eventsPerStage.Observe(float64(count))
+}
+
+func (m *Metrics) incReorgs() {
+	if m == nil {
+		return
+	}
+	m.reorgsDetected.Inc()
+}
+
+func (m *Metrics) incRangeSplits() {
+	if m == nil {
+		return
+	}
+	m.rangeSplits.Inc()
+}
+
+func (m *Metrics) incRPCErrors(call string) {
+	if m == nil {
+		return
+	}
+	m.rpcErrors.WithLabelValues(call).Inc()
+}
+
+func (m *Metrics) incRetries(task string) {
+	if m == nil {
+		return
+	}
+	m.retries.WithLabelValues(task).Inc()
+}
+
+func (m *Metrics) incFailedRanges(task string) {
+	if m == nil {
+		return
+	}
+	m.failedRanges.WithLabelValues(task).Inc()
+}
+
+func (m *Metrics) incRateLimited() {
+	if m == nil {
+		return
+	}
+	m.rateLimited.Inc()
+}
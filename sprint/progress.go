@@ -0,0 +1,60 @@
+package sprint
+
+import (
+	"context"
+	"errors"
+
+	"github.com/upper/db/v4"
+)
+
+// ErrNoProgress is returned by a ProgressStore when no progress rows match a query
+var ErrNoProgress = errors.New("no matching progress rows")
+
+// ProgressStore persists the stage progress rows sprint schedules work from, along with the hashes
+// of the blocks it has ingested.
+//
+// Ranges are grouped into lanes, see StageProgressLog.Lane. Lanes are scheduled and executed
+// independently, while validation passes over ranges of every lane.
+//
+// Methods taking a db.Session are called from inside the transaction that uploads or validates a
+// range's events. Stores backed by the same database should write through that session so progress
+// commits atomically with the events. The session is nil when sprint runs without a database.
+type ProgressStore interface {
+	// Returns the end block of the highest scheduled range in a lane
+	ScheduleHead(ctx context.Context, lane string) (uint64, error)
+	// Inserts newly scheduled ranges, ignoring any that already exist
+	InsertScheduled(ctx context.Context, toSchedule []*StageProgressLog) error
+	// Claims the lowest unscheduled range in a lane by marking it scheduled. Ranges above a failed
+	// range are never claimed
+	NextRange(ctx context.Context, lane string) (*StageProgressLog, error)
+	// Returns the highest finished range in a lane
+	SprintHead(ctx context.Context, lane string) (*StageProgressLog, error)
+	// Returns the row recording the blocks a lane backfills, see Sprint.AddLane
+	Lane(ctx context.Context, lane string) (*StageProgressLog, error)
+	// Deletes every row of a lane
+	DeleteLane(ctx context.Context, lane string) error
+	// Claims the next range for each validator, spacing validators apart starting below currHeadStart
+	ClaimValidatorRanges(ctx context.Context, currHeadStart, validatorCount, validatorSpacing int) ([]*StageProgressLog, error)
+	// Claims up to limit finished ranges ending at or below the finalized block for a final validation pass
+	ClaimFinalizationRanges(ctx context.Context, finalizedBlock, limit int) ([]*StageProgressLog, error)
+	// Claims up to limit finished ranges of any lane overlapping startBlock to endBlock for an extra
+	// validation pass, skipping ranges a validator already holds
+	ClaimRanges(ctx context.Context, startBlock, endBlock, limit int) ([]*StageProgressLog, error)
+	// Returns unscheduled, failed and finished ranges of a lane overlapping startBlock to endBlock to
+	// unscheduled so they are executed again, returning the number of ranges reset. Ranges that are
+	// in flight are left alone
+	ResetRange(ctx context.Context, lane string, startBlock, endBlock int) (int, error)
+	// Returns up to limit ranges of every lane ordered by start block, skipping the first offset
+	ListProgress(ctx context.Context, offset, limit int) ([]*StageProgressLog, error)
+	// Releases ranges that were claimed when the process last exited, so they are claimed again
+	ResetInFlight(ctx context.Context) error
+	// Persists the state of a range
+	UpdateProgress(ctx context.Context, tx db.Session, prog *StageProgressLog) error
+	// Replaces a range with the sub-ranges it was split into
+	SplitProgress(ctx context.Context, tx db.Session, prog *StageProgressLog, parts []*StageProgressLog) error
+	// Replaces the stored block hashes of a lane between startBlock and endBlock. Lanes store their
+	// hashes separately, since their ranges overlap those of the main lane
+	StoreBlockHashes(ctx context.Context, tx db.Session, lane string, startBlock, endBlock int, hashes []*BlockHashLog) error
+	// Returns the stored block hashes of a lane between startBlock and endBlock in ascending order
+	BlockHashes(ctx context.Context, lane string, startBlock, endBlock int) ([]*BlockHashLog, error)
+}
@@ -0,0 +1,317 @@
+package sprint
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/upper/db/v4"
+)
+
+// memoryProgressStore keeps progress rows in memory. Progress is lost when the process exits, so it
+// is meant for tests and short lived indexers.
+type memoryProgressStore struct {
+	mu     sync.Mutex
+	rows   map[string]*StageProgressLog
+	hashes map[blockHashKey]*BlockHashLog
+}
+
+type blockHashKey struct {
+	lane  string
+	block int
+}
+
+// NewMemoryProgressStore returns a ProgressStore that keeps progress rows in memory
+func NewMemoryProgressStore() ProgressStore {
+	return &memoryProgressStore{
+		rows:   make(map[string]*StageProgressLog),
+		hashes: make(map[blockHashKey]*BlockHashLog),
+	}
+}
+
+func copyProgress(prog *StageProgressLog) *StageProgressLog {
+	cp := *prog
+	return &cp
+}
+
+// returns copies of the rows matching the filter, ordered by start block
+func (m *memoryProgressStore) selectRows(match func(*StageProgressLog) bool) []*StageProgressLog {
+	var res []*StageProgressLog
+	for _, row := range m.rows {
+		if match(row) {
+			res = append(res, copyProgress(row))
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].StartBlock < res[j].StartBlock
+	})
+	return res
+}
+
+func (m *memoryProgressStore) ScheduleHead(ctx context.Context, lane string) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	head, found := 0, false
+	for _, row := range m.rows {
+		if row.Stage == stageRange && row.Lane == lane && (!found || row.EndBlock > head) {
+			head, found = row.EndBlock, true
+		}
+	}
+	if !found {
+		return 0, ErrNoProgress
+	}
+	return uint64(head), nil
+}
+
+func (m *memoryProgressStore) InsertScheduled(ctx context.Context, toSchedule []*StageProgressLog) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, next := range toSchedule {
+		if _, ok := m.rows[next.PrimaryKey]; ok {
+			continue
+		}
+		m.rows[next.PrimaryKey] = copyProgress(next)
+	}
+	return nil
+}
+
+func (m *memoryProgressStore) NextRange(ctx context.Context, lane string) (*StageProgressLog, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rows := m.selectRows(func(row *StageProgressLog) bool {
+		return row.Stage == stageRange && row.Lane == lane && (row.Success == StatusUnscheduled || row.Success == StatusFailed)
+	})
+	// ranges above a failed range are parked along with it
+	if len(rows) == 0 || rows[0].Success == StatusFailed {
+		return nil, ErrNoProgress
+	}
+	prog := rows[0]
+	prog.StartTs = time.Now()
+	prog.Success = StatusScheduled
+	m.rows[prog.PrimaryKey] = copyProgress(prog)
+	return prog, nil
+}
+
+func (m *memoryProgressStore) SprintHead(ctx context.Context, lane string) (*StageProgressLog, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var head *StageProgressLog
+	for _, row := range m.rows {
+		if row.Success >= StatusFinished && row.Stage == stageRange && row.Lane == lane && (head == nil || row.EndBlock > head.EndBlock) {
+			head = row
+		}
+	}
+	if head == nil {
+		return nil, ErrNoProgress
+	}
+	return copyProgress(head), nil
+}
+
+func (m *memoryProgressStore) Lane(ctx context.Context, lane string) (*StageProgressLog, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, row := range m.rows {
+		if row.Stage == stageLane && row.Lane == lane {
+			return copyProgress(row), nil
+		}
+	}
+	return nil, ErrNoProgress
+}
+
+func (m *memoryProgressStore) DeleteLane(ctx context.Context, lane string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, row := range m.rows {
+		if row.Lane == lane {
+			delete(m.rows, key)
+		}
+	}
+	return nil
+}
+
+func (m *memoryProgressStore) ClaimValidatorRanges(ctx context.Context, currHeadStart, validatorCount, validatorSpacing int) ([]*StageProgressLog, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// lowest start block per number of validator passes, mirroring the grouped query of the sql store
+	minStart := make(map[int]int)
+	for _, row := range m.rows {
+		if row.Success != StatusFinished || row.Stage != stageRange || row.ValidatorPasses < 0 || row.ValidatorPasses >= validatorCount {
+			continue
+		}
+		if start, ok := minStart[row.ValidatorPasses]; !ok || row.StartBlock < start {
+			minStart[row.ValidatorPasses] = row.StartBlock
+		}
+	}
+	passes := make([]int, 0, len(minStart))
+	for p := range minStart {
+		passes = append(passes, p)
+	}
+	sort.Ints(passes)
+	res := make([]*StageProgressLog, 0, validatorCount)
+	lastScheduledValidatorBlock := currHeadStart - validatorSpacing
+	for _, p := range passes {
+		candidates := m.selectRows(func(row *StageProgressLog) bool {
+			return row.Success == StatusFinished && row.Stage == stageRange && row.ValidatorPasses >= 0 && row.ValidatorPasses <= p &&
+				row.StartBlock >= minStart[p] && row.EndBlock <= lastScheduledValidatorBlock
+		})
+		if len(candidates) == 0 {
+			continue
+		}
+		// most validated first, then lowest end block
+		sort.SliceStable(candidates, func(i, j int) bool {
+			if candidates[i].ValidatorPasses != candidates[j].ValidatorPasses {
+				return candidates[i].ValidatorPasses > candidates[j].ValidatorPasses
+			}
+			return candidates[i].EndBlock < candidates[j].EndBlock
+		})
+		currValidatorTask := candidates[0]
+		lastScheduledValidatorBlock = currValidatorTask.StartBlock - validatorSpacing
+		currValidatorTask.ValidatorPasses = -currValidatorTask.ValidatorPasses - 1
+		currValidatorTask.StartTs = time.Now()
+		m.rows[currValidatorTask.PrimaryKey] = copyProgress(currValidatorTask)
+		res = append(res, currValidatorTask)
+	}
+	return res, nil
+}
+
+func (m *memoryProgressStore) ClaimFinalizationRanges(ctx context.Context, finalizedBlock, limit int) ([]*StageProgressLog, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := m.selectRows(func(row *StageProgressLog) bool {
+		return row.Success == StatusFinished && row.Stage == stageRange && row.ValidatorPasses >= 0 && row.EndBlock <= finalizedBlock
+	})
+	if len(res) > limit {
+		res = res[:limit]
+	}
+	for _, prog := range res {
+		prog.ValidatorPasses = -prog.ValidatorPasses - 1
+		prog.StartTs = time.Now()
+		m.rows[prog.PrimaryKey] = copyProgress(prog)
+	}
+	return res, nil
+}
+
+func (m *memoryProgressStore) ClaimRanges(ctx context.Context, startBlock, endBlock, limit int) ([]*StageProgressLog, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := m.selectRows(func(row *StageProgressLog) bool {
+		return row.Success >= StatusFinished && row.Stage == stageRange && row.ValidatorPasses >= 0 &&
+			row.StartBlock <= endBlock && row.EndBlock >= startBlock
+	})
+	if len(res) > limit {
+		res = res[:limit]
+	}
+	for _, prog := range res {
+		prog.ValidatorPasses = -prog.ValidatorPasses - 1
+		prog.StartTs = time.Now()
+		m.rows[prog.PrimaryKey] = copyProgress(prog)
+	}
+	return res, nil
+}
+
+func (m *memoryProgressStore) ResetRange(ctx context.Context, lane string, startBlock, endBlock int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, row := range m.rows {
+		if row.Stage != stageRange || row.Lane != lane || row.Success == StatusScheduled || row.ValidatorPasses < 0 ||
+			row.StartBlock > endBlock || row.EndBlock < startBlock {
+			continue
+		}
+		row.Success = StatusUnscheduled
+		row.ValidatorPasses = 0
+		row.Error = ""
+		n++
+	}
+	return n, nil
+}
+
+func (m *memoryProgressStore) ListProgress(ctx context.Context, offset, limit int) ([]*StageProgressLog, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := m.selectRows(func(row *StageProgressLog) bool {
+		return row.Stage == stageRange
+	})
+	// ties on start block are ordered by lane, as in the sql store
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].StartBlock != res[j].StartBlock {
+			return res[i].StartBlock < res[j].StartBlock
+		}
+		return res[i].Lane < res[j].Lane
+	})
+	if offset >= len(res) {
+		return nil, nil
+	}
+	res = res[offset:]
+	if len(res) > limit {
+		res = res[:limit]
+	}
+	return res, nil
+}
+
+func (m *memoryProgressStore) ResetInFlight(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, row := range m.rows {
+		if row.Success == StatusScheduled && row.Stage == stageRange {
+			row.Success = StatusUnscheduled
+		}
+		if row.ValidatorPasses < 0 {
+			row.ValidatorPasses = -row.ValidatorPasses - 1
+		}
+	}
+	return nil
+}
+
+func (m *memoryProgressStore) UpdateProgress(ctx context.Context, tx db.Session, prog *StageProgressLog) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.rows[prog.PrimaryKey]; !ok {
+		return ErrNoProgress
+	}
+	m.rows[prog.PrimaryKey] = copyProgress(prog)
+	return nil
+}
+
+func (m *memoryProgressStore) SplitProgress(ctx context.Context, tx db.Session, prog *StageProgressLog, parts []*StageProgressLog) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.rows, prog.PrimaryKey)
+	for _, part := range parts {
+		m.rows[part.PrimaryKey] = copyProgress(part)
+	}
+	return nil
+}
+
+func (m *memoryProgressStore) StoreBlockHashes(ctx context.Context, tx db.Session, lane string, startBlock, endBlock int, hashes []*BlockHashLog) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key := range m.hashes {
+		if key.lane == lane && key.block >= startBlock && key.block <= endBlock {
+			delete(m.hashes, key)
+		}
+	}
+	for _, h := range hashes {
+		cp := *h
+		cp.Lane = lane
+		m.hashes[blockHashKey{lane: lane, block: h.BlockNumber}] = &cp
+	}
+	return nil
+}
+
+func (m *memoryProgressStore) BlockHashes(ctx context.Context, lane string, startBlock, endBlock int) ([]*BlockHashLog, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var res []*BlockHashLog
+	for key, h := range m.hashes {
+		if key.lane == lane && key.block >= startBlock && key.block <= endBlock {
+			cp := *h
+			res = append(res, &cp)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].BlockNumber < res[j].BlockNumber
+	})
+	return res, nil
+}
@@ -0,0 +1,173 @@
+package sprint
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestMemoryProgressStoreScheduling(t *testing.T) {
+	testProgressStoreScheduling(t, NewMemoryProgressStore())
+}
+
+// the store tests are shared with the SQL stores, see progress_sql_test.go
+func testProgressStoreScheduling(t *testing.T, store ProgressStore) {
+	ctx := context.Background()
+	if _, err := store.ScheduleHead(ctx, ""); !errors.Is(err, ErrNoProgress) {
+		t.Fatalf("expected ErrNoProgress, got %v", err)
+	}
+	toSchedule, err := createScheduleLogs("", divideStageRanges(0, 29, 9))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.InsertScheduled(ctx, toSchedule); err != nil {
+		t.Fatal(err)
+	}
+	// duplicate ranges are ignored
+	if err := store.InsertScheduled(ctx, toSchedule[:1]); err != nil {
+		t.Fatal(err)
+	}
+	head, err := store.ScheduleHead(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head != 29 {
+		t.Fatalf("expected schedule head 29, got %d", head)
+	}
+	next, err := store.NextRange(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.StartBlock != 0 || next.Success != StatusScheduled {
+		t.Fatalf("unexpected next range %+v", next)
+	}
+	// claimed ranges are released on reset
+	if err := store.ResetInFlight(ctx); err != nil {
+		t.Fatal(err)
+	}
+	again, err := store.NextRange(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.PrimaryKey != next.PrimaryKey {
+		t.Fatalf("expected %s to be claimed again, got %s", next.PrimaryKey, again.PrimaryKey)
+	}
+	again.Success = StatusFinished
+	if err := store.UpdateProgress(ctx, nil, again); err != nil {
+		t.Fatal(err)
+	}
+	sprintHead, err := store.SprintHead(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sprintHead.EndBlock != 9 {
+		t.Fatalf("expected sprint head to end at 9, got %d", sprintHead.EndBlock)
+	}
+}
+
+func TestMemoryProgressStoreValidators(t *testing.T) {
+	testProgressStoreValidators(t, NewMemoryProgressStore())
+}
+
+func testProgressStoreValidators(t *testing.T, store ProgressStore) {
+	ctx := context.Background()
+	toSchedule, _ := createScheduleLogs("", divideStageRanges(0, 99, 9))
+	for _, prog := range toSchedule {
+		prog.Success = StatusFinished
+	}
+	if err := store.InsertScheduled(ctx, toSchedule); err != nil {
+		t.Fatal(err)
+	}
+	claimed, err := store.ClaimValidatorRanges(ctx, 90, 2, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claimed) != 1 || claimed[0].StartBlock != 0 || claimed[0].ValidatorPasses != -1 {
+		t.Fatalf("unexpected validator ranges %+v", claimed)
+	}
+	// ranges in flight are not claimed twice
+	finalizing, err := store.ClaimFinalizationRanges(ctx, 19, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(finalizing) != 1 || finalizing[0].StartBlock != 10 {
+		t.Fatalf("unexpected finalization ranges %+v", finalizing)
+	}
+}
+
+func TestMemoryProgressStoreBlockHashes(t *testing.T) {
+	testProgressStoreBlockHashes(t, NewMemoryProgressStore())
+}
+
+func testProgressStoreBlockHashes(t *testing.T, store ProgressStore) {
+	ctx := context.Background()
+	err := store.StoreBlockHashes(ctx, nil, "", 0, 10, []*BlockHashLog{
+		{BlockNumber: 10, BlockHash: "0x0a"},
+		{BlockNumber: 3, BlockHash: "0x03"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// storing a range replaces every hash inside it
+	err = store.StoreBlockHashes(ctx, nil, "", 5, 10, []*BlockHashLog{{BlockNumber: 7, BlockHash: "0x07"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// lanes overlapping the range keep their own hashes
+	err = store.StoreBlockHashes(ctx, nil, HistoryLane, 0, 10, []*BlockHashLog{{BlockNumber: 7, BlockHash: "0x17"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes, err := store.BlockHashes(ctx, "", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 2 || hashes[0].BlockNumber != 3 || hashes[1].BlockHash != "0x07" {
+		t.Fatalf("unexpected hashes %+v", hashes)
+	}
+	hashes, err = store.BlockHashes(ctx, HistoryLane, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 1 || hashes[0].BlockHash != "0x17" || hashes[0].Lane != HistoryLane {
+		t.Fatalf("unexpected lane hashes %+v", hashes)
+	}
+}
+
+func TestMemoryProgressStoreParksAfterFailed(t *testing.T) {
+	testProgressStoreParksAfterFailed(t, NewMemoryProgressStore())
+}
+
+func testProgressStoreParksAfterFailed(t *testing.T, store ProgressStore) {
+	ctx := context.Background()
+	toSchedule, err := createScheduleLogs("", divideStageRanges(0, 29, 9))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.InsertScheduled(ctx, toSchedule); err != nil {
+		t.Fatal(err)
+	}
+	first, err := store.NextRange(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.Success = StatusFailed
+	if err := store.UpdateProgress(ctx, nil, first); err != nil {
+		t.Fatal(err)
+	}
+	// ranges above a failed range are not executed
+	if _, err := store.NextRange(ctx, ""); !errors.Is(err, ErrNoProgress) {
+		t.Fatalf("expected ErrNoProgress, got %v", err)
+	}
+	first.Success = StatusUnscheduled
+	if err := store.UpdateProgress(ctx, nil, first); err != nil {
+		t.Fatal(err)
+	}
+	next, err := store.NextRange(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.StartBlock != first.StartBlock {
+		t.Fatalf("expected reset range %d, got %d", first.StartBlock, next.StartBlock)
+	}
+}
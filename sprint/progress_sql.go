@@ -0,0 +1,386 @@
+package sprint
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/upper/db/v4"
+)
+
+// sqlProgressStore keeps progress rows in an upper/db session. Block hashes are kept in a second table
+// named after the progress table, see BlockHashLog.
+type sqlProgressStore struct {
+	sess          db.Session
+	progressTable string
+	blockTable    string
+	dialect       SQLDialect
+}
+
+// NewPostgresProgressStore returns a ProgressStore that keeps progress rows in the given Postgres table.
+// Tables created before lanes were added need a lane column, see MigratePostgresProgressStore.
+func NewPostgresProgressStore(sess db.Session, progressTable string) ProgressStore {
+	return &sqlProgressStore{
+		sess:          sess,
+		progressTable: progressTable,
+		blockTable:    blockTableName(progressTable),
+		dialect:       DialectPostgres,
+	}
+}
+
+// MigratePostgresProgressStore adds the columns added to the progress and block hash tables since they
+// were first released, and keys block hashes by lane. The block hash table is created if it does not
+// exist yet, see BlockHashLog. NewSprint runs it, callers of NewPostgresProgressStore must run it
+// themselves.
+func MigratePostgresProgressStore(ctx context.Context, sess db.Session, progressTable string) error {
+	_, err := sess.SQL().ExecContext(ctx, `ALTER TABLE `+progressTable+` ADD COLUMN IF NOT EXISTS lane TEXT NOT NULL DEFAULT ''`)
+	if err != nil {
+		return fmt.Errorf("error migrating %s: %w", progressTable, err)
+	}
+	blockTable := blockTableName(progressTable)
+	_, err = sess.SQL().ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+blockTable+` (
+		lane TEXT NOT NULL DEFAULT '',
+		block_number BIGINT NOT NULL,
+		block_hash TEXT NOT NULL,
+		parent_hash TEXT NOT NULL,
+		PRIMARY KEY (lane, block_number)
+	)`)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %w", blockTable, err)
+	}
+	_, err = sess.SQL().ExecContext(ctx, `ALTER TABLE `+blockTable+` ADD COLUMN IF NOT EXISTS lane TEXT NOT NULL DEFAULT ''`)
+	if err != nil {
+		return fmt.Errorf("error migrating %s: %w", blockTable, err)
+	}
+	// tables created before lanes were keyed by block number alone
+	var pkey string
+	var columns int
+	row, err := sess.SQL().QueryRowContext(ctx, `SELECT conname, array_length(conkey, 1) FROM pg_constraint WHERE conrelid = ?::regclass AND contype = 'p'`, blockTable)
+	if err != nil {
+		return fmt.Errorf("error migrating %s: %w", blockTable, err)
+	}
+	err = row.Scan(&pkey, &columns)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("error migrating %s: %w", blockTable, err)
+	}
+	if columns == 2 {
+		return nil
+	}
+	alter := `ALTER TABLE ` + blockTable + ` ADD PRIMARY KEY (lane, block_number)`
+	if pkey != "" {
+		alter = `ALTER TABLE ` + blockTable + ` DROP CONSTRAINT "` + pkey + `", ADD PRIMARY KEY (lane, block_number)`
+	}
+	_, err = sess.SQL().ExecContext(ctx, alter)
+	if err != nil {
+		return fmt.Errorf("error migrating %s: %w", blockTable, err)
+	}
+	return nil
+}
+
+// NewSQLiteProgressStore returns a ProgressStore that keeps progress rows in the given SQLite table,
+// creating the progress and block hash tables if they do not exist. The session can be opened with
+// upper/db's sqlite adapter.
+func NewSQLiteProgressStore(ctx context.Context, sess db.Session, progressTable string) (ProgressStore, error) {
+	p := &sqlProgressStore{
+		sess:          sess,
+		progressTable: progressTable,
+		blockTable:    blockTableName(progressTable),
+		dialect:       DialectSQLite,
+	}
+	_, err := sess.SQL().ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+p.progressTable+` (
+		primary_key TEXT PRIMARY KEY,
+		stage INTEGER NOT NULL,
+		start_block INTEGER NOT NULL,
+		end_block INTEGER NOT NULL,
+		start_ts DATETIME,
+		end_ts DATETIME,
+		success INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		msg TEXT NOT NULL DEFAULT '',
+		validator_passes INTEGER NOT NULL DEFAULT 0,
+		lane TEXT NOT NULL DEFAULT ''
+	)`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = sess.SQL().ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+p.blockTable+` (
+		lane TEXT NOT NULL DEFAULT '',
+		block_number INTEGER NOT NULL,
+		block_hash TEXT NOT NULL,
+		parent_hash TEXT NOT NULL,
+		PRIMARY KEY (lane, block_number)
+	)`)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// use the transaction of the caller when there is one
+func (p *sqlProgressStore) session(tx db.Session) db.Session {
+	if tx == nil {
+		return p.sess
+	}
+	return tx
+}
+
+func noProgress(err error) error {
+	if errors.Is(err, db.ErrNoMoreRows) {
+		return ErrNoProgress
+	}
+	return err
+}
+
+func (p *sqlProgressStore) ScheduleHead(ctx context.Context, lane string) (uint64, error) {
+	type Blk struct {
+		EndBlock uint64 `db:"end_block"`
+	}
+	b := &Blk{}
+	err := p.sess.SQL().Select("end_block").From(p.progressTable).Where("stage = 2 AND lane = ?", lane).OrderBy("-end_block").Limit(1).One(b)
+	if err != nil {
+		return 0, noProgress(err)
+	}
+	return b.EndBlock, nil
+}
+
+func (p *sqlProgressStore) InsertScheduled(ctx context.Context, toSchedule []*StageProgressLog) error {
+	return p.sess.TxContext(ctx, func(sess db.Session) error {
+		// duplicate ranges are ignored
+		b := sess.SQL().InsertInto(p.progressTable).Amend(p.dialect.IgnoreConflicts).Batch(1000)
+		go func() {
+			defer b.Done()
+			for _, next := range toSchedule {
+				b.Values(next)
+			}
+		}()
+		return b.Wait()
+	}, nil)
+}
+
+func (p *sqlProgressStore) NextRange(ctx context.Context, lane string) (*StageProgressLog, error) {
+	prog := &StageProgressLog{}
+	err := p.sess.TxContext(ctx, func(sess db.Session) error {
+		err := sess.SQL().SelectFrom(p.progressTable).
+			Where("success = 0 AND stage = 2 AND lane = ? AND NOT EXISTS (SELECT 1 FROM "+p.progressTable+" f WHERE f.success = ? AND f.stage = 2 AND f.lane = ? AND f.start_block < "+p.progressTable+".start_block)",
+				lane, StatusFailed, lane).
+			OrderBy("start_block ASC").Limit(1).One(prog)
+		if err != nil {
+			return err
+		}
+		prog.StartTs = time.Now()
+		prog.Success = StatusScheduled
+		return sess.Collection(p.progressTable).UpdateReturning(prog)
+	}, nil)
+	if err != nil {
+		return nil, noProgress(err)
+	}
+	return prog, nil
+}
+
+func (p *sqlProgressStore) SprintHead(ctx context.Context, lane string) (*StageProgressLog, error) {
+	prog := &StageProgressLog{}
+	err := p.sess.SQL().SelectFrom(p.progressTable).Where("success >= 1 AND stage = 2 AND lane = ?", lane).OrderBy("-end_block").Limit(1).One(prog)
+	if err != nil {
+		return nil, noProgress(err)
+	}
+	return prog, nil
+}
+
+func (p *sqlProgressStore) Lane(ctx context.Context, lane string) (*StageProgressLog, error) {
+	prog := &StageProgressLog{}
+	err := p.sess.SQL().SelectFrom(p.progressTable).Where("stage = 1 AND lane = ?", lane).Limit(1).One(prog)
+	if err != nil {
+		return nil, noProgress(err)
+	}
+	return prog, nil
+}
+
+func (p *sqlProgressStore) DeleteLane(ctx context.Context, lane string) error {
+	_, err := p.sess.SQL().DeleteFrom(p.progressTable).Where("lane = ?", lane).ExecContext(ctx)
+	return err
+}
+
+type ValidatorBlock struct {
+	StartBlock       int `db:"start_block"`
+	ValidatorPassess int `db:"validator_passes"`
+}
+
+func (p *sqlProgressStore) ClaimValidatorRanges(ctx context.Context, currHeadStart, validatorCount, validatorSpacing int) ([]*StageProgressLog, error) {
+	// for first validator, we want to start at the most-validated block + 1
+	// for all other validators, we want to start at the second most-validated block - validatorSpacing
+	res := make([]*StageProgressLog, 0, validatorCount)
+	lastScheduledValidatorBlock := currHeadStart - validatorSpacing
+	err := p.sess.TxContext(ctx, func(sess db.Session) error {
+		var maxes []*ValidatorBlock
+		err := sess.SQL().Select("validator_passes", db.Raw("MIN(start_block) as start_block")).
+			From(p.progressTable).Where("success = 1 AND stage = 2 AND validator_passes >= 0 AND validator_passes < ?", validatorCount).
+			GroupBy("validator_passes").OrderBy("validator_passes").
+			Limit(validatorCount).
+			All(&maxes)
+		if err != nil {
+			return err
+		}
+		for _, max := range maxes {
+			if max.ValidatorPassess >= validatorCount {
+				continue
+			}
+			currValidatorTask := &StageProgressLog{}
+			err := sess.SQL().SelectFrom(p.progressTable).
+				Where("success = 1 AND stage = 2 AND validator_passes <= ? AND validator_passes >= 0 AND start_block >= ? AND end_block <= ?",
+					max.ValidatorPassess, max.StartBlock, lastScheduledValidatorBlock).
+				OrderBy("-validator_passes", "end_block").Limit(1).One(currValidatorTask)
+			if err != nil {
+				continue
+			}
+			lastScheduledValidatorBlock = currValidatorTask.StartBlock - validatorSpacing
+			currValidatorTask.ValidatorPasses = -currValidatorTask.ValidatorPasses - 1
+			currValidatorTask.StartTs = time.Now()
+			err = sess.Collection(p.progressTable).UpdateReturning(currValidatorTask)
+			if err != nil {
+				return err
+			}
+			res = append(res, currValidatorTask)
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (p *sqlProgressStore) ClaimFinalizationRanges(ctx context.Context, finalizedBlock, limit int) ([]*StageProgressLog, error) {
+	var res []*StageProgressLog
+	err := p.sess.TxContext(ctx, func(sess db.Session) error {
+		err := sess.SQL().SelectFrom(p.progressTable).
+			Where("success = 1 AND stage = 2 AND validator_passes >= 0 AND end_block <= ?", finalizedBlock).
+			OrderBy("start_block").Limit(limit).All(&res)
+		if err != nil {
+			return err
+		}
+		for _, prog := range res {
+			// mark as in flight the same way validators do
+			prog.ValidatorPasses = -prog.ValidatorPasses - 1
+			prog.StartTs = time.Now()
+			err := sess.Collection(p.progressTable).UpdateReturning(prog)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (p *sqlProgressStore) ClaimRanges(ctx context.Context, startBlock, endBlock, limit int) ([]*StageProgressLog, error) {
+	var res []*StageProgressLog
+	err := p.sess.TxContext(ctx, func(sess db.Session) error {
+		err := sess.SQL().SelectFrom(p.progressTable).
+			Where("success >= 1 AND stage = 2 AND validator_passes >= 0 AND start_block <= ? AND end_block >= ?", endBlock, startBlock).
+			OrderBy("start_block").Limit(limit).All(&res)
+		if err != nil {
+			return err
+		}
+		for _, prog := range res {
+			prog.ValidatorPasses = -prog.ValidatorPasses - 1
+			prog.StartTs = time.Now()
+			err := sess.Collection(p.progressTable).UpdateReturning(prog)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (p *sqlProgressStore) ResetRange(ctx context.Context, lane string, startBlock, endBlock int) (int, error) {
+	res, err := p.sess.SQL().Update(p.progressTable).
+		Set(map[string]any{"success": StatusUnscheduled, "validator_passes": 0, "error": ""}).
+		Where("stage = 2 AND lane = ? AND success <> -1 AND validator_passes >= 0 AND start_block <= ? AND end_block >= ?", lane, endBlock, startBlock).
+		ExecContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (p *sqlProgressStore) ListProgress(ctx context.Context, offset, limit int) ([]*StageProgressLog, error) {
+	var res []*StageProgressLog
+	err := p.sess.SQL().SelectFrom(p.progressTable).Where("stage = 2").
+		OrderBy("start_block", "lane").Offset(offset).Limit(limit).All(&res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (p *sqlProgressStore) ResetInFlight(ctx context.Context) error {
+	_, err := p.sess.SQL().Update(p.progressTable).Set("success", StatusUnscheduled).Where("success = -1 AND stage = 2").ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = p.sess.SQL().Update(p.progressTable).Set("validator_passes", db.Raw("-validator_passes - 1")).Where("validator_passes < 0").ExecContext(ctx)
+	return err
+}
+
+func (p *sqlProgressStore) UpdateProgress(ctx context.Context, tx db.Session, prog *StageProgressLog) error {
+	// if for some reason the progress log is deleted, this will fail
+	return p.session(tx).Collection(p.progressTable).UpdateReturning(prog)
+}
+
+func (p *sqlProgressStore) SplitProgress(ctx context.Context, tx db.Session, prog *StageProgressLog, parts []*StageProgressLog) error {
+	sess := p.session(tx)
+	err := sess.Collection(p.progressTable).Find(db.Cond{"primary_key": prog.PrimaryKey}).Delete()
+	if err != nil {
+		return err
+	}
+	for _, part := range parts {
+		_, err := sess.Collection(p.progressTable).Insert(part)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *sqlProgressStore) StoreBlockHashes(ctx context.Context, tx db.Session, lane string, startBlock, endBlock int, hashes []*BlockHashLog) error {
+	sess := p.session(tx)
+	_, err := sess.SQL().DeleteFrom(p.blockTable).Where("lane = ? AND block_number >= ? AND block_number <= ?", lane, startBlock, endBlock).ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+	b := sess.SQL().InsertInto(p.blockTable).Batch(1000)
+	go func() {
+		defer b.Done()
+		for _, h := range hashes {
+			cp := *h
+			cp.Lane = lane
+			b.Values(&cp)
+		}
+	}()
+	return b.Wait()
+}
+
+func (p *sqlProgressStore) BlockHashes(ctx context.Context, lane string, startBlock, endBlock int) ([]*BlockHashLog, error) {
+	var hashes []*BlockHashLog
+	err := p.sess.SQL().SelectFrom(p.blockTable).
+		Where("lane = ? AND block_number >= ? AND block_number <= ?", lane, startBlock, endBlock).
+		OrderBy("block_number").All(&hashes)
+	if err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
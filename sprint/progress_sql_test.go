@@ -0,0 +1,37 @@
+package sprint
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/upper/db/v4/adapter/sqlite"
+)
+
+func newSQLiteTestStore(t *testing.T) ProgressStore {
+	t.Helper()
+	sess, err := sqlite.Open(sqlite.ConnectionURL{Database: filepath.Join(t.TempDir(), "progress.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sess.Close() })
+	store, err := NewSQLiteProgressStore(context.Background(), sess, "progress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestSQLiteProgressStore(t *testing.T) {
+	for name, test := range map[string]func(*testing.T, ProgressStore){
+		"scheduling":         testProgressStoreScheduling,
+		"validators":         testProgressStoreValidators,
+		"block hashes":       testProgressStoreBlockHashes,
+		"parks after failed": testProgressStoreParksAfterFailed,
+	} {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			test(t, newSQLiteTestStore(t))
+		})
+	}
+}
@@ -0,0 +1,291 @@
+package sprint
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"gfx.cafe/open/jrpc"
+	"tuxpa.in/a/zlog/log"
+)
+
+// DefaultComputeUnits holds the compute units of the calls sprint makes, as billed by providers that
+// price calls in compute units. Calls missing from RateLimit.ComputeUnits are looked up here.
+var DefaultComputeUnits = map[string]int{
+	"eth_blockNumber":           10,
+	"eth_getLogs":               75,
+	"eth_getBlockByNumber":      16,
+	"eth_getBlockReceipts":      500,
+	"eth_getTransactionByHash":  17,
+	"eth_getTransactionReceipt": 15,
+}
+
+// compute units of calls missing from both RateLimit.ComputeUnits and DefaultComputeUnits
+const defaultCallComputeUnits = 26
+
+const (
+	// calls rejected by the provider's rate limit are retried this many times before the error is returned
+	rateLimitRetries      = 5
+	initialRateLimitPause = time.Second
+	maxRateLimitPause     = 30 * time.Second
+)
+
+// RateLimit bounds the rate of RPC calls made by sprint, across the block cache and log fetching.
+// Calls in a JSON-RPC batch count individually.
+type RateLimit struct {
+	// Calls per second. 0 disables the limit.
+	RequestsPerSecond float64
+	// Compute units per second. 0 disables the limit.
+	ComputeUnitsPerSecond float64
+	// Compute units per method, for calls priced differently than in DefaultComputeUnits.
+	ComputeUnits map[string]int
+}
+
+func checkRateLimit(r RateLimit) error {
+	if r.RequestsPerSecond < 0 || r.ComputeUnitsPerSecond < 0 {
+		return errors.New("rate limits must be greater than or equal to 0")
+	}
+	for _, cu := range r.ComputeUnits {
+		if cu < 0 {
+			return errors.New("compute units must be greater than or equal to 0")
+		}
+	}
+	return nil
+}
+
+// JSON-RPC error code some providers reject calls exceeding their rate limit with, mirroring the HTTP
+// status
+const rateLimitErrorCode = 429
+
+// Error fragments returned by providers when a call is rejected by their rate limit. HTTP errors read
+// "429 Too Many Requests", a bare 429 would match block numbers and hashes in other errors
+var rateLimitErrors = []string{
+	"429 too many requests",
+	"status code 429",
+	"too many requests",
+	"rate limit",
+	"ratelimit",
+	"compute units per second",
+	"exceeded its throughput",
+	"capacity exceeded",
+}
+
+func isRateLimited(err error) bool {
+	// providers reject large log queries with similar wording, those are split rather than retried
+	if err == nil || isRangeLimitError(err) {
+		return false
+	}
+	if code, ok := rpcErrorCode(err); ok && code == rateLimitErrorCode {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, frag := range rateLimitErrors {
+		if strings.Contains(msg, frag) {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenBucket refills at rate tokens per second up to one second worth of tokens. Tokens are reserved
+// ahead of time, so the bucket goes negative while callers wait for their reservations.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// Takes n tokens, returning how long to wait until they are available
+func (b *tokenBucket) reserve(now time.Time, n float64) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+type rateLimiter struct {
+	c       RateLimit
+	metrics *Metrics
+
+	mu       sync.Mutex
+	requests *tokenBucket
+	units    *tokenBucket
+	// calls are held until then after the provider rate limited a call
+	pausedUntil time.Time
+	pause       time.Duration
+}
+
+func newRateLimiter(c RateLimit, metrics *Metrics) *rateLimiter {
+	return &rateLimiter{
+		c:        c,
+		metrics:  metrics,
+		requests: newTokenBucket(c.RequestsPerSecond),
+		units:    newTokenBucket(c.ComputeUnitsPerSecond),
+	}
+}
+
+func (l *rateLimiter) cost(method string) int {
+	if cu, ok := l.c.ComputeUnits[method]; ok {
+		return cu
+	}
+	if cu, ok := DefaultComputeUnits[method]; ok {
+		return cu
+	}
+	return defaultCallComputeUnits
+}
+
+// Blocks until the calls fit in the configured rates and any rate limit pause has passed
+func (l *rateLimiter) wait(ctx context.Context, methods ...string) error {
+	units := 0
+	for _, method := range methods {
+		units += l.cost(method)
+	}
+	l.mu.Lock()
+	now := time.Now()
+	delay := l.pausedUntil.Sub(now)
+	if d := l.requests.reserve(now, float64(len(methods))); d > delay {
+		delay = d
+	}
+	if d := l.units.reserve(now, float64(units)); d > delay {
+		delay = d
+	}
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Pauses every call after the provider rate limited one, doubling the pause while it keeps doing so
+func (l *rateLimiter) limited(err error) {
+	l.metrics.incRateLimited()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	// calls that were in flight when the pause started do not extend it
+	if now.Before(l.pausedUntil) {
+		return
+	}
+	switch {
+	case l.pause == 0:
+		l.pause = initialRateLimitPause
+	case l.pause < maxRateLimitPause:
+		l.pause *= 2
+		if l.pause > maxRateLimitPause {
+			l.pause = maxRateLimitPause
+		}
+	}
+	l.pausedUntil = now.Add(l.pause)
+	log.Warn().Err(err).Dur("pause", l.pause).Msg("rate limited by provider, pausing rpc calls")
+}
+
+func (l *rateLimiter) succeeded() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !time.Now().Before(l.pausedUntil) {
+		l.pause = 0
+	}
+}
+
+// rateLimitedConn holds calls to the wrapped conn to the configured rate limit, and retries calls
+// the provider rejected for exceeding its own limit
+type rateLimitedConn struct {
+	jrpc.Conn
+	l *rateLimiter
+}
+
+func newRateLimitedConn(c jrpc.Conn, limit RateLimit, metrics *Metrics) *rateLimitedConn {
+	return &rateLimitedConn{Conn: c, l: newRateLimiter(limit, metrics)}
+}
+
+func (c *rateLimitedConn) Do(ctx context.Context, result any, method string, params any) error {
+	for attempt := 1; ; attempt++ {
+		err := c.l.wait(ctx, method)
+		if err != nil {
+			return err
+		}
+		err = c.Conn.Do(ctx, result, method, params)
+		if !isRateLimited(err) {
+			if err == nil {
+				c.l.succeeded()
+			}
+			return err
+		}
+		c.l.limited(err)
+		if attempt >= rateLimitRetries {
+			return err
+		}
+	}
+}
+
+func (c *rateLimitedConn) BatchCall(ctx context.Context, b ...*jrpc.BatchElem) error {
+	pending := b
+	for attempt := 1; ; attempt++ {
+		methods := make([]string, len(pending))
+		for i, el := range pending {
+			methods[i] = el.Method
+		}
+		err := c.l.wait(ctx, methods...)
+		if err != nil {
+			return err
+		}
+		err = c.Conn.BatchCall(ctx, pending...)
+		if isRateLimited(err) {
+			c.l.limited(err)
+			if attempt >= rateLimitRetries {
+				return err
+			}
+			for _, el := range pending {
+				el.Error = nil
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// only the calls the provider rejected are sent again
+		var limited []*jrpc.BatchElem
+		for _, el := range pending {
+			if isRateLimited(el.Error) {
+				limited = append(limited, el)
+			}
+		}
+		if len(limited) == 0 {
+			c.l.succeeded()
+			return nil
+		}
+		c.l.limited(limited[0].Error)
+		if attempt >= rateLimitRetries {
+			return nil
+		}
+		for _, el := range limited {
+			el.Error = nil
+		}
+		pending = limited
+	}
+}
@@ -0,0 +1,69 @@
+package sprint
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestIsRateLimited(t *testing.T) {
+	cases := map[string]bool{
+		"429 Too Many Requests": true,
+		"Your app has exceeded its compute units per second capacity": true,
+		"daily request count exceeded, request rate limited":          true,
+		"query returned more than 10000 results":                      false,
+		"connection refused":                                          false,
+		"response status code 429":                                    true,
+		// block numbers and hashes holding 429
+		"header not found for block 14290000":           false,
+		"transaction 0xab429c not found in block 18000": false,
+	}
+	for msg, want := range cases {
+		if got := isRateLimited(errors.New(msg)); got != want {
+			t.Errorf("isRateLimited(%q) = %v, want %v", msg, got, want)
+		}
+	}
+	if !isRateLimited(codeError{code: 429, msg: "exceeded"}) {
+		t.Error("expected JSON-RPC error code 429 to be rate limited")
+	}
+	if isRateLimited(codeError{code: -32000, msg: "block 429 not found"}) {
+		t.Error("expected other JSON-RPC errors not to be rate limited")
+	}
+}
+
+// codeError is a JSON-RPC error returned by the server
+type codeError struct {
+	code int
+	msg  string
+}
+
+func (e codeError) Error() string { return e.msg }
+
+func (e codeError) ErrorCode() int { return e.code }
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(10)
+	now := b.last
+	// a full second of tokens is available up front
+	if d := b.reserve(now, 10); d != 0 {
+		t.Fatalf("expected no wait for the initial burst, got %v", d)
+	}
+	if d := b.reserve(now, 5); d != 500*time.Millisecond {
+		t.Fatalf("expected 500ms wait, got %v", d)
+	}
+	// reservations queue behind each other
+	if d := b.reserve(now, 5); d != time.Second {
+		t.Fatalf("expected 1s wait, got %v", d)
+	}
+	// refills never exceed a second of tokens
+	if d := b.reserve(now.Add(time.Minute), 10); d != 0 {
+		t.Fatalf("expected no wait after refilling, got %v", d)
+	}
+	if d := b.reserve(now.Add(time.Minute), 1); d != 100*time.Millisecond {
+		t.Fatalf("expected 100ms wait, got %v", d)
+	}
+	var disabled *tokenBucket
+	if d := disabled.reserve(now, 100); d != 0 {
+		t.Fatalf("expected disabled bucket not to wait, got %v", d)
+	}
+}
@@ -0,0 +1,194 @@
+package sprint
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"gfx.cafe/open/ghost"
+	"gfx.cafe/open/ghost/hexutil"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/holiman/uint256"
+	"golang.org/x/sync/errgroup"
+)
+
+// ReceiptInfo is the subset of transaction receipt fields needed for fee accounting
+type ReceiptInfo struct {
+	TransactionHash   common.Hash     `json:"transactionHash"`
+	TransactionIndex  *uint256.Int    `json:"transactionIndex"`
+	BlockHash         common.Hash     `json:"blockHash"`
+	BlockNumber       *uint256.Int    `json:"blockNumber"`
+	From              common.Address  `json:"from"`
+	To                *common.Address `json:"to"`
+	GasUsed           *uint256.Int    `json:"gasUsed"`
+	CumulativeGasUsed *uint256.Int    `json:"cumulativeGasUsed"`
+	EffectiveGasPrice *uint256.Int    `json:"effectiveGasPrice"`
+	// 1 for success, 0 for failure
+	Status *uint256.Int `json:"status"`
+	// Address of the contract created by the transaction, nil otherwise
+	ContractAddress *common.Address `json:"contractAddress"`
+	Type            *uint256.Int    `json:"type"`
+}
+
+// JSON-RPC error code of calls to methods the server does not implement
+const methodNotFoundErrorCode = -32601
+
+// Error fragments returned by providers that do not implement a method, for those that do not return
+// methodNotFoundErrorCode
+var methodNotFoundErrors = []string{
+	"method not found",
+	"does not exist/is not available",
+	"unsupported method",
+}
+
+func isMethodNotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+	if code, ok := rpcErrorCode(err); ok {
+		return code == methodNotFoundErrorCode
+	}
+	msg := strings.ToLower(err.Error())
+	for _, frag := range methodNotFoundErrors {
+		if strings.Contains(msg, frag) {
+			return true
+		}
+	}
+	return false
+}
+
+func fillReceipt(r *ReceiptInfo) {
+	if r.To == nil {
+		r.To = &common.Address{}
+	}
+	if r.TransactionIndex == nil {
+		r.TransactionIndex = &uint256.Int{}
+	}
+	if r.GasUsed == nil {
+		r.GasUsed = &uint256.Int{}
+	}
+	if r.CumulativeGasUsed == nil {
+		r.CumulativeGasUsed = &uint256.Int{}
+	}
+	// pre-london receipts have no effective gas price
+	if r.EffectiveGasPrice == nil {
+		r.EffectiveGasPrice = &uint256.Int{}
+	}
+	if r.Status == nil {
+		r.Status = &uint256.Int{}
+	}
+	if r.Type == nil {
+		r.Type = &uint256.Int{}
+	}
+}
+
+// Fetches the receipts of every transaction that emitted one of the logs, keyed by transaction hash.
+// Receipts must come from the same blocks as the block info, otherwise the range is retried
+func (s *Sprint) getStageReceipts(ctx context.Context, eventLogs []*ghost.ErigonLog, blocks map[int]*BlockInfo) (map[common.Hash]*ReceiptInfo, error) {
+	blockSet := make(map[int][]common.Hash)
+	for _, eventLog := range eventLogs {
+		blockSet[int(eventLog.BlockNumber)] = append(blockSet[int(eventLog.BlockNumber)], eventLog.TxHash)
+	}
+	receipts := make(map[common.Hash]*ReceiptInfo, len(eventLogs))
+	wg := errgroup.Group{}
+	m := sync.Mutex{}
+	for block := range blockSet {
+		block := block
+		wg.Go(func() error {
+			res, err := s.blockCache.ReceiptsAt(ctx, block, blockSet[block])
+			if err != nil {
+				return err
+			}
+			blk, ok := blocks[block]
+			m.Lock()
+			defer m.Unlock()
+			for hash, r := range res {
+				if ok && r.BlockHash != blk.Hash {
+					s.blockCache.InvalidateFrom(block)
+					return fmt.Errorf("receipt of %s is from a different block than %d", hash, block)
+				}
+				receipts[hash] = r
+			}
+			return nil
+		})
+	}
+	return receipts, wg.Wait()
+}
+
+// Fetches the receipts of the given transactions in a block. Uses eth_getBlockReceipts unless the
+// provider does not support it, after which every receipt is fetched on its own.
+// Meant to be used concurrently from caller
+func (t *blockCache) ReceiptsAt(ctx context.Context, block int, txs []common.Hash) (map[common.Hash]*ReceiptInfo, error) {
+	if !t.noBlockReceipts.Load() {
+		res, err := t.blockReceipts(ctx, block, txs)
+		if err == nil || !isMethodNotFound(err) {
+			return res, err
+		}
+		t.noBlockReceipts.Store(true)
+	}
+	res := make(map[common.Hash]*ReceiptInfo, len(txs))
+	wg := errgroup.Group{}
+	m := sync.Mutex{}
+	for _, hash := range txs {
+		hash := hash
+		m.Lock()
+		_, seen := res[hash]
+		res[hash] = nil
+		m.Unlock()
+		if seen {
+			continue
+		}
+		wg.Go(func() error {
+			r, err := t.transactionReceipt(ctx, hash)
+			if err != nil {
+				return err
+			}
+			m.Lock()
+			defer m.Unlock()
+			res[hash] = r
+			return nil
+		})
+	}
+	return res, wg.Wait()
+}
+
+func (t *blockCache) blockReceipts(ctx context.Context, block int, txs []common.Hash) (map[common.Hash]*ReceiptInfo, error) {
+	t.acquireWorker()
+	defer t.releaseWorker()
+	var all []*ReceiptInfo
+	err := t.c.Do(ctx, &all, "eth_getBlockReceipts", []any{hexutil.Uint64(block)})
+	if err != nil {
+		return nil, err
+	}
+	byHash := make(map[common.Hash]*ReceiptInfo, len(all))
+	for _, r := range all {
+		byHash[r.TransactionHash] = r
+	}
+	res := make(map[common.Hash]*ReceiptInfo, len(txs))
+	for _, hash := range txs {
+		r, ok := byHash[hash]
+		if !ok {
+			return nil, fmt.Errorf("missing receipt for transaction %s in block %d", hash, block)
+		}
+		fillReceipt(r)
+		res[hash] = r
+	}
+	return res, nil
+}
+
+func (t *blockCache) transactionReceipt(ctx context.Context, hash common.Hash) (*ReceiptInfo, error) {
+	t.acquireWorker()
+	defer t.releaseWorker()
+	r := &ReceiptInfo{}
+	err := t.c.Do(ctx, r, "eth_getTransactionReceipt", []any{hash})
+	if err != nil {
+		return nil, err
+	}
+	// null result for transactions the provider does not know about (yet)
+	if r.TransactionHash != hash {
+		return nil, fmt.Errorf("missing receipt for transaction %s", hash)
+	}
+	fillReceipt(r)
+	return r, nil
+}
@@ -0,0 +1,95 @@
+package sprint
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"gfx.cafe/open/ghost"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestIsMethodNotFound(t *testing.T) {
+	cases := map[string]bool{
+		"the method eth_getBlockReceipts does not exist/is not available": true,
+		"Method not found":                         true,
+		"Unsupported method: eth_getBlockReceipts": true,
+		"header not found":                         false,
+		"context deadline exceeded":                false,
+		// ordinary errors sharing words with method errors
+		"block 0x1234 does not exist":    false,
+		"receipts not available yet":     false,
+		"transaction type not supported": false,
+	}
+	for msg, want := range cases {
+		if got := isMethodNotFound(errors.New(msg)); got != want {
+			t.Errorf("isMethodNotFound(%q) = %v, want %v", msg, got, want)
+		}
+	}
+	if !isMethodNotFound(codeError{code: -32601, msg: "eth_getBlockReceipts"}) {
+		t.Error("expected error code -32601 to be method not found")
+	}
+	if isMethodNotFound(codeError{code: -32000, msg: "method not found"}) {
+		t.Error("expected the error code to take precedence over the message")
+	}
+}
+
+func TestReceiptsAtFallback(t *testing.T) {
+	ctx := context.Background()
+	chain := newChainConn()
+	txs := []common.Hash{{0x01}, {0x02}}
+	blk := chain.setBlock(5, 1)
+	for _, tx := range txs {
+		chain.setReceipt(blk, tx)
+	}
+	cache := NewBlockCacheWithSize(ctx, chain, 2, 0)
+	// the provider does not implement eth_getBlockReceipts
+	for i := 0; i < 2; i++ {
+		res, err := cache.ReceiptsAt(ctx, 5, txs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != 2 || res[txs[1]].TransactionHash != txs[1] || res[txs[1]].BlockHash != blk.Hash {
+			t.Fatalf("unexpected receipts %+v", res)
+		}
+	}
+	if got := chain.callCount("eth_getBlockReceipts"); got != 1 {
+		t.Fatalf("expected eth_getBlockReceipts to be called once, got %d", got)
+	}
+	if got := chain.callCount("eth_getTransactionReceipt"); got != 4 {
+		t.Fatalf("expected 4 transaction receipt calls, got %d", got)
+	}
+	// errors of a supported eth_getBlockReceipts are returned rather than falling back
+	chain = newChainConn()
+	chain.blockReceipts = true
+	cache = NewBlockCacheWithSize(ctx, chain, 2, 0)
+	if _, err := cache.ReceiptsAt(ctx, 6, txs); err == nil {
+		t.Fatal("expected missing receipts to fail")
+	}
+	if cache.noBlockReceipts.Load() || chain.callCount("eth_getTransactionReceipt") != 0 {
+		t.Fatal("expected an ordinary error not to disable eth_getBlockReceipts")
+	}
+}
+
+func TestStageReceipts(t *testing.T) {
+	ctx := context.Background()
+	chain := newChainConn()
+	chain.blockReceipts = true
+	tx := common.Hash{0x01}
+	blk := chain.setBlock(5, 1)
+	chain.setReceipt(blk, tx)
+	s := &Sprint{blockCache: NewBlockCacheWithSize(ctx, chain, 1, 0)}
+	logs := []*ghost.ErigonLog{{BlockNumber: 5, BlockHash: blk.Hash, TxHash: tx}}
+	receipts, err := s.getStageReceipts(ctx, logs, map[int]*BlockInfo{5: blk})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := receipts[tx]; r == nil || r.Status.Uint64() != 1 || r.EffectiveGasPrice == nil {
+		t.Fatalf("unexpected receipt %+v", r)
+	}
+	// receipts of a block reorged after the block info was fetched
+	chain.setReceipt(chain.setBlock(5, 2), tx)
+	if _, err := s.getStageReceipts(ctx, logs, map[int]*BlockInfo{5: blk}); err == nil {
+		t.Fatal("expected receipts of another block to fail")
+	}
+}
@@ -0,0 +1,80 @@
+package sprint
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultInitialBackoff = 500 * time.Millisecond
+	defaultMaxBackoff     = 30 * time.Second
+)
+
+// RetryPolicy bounds how sprint retries failed fetches and uploads. Delays grow exponentially from
+// InitialBackoff up to MaxBackoff between attempts.
+type RetryPolicy struct {
+	// Attempts made before a range is marked failed and parked for operator attention.
+	// 0 retries forever.
+	MaxAttempts int
+	// Delay before the first retry. Defaults to 500ms.
+	InitialBackoff time.Duration
+	// Upper bound on the delay between retries. Defaults to 30s.
+	MaxBackoff time.Duration
+	// Fraction of each delay that is randomized, between 0 and 1, so workers retrying the
+	// same provider spread out.
+	Jitter float64
+}
+
+func checkRetryPolicy(p RetryPolicy) error {
+	if p.MaxAttempts < 0 {
+		return errors.New("retry max attempts must be greater than or equal to 0")
+	}
+	if p.InitialBackoff < 0 || p.MaxBackoff < 0 {
+		return errors.New("retry backoff must be greater than or equal to 0")
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return errors.New("retry jitter must be between 0 and 1")
+	}
+	return nil
+}
+
+// Returns the delay after the given failed attempt, starting at 1
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	initial, max := p.InitialBackoff, p.MaxBackoff
+	if initial == 0 {
+		initial = defaultInitialBackoff
+	}
+	if max == 0 {
+		max = defaultMaxBackoff
+	}
+	d := initial
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if p.Jitter > 0 {
+		// spread the delay evenly over [d - jitter*d, d]
+		d -= time.Duration(rand.Float64() * p.Jitter * float64(d))
+	}
+	return d
+}
+
+// Waits out the backoff after a failed attempt. Returns false without waiting once attempts are
+// exhausted, or when the context is cancelled while waiting.
+func (p RetryPolicy) wait(ctx context.Context, attempt int) bool {
+	if p.MaxAttempts > 0 && attempt >= p.MaxAttempts {
+		return false
+	}
+	timer := time.NewTimer(p.backoff(attempt))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,39 @@
+package sprint
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+	for i, exp := range expected {
+		if d := p.backoff(i + 1); d != exp {
+			t.Fatalf("attempt %d: expected %s, got %s", i+1, exp, d)
+		}
+	}
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := p.backoff(3); d < 200*time.Millisecond || d > 400*time.Millisecond {
+			t.Fatalf("jittered backoff %s out of range", d)
+		}
+	}
+}
+
+func TestRetryPolicyWait(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}
+	ctx := context.Background()
+	if !p.wait(ctx, 1) {
+		t.Fatal("expected retry after first attempt")
+	}
+	if p.wait(ctx, 2) {
+		t.Fatal("expected attempts to be exhausted")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if (RetryPolicy{}).wait(ctx, 1) {
+		t.Fatal("expected cancelled context to stop retries")
+	}
+}
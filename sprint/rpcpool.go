@@ -0,0 +1,457 @@
+package sprint
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gfx.cafe/open/ghost/hexutil"
+	"gfx.cafe/open/jrpc"
+	"tuxpa.in/a/zlog/log"
+)
+
+// ErrNoQuorum is returned by an RPCPool when too few endpoints agree on the result of a call
+var ErrNoQuorum = errors.New("rpc endpoints did not reach quorum")
+
+var errPoolClosed = errors.New("rpc pool is closed")
+
+type RPCPoolConfig struct {
+	// Interval between health checks of every endpoint. Defaults to 15s.
+	HealthCheckInterval time.Duration
+	// Consecutive failed calls after which an endpoint is skipped until it passes a health check.
+	// Defaults to 3.
+	MaxFailures int
+	// Number of endpoints that must return the same result for the calls of a validator: the headers
+	// compared against the stored block hashes, and the logs and blocks refetched after a fork.
+	// 0 or 1 disables quorum.
+	LogsQuorum int
+	// Blocks an endpoint's head may trail the highest head of the pool before the endpoint is marked
+	// unhealthy, since it would return empty logs for the blocks it is missing. Defaults to 5.
+	MaxHeadLag uint64
+}
+
+// PoolEndpoint is a named endpoint of an RPCPool. The name is only used in logs and stats
+type PoolEndpoint struct {
+	Name string
+	Conn jrpc.Conn
+}
+
+// EndpointStats reports the state of an endpoint of an RPCPool
+type EndpointStats struct {
+	Name    string
+	Healthy bool
+	// Block number returned by the latest health check
+	Head     uint64
+	Requests uint64
+	Errors   uint64
+	// Moving average of the latency of successful calls
+	Latency time.Duration
+}
+
+type poolEndpoint struct {
+	name     string
+	conn     jrpc.Conn
+	healthy  atomic.Bool
+	failures atomic.Int64
+	head     atomic.Uint64
+	requests atomic.Uint64
+	errors   atomic.Uint64
+	// moving average of call latency in nanoseconds, 0 until the first successful call
+	latency atomic.Int64
+}
+
+func (e *poolEndpoint) observe(start time.Time, err error, maxFailures int) {
+	e.requests.Add(1)
+	if err != nil {
+		e.errors.Add(1)
+		if e.failures.Add(1) >= int64(maxFailures) && e.healthy.CompareAndSwap(true, false) {
+			log.Warn().Str("endpoint", e.name).Err(err).Msg("rpc endpoint marked unhealthy")
+		}
+		return
+	}
+	e.failures.Store(0)
+	sample := int64(time.Since(start))
+	prev := e.latency.Load()
+	if prev == 0 {
+		e.latency.Store(sample)
+		return
+	}
+	e.latency.Store(prev + (sample-prev)/5)
+}
+
+// RPCPool is a jrpc.Conn that spreads calls over several endpoints. Calls go to the healthy endpoint
+// with the highest head, and the lowest latency among those, and fail over to the next endpoint when
+// the call fails. Endpoints trailing the others by more than RPCPoolConfig.MaxHeadLag are unhealthy. Errors caused by
+// the request itself, such as a log range that is too large, are returned without failing over.
+//
+// With RPCPoolConfig.LogsQuorum set, eth_getLogs and eth_getBlockByNumber calls made while validating
+// a range are sent to several endpoints and only succeed when enough of them return the same result,
+// so a single endpoint on a stale fork can neither hide a reorg nor report one.
+type RPCPool struct {
+	c         RPCPoolConfig
+	endpoints []*poolEndpoint
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+var _ jrpc.Conn = (*RPCPool)(nil)
+
+// NewRPCPool creates a pool over the given endpoints, in order of preference until their latency is
+// known. Endpoints are health checked until the pool is closed.
+func NewRPCPool(ctx context.Context, config RPCPoolConfig, endpoints ...PoolEndpoint) (*RPCPool, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New("rpc pool needs at least one endpoint")
+	}
+	if config.HealthCheckInterval <= 0 {
+		config.HealthCheckInterval = 15 * time.Second
+	}
+	if config.MaxFailures <= 0 {
+		config.MaxFailures = 3
+	}
+	if config.MaxHeadLag == 0 {
+		config.MaxHeadLag = 5
+	}
+	if config.LogsQuorum > len(endpoints) {
+		return nil, fmt.Errorf("logs quorum of %d needs at least as many endpoints, got %d", config.LogsQuorum, len(endpoints))
+	}
+	p := &RPCPool{
+		c:      config,
+		closed: make(chan struct{}),
+	}
+	for i, ep := range endpoints {
+		name := ep.Name
+		if name == "" {
+			name = fmt.Sprintf("endpoint-%d", i)
+		}
+		e := &poolEndpoint{name: name, conn: ep.Conn}
+		e.healthy.Store(true)
+		p.endpoints = append(p.endpoints, e)
+	}
+	go p.runHealthChecks(ctx)
+	return p, nil
+}
+
+// Stats returns the state of every endpoint, in the order they were given
+func (p *RPCPool) Stats() []EndpointStats {
+	res := make([]EndpointStats, len(p.endpoints))
+	for i, e := range p.endpoints {
+		res[i] = EndpointStats{
+			Name:     e.name,
+			Healthy:  e.healthy.Load(),
+			Head:     e.head.Load(),
+			Requests: e.requests.Load(),
+			Errors:   e.errors.Load(),
+			Latency:  time.Duration(e.latency.Load()),
+		}
+	}
+	return res
+}
+
+// Returns healthy endpoints by descending head and then ascending latency, followed by unhealthy ones
+// so calls are still attempted when every endpoint is failing
+func (p *RPCPool) candidates() []*poolEndpoint {
+	res := make([]*poolEndpoint, len(p.endpoints))
+	copy(res, p.endpoints)
+	sort.SliceStable(res, func(i, j int) bool {
+		hi, hj := res[i].healthy.Load(), res[j].healthy.Load()
+		if hi != hj {
+			return hi
+		}
+		if hi, hj := res[i].head.Load(), res[j].head.Load(); hi != hj {
+			return hi > hj
+		}
+		return res[i].latency.Load() < res[j].latency.Load()
+	})
+	return res
+}
+
+// Reports whether an error is caused by the request rather than the endpoint, so other endpoints
+// would return it too
+func isRequestError(err error) bool {
+	return isRangeLimitError(err)
+}
+
+func (p *RPCPool) Do(ctx context.Context, result any, method string, params any) error {
+	if p.isClosed() {
+		return errPoolClosed
+	}
+	if p.c.LogsQuorum > 1 && quorumMethods[method] && isValidation(ctx) {
+		return p.doQuorum(ctx, result, method, params)
+	}
+	var err error
+	for _, e := range p.candidates() {
+		start := time.Now()
+		err = e.conn.Do(ctx, result, method, params)
+		if err == nil || isRequestError(err) {
+			e.observe(start, nil, p.c.MaxFailures)
+			return err
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		e.observe(start, err, p.c.MaxFailures)
+		log.Debug().Str("endpoint", e.name).Str("method", method).Err(err).Msg("rpc call failed, trying next endpoint")
+	}
+	return err
+}
+
+// Sends the call to endpoints until LogsQuorum of them return the same result
+func (p *RPCPool) doQuorum(ctx context.Context, result any, method string, params any) error {
+	typ := reflect.TypeOf(result)
+	if typ == nil || typ.Kind() != reflect.Pointer {
+		return errors.New("quorum call result must be a pointer")
+	}
+	type vote struct {
+		key   []byte
+		count int
+	}
+	var votes []*vote
+	var lastErr error
+	call := func(e *poolEndpoint) (reflect.Value, []byte, error) {
+		val := reflect.New(typ.Elem())
+		start := time.Now()
+		err := e.conn.Do(ctx, val.Interface(), method, params)
+		if isRequestError(err) {
+			e.observe(start, nil, p.c.MaxFailures)
+			return val, nil, err
+		}
+		e.observe(start, err, p.c.MaxFailures)
+		if err != nil {
+			return val, nil, err
+		}
+		// compare re-encoded results so formatting differences between providers are ignored
+		key, err := json.Marshal(val.Interface())
+		return val, key, err
+	}
+	tally := func(val reflect.Value, key []byte) bool {
+		for _, v := range votes {
+			if bytes.Equal(v.key, key) {
+				v.count++
+				return v.count >= p.c.LogsQuorum
+			}
+		}
+		votes = append(votes, &vote{key: key, count: 1})
+		return false
+	}
+	accept := func(val reflect.Value) error {
+		reflect.ValueOf(result).Elem().Set(val.Elem())
+		return nil
+	}
+	candidates := p.candidates()
+	// ask the first quorum of endpoints at once, then one more endpoint at a time until they agree
+	first := candidates[:p.c.LogsQuorum]
+	type response struct {
+		val reflect.Value
+		key []byte
+		err error
+	}
+	responses := make([]response, len(first))
+	wg := sync.WaitGroup{}
+	for i, e := range first {
+		i, e := i, e
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			val, key, err := call(e)
+			responses[i] = response{val: val, key: key, err: err}
+		}()
+	}
+	wg.Wait()
+	for _, r := range responses {
+		if r.err != nil {
+			// every endpoint would split the range the same way
+			if isRequestError(r.err) {
+				return r.err
+			}
+			lastErr = r.err
+			continue
+		}
+		if tally(r.val, r.key) {
+			return accept(r.val)
+		}
+	}
+	for _, e := range candidates[p.c.LogsQuorum:] {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		val, key, err := call(e)
+		if err != nil {
+			if isRequestError(err) {
+				return err
+			}
+			lastErr = err
+			continue
+		}
+		if tally(val, key) {
+			return accept(val)
+		}
+	}
+	if len(votes) > 1 {
+		log.Warn().Str("method", method).Int("results", len(votes)).Msg("rpc endpoints returned different results")
+	}
+	if lastErr != nil {
+		return fmt.Errorf("%w: %w", ErrNoQuorum, lastErr)
+	}
+	return ErrNoQuorum
+}
+
+func (p *RPCPool) BatchCall(ctx context.Context, b ...*jrpc.BatchElem) error {
+	if p.isClosed() {
+		return errPoolClosed
+	}
+	if p.c.LogsQuorum > 1 && isValidation(ctx) {
+		for _, el := range b {
+			if quorumMethods[el.Method] {
+				return p.batchQuorum(ctx, b)
+			}
+		}
+	}
+	var err error
+	for _, e := range p.candidates() {
+		for _, el := range b {
+			el.Error = nil
+		}
+		start := time.Now()
+		err = e.conn.BatchCall(ctx, b...)
+		// batch rejections are handled by the caller, which falls back to single calls
+		if err == nil || isBatchRejected(err) {
+			e.observe(start, nil, p.c.MaxFailures)
+			return err
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		e.observe(start, err, p.c.MaxFailures)
+		log.Debug().Str("endpoint", e.name).Int("calls", len(b)).Err(err).Msg("rpc batch failed, trying next endpoint")
+	}
+	return err
+}
+
+// Runs the calls of a batch one by one so they go through quorum
+func (p *RPCPool) batchQuorum(ctx context.Context, b []*jrpc.BatchElem) error {
+	wg := sync.WaitGroup{}
+	for _, el := range b {
+		el := el
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			el.Error = p.Do(ctx, el.Result, el.Method, el.Params)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+func (p *RPCPool) runHealthChecks(ctx context.Context) {
+	ticker := time.NewTicker(p.c.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.closed:
+			return
+		case <-ticker.C:
+		}
+		p.checkHealth(ctx)
+	}
+}
+
+// Checks the head of every endpoint, marking endpoints that fail or trail the highest head by more
+// than MaxHeadLag blocks unhealthy
+func (p *RPCPool) checkHealth(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, p.c.HealthCheckInterval)
+	defer cancel()
+	errs := make([]error, len(p.endpoints))
+	wg := sync.WaitGroup{}
+	for i, e := range p.endpoints {
+		i, e := i, e
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var head hexutil.Uint64
+			errs[i] = e.conn.Do(ctx, &head, "eth_blockNumber", nil)
+			if errs[i] == nil {
+				e.head.Store(uint64(head))
+			}
+		}()
+	}
+	wg.Wait()
+	var best uint64
+	for i, e := range p.endpoints {
+		if errs[i] == nil && e.head.Load() > best {
+			best = e.head.Load()
+		}
+	}
+	for i, e := range p.endpoints {
+		if errs[i] != nil {
+			if e.healthy.CompareAndSwap(true, false) {
+				log.Warn().Str("endpoint", e.name).Err(errs[i]).Msg("rpc endpoint failed health check")
+			}
+			continue
+		}
+		if head := e.head.Load(); head+p.c.MaxHeadLag < best {
+			if e.healthy.CompareAndSwap(true, false) {
+				log.Warn().Str("endpoint", e.name).Uint64("head", head).Uint64("best_head", best).Msg("rpc endpoint is behind")
+			}
+			continue
+		}
+		e.failures.Store(0)
+		if e.healthy.CompareAndSwap(false, true) {
+			log.Info().Str("endpoint", e.name).Msg("rpc endpoint recovered")
+		}
+	}
+}
+
+// Close stops health checks and closes every endpoint
+func (p *RPCPool) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		for _, e := range p.endpoints {
+			if cerr := e.conn.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	})
+	return err
+}
+
+func (p *RPCPool) Closed() <-chan struct{} {
+	return p.closed
+}
+
+func (p *RPCPool) isClosed() bool {
+	select {
+	case <-p.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// calls of validators that are checked against several endpoints, see RPCPoolConfig.LogsQuorum
+var quorumMethods = map[string]bool{
+	"eth_getLogs":          true,
+	"eth_getBlockByNumber": true,
+}
+
+type validationKey struct{}
+
+// Marks calls made while validating a range, see RPCPoolConfig.LogsQuorum
+func withValidation(ctx context.Context) context.Context {
+	return context.WithValue(ctx, validationKey{}, true)
+}
+
+func isValidation(ctx context.Context) bool {
+	v, _ := ctx.Value(validationKey{}).(bool)
+	return v
+}
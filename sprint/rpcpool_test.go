@@ -0,0 +1,149 @@
+package sprint
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"gfx.cafe/open/ghost/hexutil"
+	"gfx.cafe/open/jrpc"
+)
+
+// fakeConn answers every call with the same result or error, and eth_blockNumber with its head
+type fakeConn struct {
+	result []int
+	head   uint64
+	err    error
+	calls  int
+}
+
+func (c *fakeConn) Do(ctx context.Context, result any, method string, params any) error {
+	c.calls++
+	if c.err != nil {
+		return c.err
+	}
+	if method == "eth_blockNumber" {
+		*result.(*hexutil.Uint64) = hexutil.Uint64(c.head)
+		return nil
+	}
+	*result.(*[]int) = append([]int(nil), c.result...)
+	return nil
+}
+
+func (c *fakeConn) BatchCall(ctx context.Context, b ...*jrpc.BatchElem) error {
+	for _, el := range b {
+		el.Error = c.Do(ctx, el.Result, el.Method, el.Params)
+	}
+	return nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Closed() <-chan struct{} { return nil }
+
+func newTestPool(t *testing.T, config RPCPoolConfig, conns ...*fakeConn) *RPCPool {
+	endpoints := make([]PoolEndpoint, len(conns))
+	for i, c := range conns {
+		endpoints[i] = PoolEndpoint{Conn: c}
+	}
+	p, err := NewRPCPool(context.Background(), config, endpoints...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func TestRPCPoolFailover(t *testing.T) {
+	down := &fakeConn{err: errors.New("connection refused")}
+	up := &fakeConn{result: []int{1}}
+	p := newTestPool(t, RPCPoolConfig{MaxFailures: 1}, down, up)
+	var res []int
+	if err := p.Do(context.Background(), &res, "eth_getLogs", nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || down.calls != 1 {
+		t.Fatalf("got %v after %d calls to the failing endpoint", res, down.calls)
+	}
+	// the failing endpoint is skipped once unhealthy
+	if err := p.Do(context.Background(), &res, "eth_getLogs", nil); err != nil {
+		t.Fatal(err)
+	}
+	if down.calls != 1 {
+		t.Fatalf("unhealthy endpoint was called %d times", down.calls)
+	}
+	if stats := p.Stats(); stats[0].Healthy || stats[0].Errors != 1 || stats[1].Requests != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestRPCPoolRequestErrorNotRetried(t *testing.T) {
+	a := &fakeConn{err: errors.New("query returned more than 10000 results")}
+	b := &fakeConn{result: []int{1}}
+	p := newTestPool(t, RPCPoolConfig{}, a, b)
+	var res []int
+	if err := p.Do(context.Background(), &res, "eth_getLogs", nil); !isRangeLimitError(err) {
+		t.Fatalf("expected range limit error, got %v", err)
+	}
+	if b.calls != 0 {
+		t.Fatal("request error failed over to the next endpoint")
+	}
+}
+
+func TestRPCPoolQuorum(t *testing.T) {
+	ctx := withValidation(context.Background())
+	a := &fakeConn{result: []int{1, 2}}
+	b := &fakeConn{result: []int{1}}
+	c := &fakeConn{result: []int{1, 2}}
+	p := newTestPool(t, RPCPoolConfig{LogsQuorum: 2}, a, b, c)
+	var res []int
+	if err := p.Do(ctx, &res, "eth_getLogs", nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || c.calls != 1 {
+		t.Fatalf("got %v after %d calls to the tie breaking endpoint", res, c.calls)
+	}
+	// calls outside validation go to a single endpoint
+	if err := p.Do(context.Background(), &res, "eth_getLogs", nil); err != nil {
+		t.Fatal(err)
+	}
+	if a.calls+b.calls+c.calls != 4 {
+		t.Fatalf("expected 4 calls, got %d", a.calls+b.calls+c.calls)
+	}
+
+	c.result = []int{3}
+	err := p.Do(ctx, &res, "eth_getLogs", nil)
+	if !errors.Is(err, ErrNoQuorum) {
+		t.Fatalf("expected ErrNoQuorum, got %v", err)
+	}
+	// headers compared against stored block hashes are checked as well
+	err = p.Do(ctx, &res, "eth_getBlockByNumber", nil)
+	if !errors.Is(err, ErrNoQuorum) {
+		t.Fatalf("expected ErrNoQuorum for headers, got %v", err)
+	}
+}
+
+func TestRPCPoolHeadLag(t *testing.T) {
+	ctx := context.Background()
+	slow := &fakeConn{result: []int{1}, head: 90}
+	behind := &fakeConn{result: []int{2}, head: 98}
+	synced := &fakeConn{result: []int{3}, head: 100}
+	p := newTestPool(t, RPCPoolConfig{MaxHeadLag: 5}, slow, behind, synced)
+	p.checkHealth(ctx)
+	if stats := p.Stats(); stats[0].Healthy || !stats[1].Healthy || !stats[2].Healthy || stats[0].Head != 90 {
+		t.Fatalf("expected the endpoint 10 blocks behind to be unhealthy, got %+v", stats)
+	}
+	// calls go to the endpoint with the highest head first
+	var res []int
+	if err := p.Do(ctx, &res, "eth_getLogs", nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0] != 3 {
+		t.Fatalf("expected the synced endpoint to answer, got %v", res)
+	}
+	slow.head = 99
+	p.checkHealth(ctx)
+	if stats := p.Stats(); !stats[0].Healthy {
+		t.Fatalf("expected the endpoint to recover once it caught up, got %+v", stats)
+	}
+}
@@ -2,11 +2,10 @@ package sprint
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"strings"
 	"time"
 
-	"github.com/upper/db/v4"
 	"tuxpa.in/a/zlog/log"
 )
 
@@ -16,6 +15,10 @@ var (
 	StatusScheduled   TaskStatus = -1
 	StatusUnscheduled TaskStatus = 0
 	StatusFinished    TaskStatus = 1
+	// Finished ranges that were validated against the finalized chain, and so are never validated again
+	StatusFinalized TaskStatus = 2
+	// Ranges that exhausted their retries. No later range is executed until the range is reset
+	StatusFailed TaskStatus = -2
 )
 
 type StageProgressLog struct {
@@ -29,82 +32,115 @@ type StageProgressLog struct {
 	Error           string     `db:"error" json:"error"`
 	Msg             string     `db:"msg" json:"msg"`
 	ValidatorPasses int        `db:"validator_passes" json:"validator_passes"`
+	// Lane the range belongs to. Empty for the main lane that follows the chain head, otherwise the
+	// name of an event group backfilled after it was added at runtime. SQL stores need the column
+	// lane TEXT NOT NULL DEFAULT '', see MigratePostgresProgressStore
+	Lane string `db:"lane" json:"lane"`
 }
 
+const (
+	// progress rows recording the block a lane joins the main lane at
+	stageLane = 1
+	// progress rows for block ranges
+	stageRange = 2
+)
+
 func (s *Sprint) schedule(ctx context.Context) error {
+	// lanes read the schedule head to find where they join the main lane
+	s.scheduleMu.Lock()
+	defer s.scheduleMu.Unlock()
+	chainHead := s.m.CurrentBlock()
+	err := s.scheduleHistory(ctx, chainHead)
+	if err != nil {
+		return fmt.Errorf("error scheduling history lane: %w", err)
+	}
 	scheduleHead, err := s.currentScheduleHead(ctx)
 	if err != nil {
 		return err
 	}
-	chainHead := s.m.CurrentBlock()
 	if chainHead < s.c.StartBlock || scheduleHead < s.c.StartBlock {
 		return fmt.Errorf("sanity check: live block is too low")
 	}
 	scheduleHead = scheduleHead + 1
-	rngs := divideStageRanges(scheduleHead, chainHead, s.c.BlocksPerStage)
-	toSchedule, err := createScheduleLogs(rngs)
+	rngs := divideStageRanges(scheduleHead, chainHead, s.stageSize.Load())
+	toSchedule, err := createScheduleLogs("", rngs)
 	if err != nil {
 		return err
 	}
-	if len(toSchedule) == 0 {
-		return nil
+	if len(toSchedule) > 0 {
+		err = s.insertScheduledRanges(ctx, toSchedule)
+		if err != nil {
+			return err
+		}
 	}
-	return s.insertScheduledRanges(ctx, toSchedule)
+	// lanes following the chain head are scheduled independently of the main lane
+	for _, l := range s.followingLanes() {
+		err := s.scheduleFollowingLane(ctx, l, chainHead)
+		if err != nil {
+			return fmt.Errorf("error scheduling lane %s: %w", l.name, err)
+		}
+	}
+	return nil
 }
 
 func (s *Sprint) insertScheduledRanges(ctx context.Context, toSchedule []*StageProgressLog) error {
-	err := s.db.TxContext(ctx, func(d db.Session) error {
-		b := s.db.SQL().InsertInto(s.progressTable).Amend(onConflictDoNothing).Batch(1000)
-		go func() {
-			defer b.Done()
-			for _, next := range toSchedule {
-				log.Info().Int("start_block", next.StartBlock).Int("end_block", next.EndBlock).Msg("scheduled stage")
-				b.Values(next)
-			}
-		}()
-		return b.Wait()
-	}, nil)
-	if err != nil {
-		return err
+	for _, next := range toSchedule {
+		log.Info().Int("start_block", next.StartBlock).Int("end_block", next.EndBlock).Str("lane", next.Lane).Msg("scheduled stage")
 	}
-	return nil
+	return s.store.InsertScheduled(ctx, toSchedule)
 }
 
 func (s *Sprint) currentScheduleHead(ctx context.Context) (uint64, error) {
-	type Blk struct {
-		EndBlock uint64 `db:"end_block"`
+	head, err := s.store.ScheduleHead(ctx, "")
+	if err == nil {
+		return head, nil
 	}
-	b := &Blk{}
-	err := s.db.SQL().Select("end_block").From(s.progressTable).OrderBy("-end_block").Limit(1).One(b)
-	if err != nil {
-		if strings.Contains(err.Error(), "no more rows in this result set") {
-			return s.c.StartBlock, nil
-		}
+	if !errors.Is(err, ErrNoProgress) {
 		return 0, err
 	}
-	return b.EndBlock, nil
+	// the main lane starts after the blocks split off into the history lane
+	if s.historyEnabled() {
+		history, err := s.store.Lane(ctx, HistoryLane)
+		if err == nil {
+			return uint64(history.EndBlock), nil
+		}
+		if !errors.Is(err, ErrNoProgress) {
+			return 0, err
+		}
+	}
+	return s.c.StartBlock, nil
 }
 
+// Claims the next range to execute, rotating between the main lane and backfill lanes so that
+// neither a backfill nor the head of the chain starves the other
 func (s *Sprint) getNextRangeToExecute(ctx context.Context) (*StageProgressLog, error) {
-	prog := &StageProgressLog{}
-	err := s.db.TxContext(ctx, func(sess db.Session) error {
-		// should probs be able to configure limit
-		err := sess.SQL().SelectFrom(s.progressTable).Where("success = 0 AND stage = 2").OrderBy("start_block ASC").Limit(s.c.Workers).One(prog)
-		if err != nil {
-			return err
+	// the history lane is executed by its own workers, see queueHistory
+	var lanes []string
+	for _, name := range s.laneNames() {
+		if name != HistoryLane {
+			lanes = append(lanes, name)
+		}
+	}
+	s.lanesMu.Lock()
+	first := s.laneCursor
+	s.laneCursor++
+	s.lanesMu.Unlock()
+	for i := range lanes {
+		next, err := s.store.NextRange(ctx, lanes[(first+i)%len(lanes)])
+		if err == nil {
+			return next, nil
 		}
-		prog.StartTs = time.Now()
-		prog.Success = StatusScheduled
-		return sess.Collection(s.progressTable).UpdateReturning(prog)
-	}, nil)
-	return prog, err
+		if !errors.Is(err, ErrNoProgress) {
+			return nil, err
+		}
+	}
+	return nil, ErrNoProgress
 }
 
 func (s *Sprint) getCurrentStartHeadBlock(ctx context.Context) (int, error) {
-	prog := &StageProgressLog{}
-	err := s.db.SQL().SelectFrom(s.progressTable).Where("success >= 1 AND stage = 2").OrderBy("-end_block").Limit(1).One(prog)
+	prog, err := s.store.SprintHead(ctx, "")
 	if err != nil {
-		if strings.Contains(err.Error(), "no more rows in this result set") {
+		if errors.Is(err, ErrNoProgress) {
 			return int(s.c.StartBlock), nil
 		}
 		return 0, err
@@ -112,52 +148,14 @@ func (s *Sprint) getCurrentStartHeadBlock(ctx context.Context) (int, error) {
 	return prog.StartBlock, nil
 }
 
-type ValidatorBlock struct {
-	StartBlock       int `db:"start_block"`
-	ValidatorPassess int `db:"validator_passes"`
-}
-
 func (s *Sprint) getValidatorTaskRanges(ctx context.Context, currHeadStart, validatorCount, validatorSpacing int) ([]*StageProgressLog, error) {
 	if validatorCount == 0 {
 		return nil, fmt.Errorf("validator count is 0")
 	}
-	// for first validator, we want to start at the most-validated block + 1
-	// for all other validators, we want to start at the second most-validated block - validatorSpacing
-	res := make([]*StageProgressLog, 0, validatorCount)
-	lastScheduledValidatorBlock := currHeadStart - validatorSpacing
-	s.db.TxContext(ctx, func(sess db.Session) error {
-		var maxes []*ValidatorBlock
-		err := sess.SQL().Select("validator_passes", db.Raw("MIN(start_block) as start_block")).
-			From(s.progressTable).Where("success = 1 AND validator_passes >= 0 AND validator_passes < ?", validatorCount).
-			GroupBy("validator_passes").OrderBy("validator_passes").
-			Limit(validatorCount).
-			All(&maxes)
-		if err != nil {
-			return err
-		}
-		for _, max := range maxes {
-			if max.ValidatorPassess >= validatorCount {
-				continue
-			}
-			currValidatorTask := &StageProgressLog{}
-			err := s.db.SQL().SelectFrom(s.progressTable).
-				Where("success = 1 AND validator_passes <= ? AND validator_passes >= 0 AND start_block >= ? AND end_block <= ?",
-					max.ValidatorPassess, max.StartBlock, lastScheduledValidatorBlock).
-				OrderBy("-validator_passes", "end_block").Limit(1).One(currValidatorTask)
-			if err != nil {
-				continue
-			}
-			lastScheduledValidatorBlock = currValidatorTask.StartBlock - validatorSpacing
-			currValidatorTask.ValidatorPasses = -currValidatorTask.ValidatorPasses - 1
-			currValidatorTask.StartTs = time.Now()
-			err = s.db.Collection(s.progressTable).UpdateReturning(currValidatorTask)
-			if err != nil {
-				return err
-			}
-			res = append(res, currValidatorTask)
-		}
-		return nil
-	}, nil)
+	res, err := s.store.ClaimValidatorRanges(ctx, currHeadStart, validatorCount, validatorSpacing)
+	if err != nil {
+		return nil, err
+	}
 	reversed := make([]*StageProgressLog, len(res))
 	for i := range res {
 		reversed[len(res)-1-i] = res[i]
@@ -165,28 +163,75 @@ func (s *Sprint) getValidatorTaskRanges(ctx context.Context, currHeadStart, vali
 	return reversed, nil
 }
 
-// Resets the success of tasks that were terminated while running
-func (s *Sprint) resetProgressSuccess(ctx context.Context) error {
-	_, err := s.db.SQL().Update(s.progressTable).Set("success", StatusUnscheduled).Where("success = -1 AND stage = 2").ExecContext(ctx)
+// Claims finished ranges at or below the finalized block for a final validation pass
+func (s *Sprint) getFinalizationTaskRanges(ctx context.Context, finalizedBlock, limit int) ([]*StageProgressLog, error) {
+	return s.store.ClaimFinalizationRanges(ctx, finalizedBlock, limit)
+}
+
+// Marks a range that exhausted its retries as failed, parking it for operator attention. Later ranges
+// are not executed until it is reset to unscheduled
+func (s *Sprint) parkRange(ctx context.Context, batch *EventBatch) {
+	prog := batch.progressLog
+	prog.Success = StatusFailed
+	prog.Error = batch.err.Error()
+	prog.EndTs = time.Now()
+	prog.Msg = fmt.Sprintf("Parked at %s", time.Now().String())
+	log.Error().Int("start_block", prog.StartBlock).Int("end_block", prog.EndBlock).Str("error", prog.Error).
+		Msg("range failed, parking until reset")
+	s.c.Metrics.incFailedRanges("execute")
+	err := s.store.UpdateProgress(ctx, nil, prog)
 	if err != nil {
-		return err
+		log.Err(err).Msg("error parking range")
+	}
+}
+
+// Returns a range queued behind a parked range to unscheduled, so it is executed again once the
+// parked range is reset
+func (s *Sprint) releaseRange(ctx context.Context, prog *StageProgressLog) {
+	prog.Success = StatusUnscheduled
+	err := s.store.UpdateProgress(ctx, nil, prog)
+	if err != nil {
+		log.Err(err).Msg("error releasing range")
+	}
+}
+
+// Records the error of a validator pass that exhausted its retries and releases the range, so a
+// later pass validates it again
+func (s *Sprint) releaseValidation(ctx context.Context, batch *EventBatch) {
+	prog := batch.progressLog
+	prog.ValidatorPasses = -prog.ValidatorPasses - 1
+	prog.Error = batch.err.Error()
+	log.Error().Int("start_block", prog.StartBlock).Int("end_block", prog.EndBlock).Str("error", prog.Error).
+		Msg("validation failed, releasing range")
+	s.c.Metrics.incFailedRanges("validate")
+	err := s.store.UpdateProgress(ctx, nil, prog)
+	if err != nil {
+		log.Err(err).Msg("error releasing validation")
 	}
-	_, err = s.db.SQL().Update(s.progressTable).Set("validator_passes", db.Raw("-validator_passes - 1")).Where("validator_passes < 0").ExecContext(ctx)
-	return err
 }
 
-func createScheduleLogs(stageRanges []stageFilterRange) ([]*StageProgressLog, error) {
+// Resets the success of tasks that were terminated while running
+func (s *Sprint) resetProgressSuccess(ctx context.Context) error {
+	return s.store.ResetInFlight(ctx)
+}
+
+func createScheduleLogs(lane string, stageRanges []stageFilterRange) ([]*StageProgressLog, error) {
 	toSchedule := make([]*StageProgressLog, 0, len(stageRanges))
 	for _, nextRange := range stageRanges {
+		key := fmt.Sprintf("%d-%d", nextRange.start, nextRange.end)
+		if lane != "" {
+			key = lane + ":" + key
+		}
 		toSchedule = append(toSchedule, &StageProgressLog{
-			PrimaryKey: fmt.Sprintf("%d-%d", nextRange.start, nextRange.end),
-			Stage:      2,
+			PrimaryKey: key,
+			Stage:      stageRange,
 			StartBlock: int(nextRange.start),
 			EndBlock:   int(nextRange.end),
 			StartTs:    time.Time{},
 			EndTs:      time.Time{},
 			Error:      "",
 			Msg:        fmt.Sprintf("Scheduled at %s", time.Now().String()),
+			Lane:       lane,
 		})
 	}
 	return toSchedule, nil
@@ -197,6 +242,11 @@ type stageFilterRange struct {
 	end   uint64
 }
 
+// The size of the range in the unit of BlocksPerStage, one less than the number of blocks it covers
+func (r stageFilterRange) size() uint64 {
+	return r.end - r.start
+}
+
 func divideStageRanges(start, stop, size uint64) []stageFilterRange {
 	if size == 0 || start == stop {
 		return []stageFilterRange{{start: start, end: stop}}
@@ -25,10 +25,30 @@ type SprintConfig struct {
 	// can cause RPC issues due to the number of events being returned. Balancing this
 	// along with the number of concurrent workers is important.
 	BlocksPerStage uint64
-	// The number of concurrent workers to use when fetching data. This number should
-	// If using a rate-limited RPC, set this slightly below the rate limit, since
-	// the scheduler must request the current block number.
+	// Bounds for adaptive stage sizing. When a provider rejects a range for returning too many
+	// results, ranges of at least MinBlocksPerStage are bisected and newly
+	// scheduled stages shrink accordingly, never below MinBlocksPerStage. Defaults to 1.
+	MinBlocksPerStage uint64
+	// Upper bound the stage size grows back to after ranges turn out sparse. Defaults to BlocksPerStage.
+	MaxBlocksPerStage uint64
+	// Ranges with fewer events than this double the size of newly scheduled stages, up to
+	// MaxBlocksPerStage. Defaults to 100, a negative value disables growth.
+	SparseStageEvents int
+	// The number of concurrent workers to use when fetching data. A single stage can fan out into many
+	// calls, so use RateLimit rather than this to stay below a provider's rate limit.
 	Workers int
+	// Workers of a separate history lane. When set, the first run follows the chain head from
+	// HeadWindow blocks below it, and the blocks from StartBlock up to there are backfilled in
+	// HistoryLane by these workers with their own queue, so a long backfill does not delay ranges near
+	// the head. Has no effect on sprints that already scheduled ranges without it. Not supported for
+	// events that add addresses, such as factories, see EventBatch.Backfill.
+	BackfillWorkers int
+	// Blocks below the chain head the main lane starts at when BackfillWorkers is set. Defaults to
+	// 10 stages.
+	HeadWindow uint64
+	// Bounds the rate of RPC calls sprint makes. Calls rejected by the provider's own rate limit pause
+	// every call with backoff and are retried, whether or not limits are set.
+	RateLimit RateLimit
 	// This sets the maximum queue size for the task execution queue. Too large a number can cause large memory usage, whereas too small
 	// can cause the validator to be unable to keep up with the sprint.
 	ExecutionQueueSize int
@@ -50,6 +70,31 @@ type SprintConfig struct {
 	// This sets the maximum queue size for the validator queue. Too large a number can cause large memory usage, whereas too small
 	// can cause the validator to be unable to keep up with the sprint.
 	ValidatorQueueSize int
+	// Block tag ("finalized" or "safe") used to track the chain's finalized head. When set, ranges that
+	// end at or below that block receive a final validation pass and are then marked finalized, after
+	// which they are never validated again. Leave empty on chains without finality tags.
+	FinalityTag string
+	// Gives event groups added with a start block their own lane, scheduled from the group's start
+	// block up to the chain head with its own progress, rather than backfilling them up to the main
+	// lane and querying them with the main lane afterwards. Lanes are persisted, so this only affects
+	// groups added for the first time.
+	LanePerGroup bool
+	// Maximum number of calls sent in one JSON-RPC batch when fetching blocks and logs. Batching is
+	// disabled below 2. Providers that reject batches are sent single calls instead.
+	MaxBatchSize int
+	// Fetches only block headers and the transactions that emitted queried logs, rather than full
+	// blocks with every transaction. BlockInfo.Transactions then only holds those transactions.
+	HeaderOnlyBlocks bool
+	// Number of blocks kept in the block cache. Defaults to 256, set below 0 to disable caching.
+	BlockCacheSize int
+	// Fetches the receipts of every transaction that emitted a queried log and attaches them to
+	// EventBatch.Receipts. Uses eth_getBlockReceipts, falling back to eth_getTransactionReceipt on
+	// providers that do not support it.
+	FetchReceipts bool
+	// Bounds retries of failed fetches and uploads. The zero value retries forever with backoff.
+	Retry RetryPolicy
+	// Optional prometheus metrics. Register the same Metrics with a prometheus registry to scrape them.
+	Metrics *Metrics
 	// Sets verbosity
 	Verbose bool
 }
@@ -58,9 +103,21 @@ func checkConfig(c *SprintConfig) error {
 	if c.BlocksPerStage <= 0 {
 		return errors.New("blocks per stage must be greater than 0")
 	}
+	if c.MaxBlocksPerStage != 0 && c.MaxBlocksPerStage < c.BlocksPerStage {
+		return errors.New("max blocks per stage must be greater than or equal to blocks per stage")
+	}
+	if c.MinBlocksPerStage > c.BlocksPerStage {
+		return errors.New("min blocks per stage must be less than or equal to blocks per stage")
+	}
+	if c.MaxBatchSize < 0 {
+		return errors.New("max batch size must be greater than or equal to 0")
+	}
 	if c.Workers <= 0 {
 		return errors.New("workers must be greater than 0")
 	}
+	if c.BackfillWorkers < 0 {
+		return errors.New("backfill workers must be greater than or equal to 0")
+	}
 	if c.ExecutionQueueSize < 0 {
 		return errors.New("execution queue size must be greater than or equal to 0")
 	}
@@ -73,12 +130,25 @@ func checkConfig(c *SprintConfig) error {
 	if c.ValidatorSpacing <= 0 && c.ValidatorCount > 0 {
 		return errors.New("validator spacing must be greater than 0")
 	}
-	if c.ValidatorQueueSize <= 0 && c.ValidatorCount > 0 {
+	if c.ValidatorQueueSize <= 0 && (c.ValidatorCount > 0 || c.FinalityTag != "") {
 		return errors.New("validator queue size must be greater than 0")
 	}
+	if c.FinalityTag != "" && c.FinalityTag != "finalized" && c.FinalityTag != "safe" {
+		return errors.New("finality tag must be one of finalized or safe")
+	}
+	if err := checkRetryPolicy(c.Retry); err != nil {
+		return err
+	}
+	if err := checkRateLimit(c.RateLimit); err != nil {
+		return err
+	}
 	return nil
 }
 
+// SprintManager supplies the filters sprint queries and handles the resulting events. Batches of
+// ranges backfilled for event groups added at runtime report their lane through EventBatch.Lane,
+// see LaneManager. Ranges that already ran, such as those reset with Sprint.ResetRange, are executed
+// through Validate, which must replace whatever events the range still holds.
 type SprintManager interface {
 	CurrentBlock() uint64
 	Insert(ctx context.Context, d db.Session, startBlock int, endBlock int, eventData *EventBatch) error
@@ -86,14 +156,33 @@ type SprintManager interface {
 	GetStageFilters(blockStart, blockEnd int) []ethereum.FilterQuery
 }
 
+// CommitHook is implemented by managers that act on a range once its transaction commits, e.g. to
+// notify consumers of the events that were inserted.
+type CommitHook interface {
+	// Called after every attempt to commit the batch of a range passed to Insert or Validate, with
+	// the error the transaction failed with, or nil once it committed. Batches of a lane are committed
+	// in block order
+	AfterCommit(ctx context.Context, batch *EventBatch, err error)
+}
+
 type Sprint struct {
-	// task scheduling table
-	progressTable string
+	// task scheduling progress and canonical hashes of ingested blocks
+	store ProgressStore
 	// manages the insertion and validation logic
 	m SprintManager
 	// for logging
 	lastSuccessfulBlock  atomic.Int64
 	validatorBlockStatus []atomic.Int64
+	// chain head at the configured finality tag
+	finalizedBlock atomic.Uint64
+	// current size of newly scheduled stages
+	stageSize atomic.Uint64
+	// serializes scheduling of the main lane and lanes added at runtime
+	scheduleMu sync.Mutex
+	// lanes other than the main lane, and the lane executed next
+	lanesMu    sync.Mutex
+	lanes      []*lane
+	laneCursor int
 	// clients
 	rpc        jrpc.Conn
 	db         db.Session
@@ -101,66 +190,172 @@ type Sprint struct {
 
 	// task execution sequencing
 	executionQueue *executionQueue
+	// executes the history lane with its own workers, nil unless SprintConfig.BackfillWorkers is set
+	historyQueue *executionQueue
+	// whether the history lane was split off or resumed, guarded by scheduleMu
+	historyChecked bool
 
 	// config
 	c        *SprintConfig
 	isActive atomic.Bool
+	// set while scheduling and validation are paused, see Pause
+	paused atomic.Bool
+
+	// requests an immediate schedule, see TriggerSchedule
+	scheduleNow chan struct{}
+
+	// lifecycle of the current run, guarded by runState
+	runState  sync.Mutex
+	cancelRun context.CancelFunc
+	stopping  chan struct{}
+	stopOnce  sync.Once
+	done      chan struct{}
 }
 
 var ErrSprintActive = errors.New("cannot add new event filter while sprint is active")
 
+var ErrSprintRunning = errors.New("sprint is already running")
+
+// ErrStaleFilters is returned by managers when a batch's logs were queried with filters that have since
+// been widened, e.g. with addresses discovered in an earlier range, so it may be missing events. See
+// EventBatch.Filters. The range is fetched again before the commit is retried.
+var ErrStaleFilters = errors.New("batch was queried with stale filters")
+
+// NewSprint creates a sprint that keeps its progress in the given Postgres table, adding the columns
+// of newer releases to it
 func NewSprint(ctx context.Context, db db.Session, rpc jrpc.Conn, config *SprintConfig, progressTable string, manager SprintManager) (*Sprint, error) {
+	err := MigratePostgresProgressStore(ctx, db, progressTable)
+	if err != nil {
+		return nil, err
+	}
+	return NewSprintWithStore(ctx, db, rpc, config, NewPostgresProgressStore(db, progressTable), manager)
+}
+
+// NewSprintWithStore creates a sprint that keeps its progress in the given store. The db session is
+// handed to the manager when inserting and validating events, and may be nil if the manager does not
+// need a database.
+func NewSprintWithStore(ctx context.Context, db db.Session, rpc jrpc.Conn, config *SprintConfig, store ProgressStore, manager SprintManager) (*Sprint, error) {
 	err := checkConfig(config)
 	if err != nil {
 		return nil, err
 	}
+	// every call goes through the same limiter, so the block cache and log fetching share its budget
+	rpc = newRateLimitedConn(rpc, config.RateLimit, config.Metrics)
 	s := &Sprint{
-		progressTable:        progressTable,
+		store:                store,
 		db:                   db,
 		rpc:                  rpc,
 		c:                    config,
 		isActive:             atomic.Bool{},
-		blockCache:           NewBlockCache(ctx, rpc, config.Workers),
+		blockCache:           NewBlockCacheWithSize(ctx, rpc, config.Workers+config.BackfillWorkers, blockCacheSize(config.BlockCacheSize)),
 		m:                    manager,
 		validatorBlockStatus: make([]atomic.Int64, config.ValidatorCount),
+		scheduleNow:          make(chan struct{}, 1),
+	}
+	s.blockCache.maxBatchSize = config.MaxBatchSize
+	s.stageSize.Store(config.BlocksPerStage)
+	s.executionQueue = s.newExecutionQueue(config.ExecutionQueueSize)
+	if s.historyEnabled() {
+		// keep every history worker busy even when the execution queue is unbuffered
+		size := config.ExecutionQueueSize
+		if size < config.BackfillWorkers {
+			size = config.BackfillWorkers
+		}
+		s.historyQueue = s.newExecutionQueue(size)
+	}
+	config.Metrics.attach(s)
+	// managers that support runtime event groups schedule their lanes through the sprint
+	if lm, ok := manager.(LaneManager); ok {
+		err := lm.AttachLanes(ctx, s)
+		if err != nil {
+			return nil, err
+		}
 	}
-	s.executionQueue = s.newExecutionQueue()
 	return s, nil
 }
 
+// Run schedules, executes and validates ranges until the context is cancelled or Shutdown is called.
+// Cancelling the context abandons in-flight ranges, which are rescheduled on the next run.
 func (s *Sprint) Run(ctx context.Context) error {
-	s.isActive.Store(true)
+	if !s.isActive.CompareAndSwap(false, true) {
+		return ErrSprintRunning
+	}
 	defer s.isActive.Store(false)
+	// workers get their own context so Shutdown can abort them once its deadline passes
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s.runState.Lock()
+	s.cancelRun = cancel
+	s.stopping = make(chan struct{})
+	s.stopOnce = sync.Once{}
+	s.done = make(chan struct{})
+	stopping, done := s.stopping, s.done
+	s.runState.Unlock()
+	defer close(done)
 	// start listening for new sprint/validation tasks in background
-	go s.executionQueue.run(ctx, s.c.Workers)
+	s.executionQueue.resetDrain()
+	if s.historyQueue != nil {
+		s.historyQueue.resetDrain()
+	}
+	queueDone := make(chan struct{})
+	go func() {
+		defer close(queueDone)
+		wg := sync.WaitGroup{}
+		if s.historyQueue != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.historyQueue.run(runCtx, s.c.BackfillWorkers)
+			}()
+		}
+		s.executionQueue.run(runCtx, s.c.Workers)
+		wg.Wait()
+	}()
 	// In the event the program exited while a task was queued, must reset
 	// so it gets scheduled, otherwise we can skip blockranges
 	err := s.resetProgressSuccess(ctx)
 	if err != nil {
+		cancel()
+		<-queueDone
 		return err
 	}
 	// set the intial last block for logging
 	lastScheduledBlock, err := s.getCurrentStartHeadBlock(ctx)
 	if err != nil {
+		cancel()
+		<-queueDone
 		return err
 	}
 	s.lastSuccessfulBlock.Store(int64(lastScheduledBlock))
-	go s.logLoop()
+	go s.logLoop(runCtx)
 	// create tickers based on config
 	scheduleTicker := time.NewTicker(s.c.ScheduleInterval)
+	defer scheduleTicker.Stop()
 	executeTicker := time.NewTicker(s.c.ExecuteInterval)
+	defer executeTicker.Stop()
 	for {
 		select {
 		case <-ctx.Done():
+			cancel()
+			<-queueDone
 			return ctx.Err()
-		case <-scheduleTicker.C:
-			// schedule new ranges when most recent block number is not contained
-			// in set of scheduled block ranges
-			err := s.schedule(ctx)
-			if err != nil {
-				log.Err(err).Msg("error scheduling stages")
+		case <-stopping:
+			// no new ranges are queued past this point, so let the queue finish what it has.
+			// Shutdown cancels runCtx if its deadline passes first
+			s.executionQueue.drain()
+			if s.historyQueue != nil {
+				s.historyQueue.drain()
 			}
+			<-queueDone
+			return runCtx.Err()
+		case <-scheduleTicker.C:
+			s.runSchedule(ctx)
+		case <-s.scheduleNow:
+			s.runSchedule(ctx)
 		case <-executeTicker.C:
+			if s.paused.Load() {
+				continue
+			}
 			// query for next range to execute from database
 			next, err := s.getNextRangeToExecute(ctx)
 			// dont want to error when we don't have any new ranges to execute,
@@ -168,108 +363,399 @@ func (s *Sprint) Run(ctx context.Context) error {
 			if err == nil {
 				s.executionQueue.addTask(ctx, next)
 			}
-			lastHeadBlock := s.lastSuccessfulBlock.Load()
-			// to prevent scheduling from stalling in the event the validation queue is full
-			if s.c.ValidatorCount == 0 || len(s.executionQueue.validationQueue) >= s.c.ValidatorQueueSize-s.c.ValidatorCount {
-				continue
-			}
-			// gets validator task ranges to execute
-			validatorTasks, err := s.getValidatorTaskRanges(ctx, int(lastHeadBlock), s.c.ValidatorCount, s.c.ValidatorSpacing)
-			if err != nil {
-				log.Err(err).Msg("error getting validator tasks")
-				continue
-			}
-			// add validator tasks to queue
-			for _, task := range validatorTasks {
-				s.executionQueue.addValidationTask(ctx, task)
-			}
+			s.queueHistory(ctx)
+			s.scheduleValidation(ctx)
 		}
 	}
 }
 
+func (s *Sprint) runSchedule(ctx context.Context) {
+	if s.paused.Load() {
+		return
+	}
+	// schedule new ranges when most recent block number is not contained
+	// in set of scheduled block ranges
+	err := s.schedule(ctx)
+	if err != nil {
+		log.Err(err).Msg("error scheduling stages")
+	}
+	err = s.updateFinalizedBlock(ctx)
+	if err != nil {
+		log.Err(err).Msg("error updating finalized block")
+	}
+}
+
+// TriggerSchedule schedules new ranges right away rather than at the next schedule interval, e.g.
+// when a head tracker sees a new block. Never blocks, and triggers made while a schedule is pending
+// are merged into it.
+func (s *Sprint) TriggerSchedule() {
+	select {
+	case s.scheduleNow <- struct{}{}:
+	default:
+	}
+}
+
+// Shutdown stops scheduling new ranges and waits for in-flight ranges and validator passes to be
+// committed in order, returning once the sprint is quiescent. If ctx expires first, in-flight work
+// is abandoned and will be rescheduled on the next run.
+func (s *Sprint) Shutdown(ctx context.Context) error {
+	s.runState.Lock()
+	stopping, done, cancel := s.stopping, s.done, s.cancelRun
+	if stopping != nil {
+		s.stopOnce.Do(func() {
+			close(stopping)
+		})
+	}
+	s.runState.Unlock()
+	if done == nil {
+		return nil
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (s *Sprint) scheduleValidation(ctx context.Context) {
+	lastHeadBlock := s.lastSuccessfulBlock.Load()
+	// to prevent scheduling from stalling in the event the validation queue is full
+	if s.c.ValidatorCount > 0 && len(s.executionQueue.validationQueue) < s.c.ValidatorQueueSize-s.c.ValidatorCount {
+		// gets validator task ranges to execute
+		validatorTasks, err := s.getValidatorTaskRanges(ctx, int(lastHeadBlock), s.c.ValidatorCount, s.c.ValidatorSpacing)
+		if err != nil {
+			log.Err(err).Msg("error getting validator tasks")
+		}
+		// add validator tasks to queue
+		for _, task := range validatorTasks {
+			s.executionQueue.addValidationTask(ctx, task, false)
+		}
+	}
+	if s.c.FinalityTag == "" {
+		return
+	}
+	// finalization passes fill whatever room is left in the validation queue
+	free := s.c.ValidatorQueueSize - len(s.executionQueue.validationSequence)
+	if free <= 0 {
+		return
+	}
+	finalizationTasks, err := s.getFinalizationTaskRanges(ctx, int(s.FinalizedBlock()), free)
+	if err != nil {
+		log.Err(err).Msg("error getting finalization tasks")
+		return
+	}
+	for _, task := range finalizationTasks {
+		s.executionQueue.addValidationTask(ctx, task, true)
+	}
+}
+
+// BlockCacheStats returns hit and miss statistics of the block cache
+func (s *Sprint) BlockCacheStats() BlockCacheStats {
+	return s.blockCache.Stats()
+}
+
+func blockCacheSize(size int) int {
+	if size == 0 {
+		return defaultBlockCacheSize
+	}
+	return size
+}
+
+// FinalizedBlock returns the latest block at the configured finality tag, or 0 if finality
+// tracking is disabled
+func (s *Sprint) FinalizedBlock() uint64 {
+	return s.finalizedBlock.Load()
+}
+
+func (s *Sprint) updateFinalizedBlock(ctx context.Context) error {
+	if s.c.FinalityTag == "" {
+		return nil
+	}
+	hdr, err := s.blockCache.HeaderByTag(ctx, s.c.FinalityTag)
+	if err != nil {
+		return err
+	}
+	// the finalized head should never move backwards, but guard against lagging providers
+	finalized := hdr.Number.Uint64()
+	if finalized > s.finalizedBlock.Load() {
+		s.finalizedBlock.Store(finalized)
+	}
+	return nil
+}
+
+// Reports whether every block up to and including the given block is final. Must be checked before
+// fetching a range, so the fetched data is known to come from the finalized chain
+func (s *Sprint) isFinalized(block int) bool {
+	return s.c.FinalityTag != "" && block <= int(s.finalizedBlock.Load())
+}
+
 func (s *Sprint) uploadBatch(ctx context.Context, batch *EventBatch) error {
 	// execute in transaction to ensure we successfully can update and insert new events
 	// and to preserve read consistency for api
-	return s.db.TxContext(ctx, func(tx db.Session) error {
-		// insert first so we can update end timestamp correctly
-		err := s.m.Insert(ctx, tx, batch.progressLog.StartBlock, batch.progressLog.EndBlock, batch)
+	defer func(start time.Time) {
+		s.c.Metrics.observeUpload("execute", time.Since(start))
+	}(time.Now())
+	err := s.withTx(ctx, func(tx db.Session) error {
+		// insert first so we can update end timestamp correctly. Ranges that ran before, such as ranges
+		// reset with ResetRange, may still hold their events, so Validate replaces them instead
+		var err error
+		if batch.progressLog.EndTs.IsZero() {
+			err = s.m.Insert(ctx, tx, batch.progressLog.StartBlock, batch.progressLog.EndBlock, batch)
+		} else {
+			_, err = s.m.Validate(ctx, tx, batch.progressLog.StartBlock, batch.progressLog.EndBlock, batch)
+		}
+		if err != nil {
+			return err
+		}
+		err = s.store.StoreBlockHashes(ctx, tx, batch.progressLog.Lane, batch.progressLog.StartBlock, batch.progressLog.EndBlock, batchBlockHashes(batch))
 		if err != nil {
 			return err
 		}
-		// update progress log values to reflect completed range
-		batch.progressLog.Success = StatusFinished
-		batch.progressLog.EndTs = time.Now()
-		// if for some reason the progress log is deleted, this will fail
-		err = tx.Collection(s.progressTable).UpdateReturning(batch.progressLog)
+		// update progress log values to reflect completed range. Ranges fetched from the finalized
+		// chain never need validating. Work on a copy so a failed attempt can be retried as is
+		prog := *batch.progressLog
+		prog.Success = StatusFinished
+		if batch.finalized {
+			prog.Success = StatusFinalized
+		}
+		prog.EndTs = time.Now()
+		prog.Error = ""
+		// ranges that had to be bisected are persisted as their sub-ranges
+		if len(batch.ranges) > 1 {
+			err = s.splitProgressRange(ctx, tx, &prog, batch.ranges)
+		} else {
+			err = s.store.UpdateProgress(ctx, tx, &prog)
+		}
 		if err != nil {
 			return err
 		}
+		*batch.progressLog = prog
 		// log success
 		s.logTaskSuccess(batch)
 		return nil
-	}, &sql.TxOptions{
-		Isolation: sql.LevelReadCommitted,
 	})
+	s.afterCommit(ctx, batch, err)
+	return err
 }
 
 func (s *Sprint) validateBatch(ctx context.Context, batch *EventBatch) error {
 	// execute in transaction to ensure we successfully can update and insert new events
 	// and to preserve read consistency for api
-	return s.db.TxContext(ctx, func(tx db.Session) error {
-		// validate events in range. Validate should delete and insert correct events
-		// when it detects inconsistencies
-		didReorg, err := s.m.Validate(ctx, tx, batch.progressLog.StartBlock, batch.progressLog.EndBlock, batch)
-		if err != nil {
-			return err
+	defer func(start time.Time) {
+		s.c.Metrics.observeUpload("validate", time.Since(start))
+	}(time.Now())
+	err := s.withTx(ctx, func(tx db.Session) error {
+		// validate events from the fork block onwards. Validate should delete and insert correct events
+		// when it detects inconsistencies. Nothing needs validating if the stored hashes are still canonical
+		didReorg := false
+		if !batch.canonical {
+			var err error
+			didReorg, err = s.m.Validate(ctx, tx, batch.fromBlock, batch.progressLog.EndBlock, batch)
+			if err != nil {
+				return err
+			}
+			err = s.store.StoreBlockHashes(ctx, tx, batch.progressLog.Lane, batch.fromBlock, batch.progressLog.EndBlock, batchBlockHashes(batch))
+			if err != nil {
+				return err
+			}
+		}
+		// update validator passes to allow multiple validators to function correctly. Work on a
+		// copy so a failed attempt can be retried as is
+		prog := *batch.progressLog
+		prog.ValidatorPasses = -prog.ValidatorPasses
+		if batch.finalized {
+			prog.Success = StatusFinalized
 		}
-		// update validator passes to allow multiple validators to function correctly
-		batch.progressLog.ValidatorPasses = -batch.progressLog.ValidatorPasses
 		if didReorg {
 			// this will be overwritten if a validator detects and fixes a reorg that is reorged out again
-			batch.progressLog.Msg = fmt.Sprintf("reorg detected at time: %s after validator pass %d", time.Now().String(), batch.progressLog.ValidatorPasses)
+			prog.Msg = fmt.Sprintf("reorg detected at time: %s after validator pass %d", time.Now().String(), prog.ValidatorPasses)
 		}
-		batch.progressLog.EndTs = time.Now()
-		err = tx.Collection(s.progressTable).UpdateReturning(batch.progressLog)
+		prog.EndTs = time.Now()
+		prog.Error = ""
+		err := s.store.UpdateProgress(ctx, tx, &prog)
 		if err != nil {
 			return err
 		}
+		*batch.progressLog = prog
+		if didReorg {
+			s.c.Metrics.incReorgs()
+		}
 		// log success
 		s.logValidationSuccess(batch, didReorg)
 		return nil
-	}, &sql.TxOptions{
+	})
+	s.afterCommit(ctx, batch, err)
+	return err
+}
+
+func (s *Sprint) afterCommit(ctx context.Context, batch *EventBatch, err error) {
+	if hook, ok := s.m.(CommitHook); ok {
+		hook.AfterCommit(ctx, batch, err)
+	}
+}
+
+// Runs fn in a transaction on the sprint database, or without one when sprint has no database
+func (s *Sprint) withTx(ctx context.Context, fn func(tx db.Session) error) error {
+	if s.db == nil {
+		return fn(nil)
+	}
+	return s.db.TxContext(ctx, fn, &sql.TxOptions{
 		Isolation: sql.LevelReadCommitted,
 	})
 }
 
 func (s *Sprint) executeTask(ctx context.Context, t *task) *EventBatch {
-	var stageLogs []*ghost.ErigonLog
-	var blockInfo map[int]*BlockInfo
+	prog := t.StageProgressLog
+	finalized := s.isFinalized(prog.EndBlock)
+	fetchStart := time.Now()
+	var batch *EventBatch
 	var err error
-	for {
-		stageLogs, err = s.getStageEventLogs(ctx, t.StageProgressLog.StartBlock, t.StageProgressLog.EndBlock)
-		if err != nil {
-			log.Err(err).Msg("error getting event logs")
-			continue
+	for attempt := 1; ; attempt++ {
+		batch, err = s.fetchRange(ctx, prog.Lane, prog.StartBlock, prog.EndBlock, true)
+		if err == nil {
+			break
+		}
+		// abandon the task when sprint is stopped mid-fetch
+		if ctx.Err() != nil {
+			return nil
+		}
+		log.Err(err).Int("start_block", prog.StartBlock).Int("end_block", prog.EndBlock).Int("attempt", attempt).Msg("error executing range")
+		if !s.c.Retry.wait(ctx, attempt) {
+			if ctx.Err() != nil {
+				return nil
+			}
+			// out of attempts, the upload sequencer parks the range
+			return &EventBatch{progressLog: prog, fromBlock: prog.StartBlock, err: err}
 		}
-		blockInfo, err = s.getStageBlockInfo(ctx, stageLogs)
+		s.c.Metrics.incRetries(t.kind())
+	}
+	s.c.Metrics.observeFetch(t.kind(), time.Since(fetchStart))
+	s.c.Metrics.observeStageEvents(len(batch.Events))
+	if len(batch.ranges) > 1 {
+		s.c.Metrics.incRangeSplits()
+	}
+	s.adjustStageSize(batch.ranges, len(batch.Events))
+	batch.progressLog = prog
+	batch.finalized = finalized
+	batch.finalizing = t.finalizing
+	batch.backfill = s.backfillLane(prog.Lane)
+	return batch
+}
+
+// Fetches logs, blocks and the end block header for a range. Ranges the provider rejects as too large
+// are bisected, and the pieces are recorded on the batch when persistSplits is set
+func (s *Sprint) fetchRange(ctx context.Context, lane string, startBlock, endBlock int, persistSplits bool) (*EventBatch, error) {
+	// the end header anchors the stored hashes, so it is fetched first. A reorg after it leaves the
+	// anchor on the old chain, which validators detect, rather than anchoring old events on the new one
+	endHeader, err := s.blockCache.HeaderAt(ctx, endBlock)
+	if err != nil {
+		s.c.Metrics.incRPCErrors("eth_getBlockByNumber")
+		return nil, fmt.Errorf("error getting end block header: %w", err)
+	}
+	stageLogs, ranges, filters, err := s.getStageEventLogsAdaptive(ctx, lane, stageFilterRange{
+		start: uint64(startBlock),
+		end:   uint64(endBlock),
+	})
+	if err != nil {
+		s.c.Metrics.incRPCErrors("eth_getLogs")
+		return nil, fmt.Errorf("error getting event logs: %w", err)
+	}
+	blockInfo, err := s.getStageBlockInfo(ctx, stageLogs)
+	if err != nil {
+		s.c.Metrics.incRPCErrors("eth_getBlockByNumber")
+		return nil, fmt.Errorf("error getting block info: %w", err)
+	}
+	if block, err := checkBlockHashes(stageLogs, blockInfo, endHeader); err != nil {
+		// a cached block may be from before a reorg, so the retry must fetch it again
+		s.blockCache.InvalidateFrom(block)
+		return nil, err
+	}
+	var receipts map[common.Hash]*ReceiptInfo
+	if s.c.FetchReceipts {
+		receipts, err = s.getStageReceipts(ctx, stageLogs, blockInfo)
 		if err != nil {
-			log.Err(err).Msg("error getting block info")
-			continue
+			s.c.Metrics.incRPCErrors("eth_getBlockReceipts")
+			return nil, fmt.Errorf("error getting receipts: %w", err)
 		}
-		break
 	}
-	return &EventBatch{
-		progressLog: t.StageProgressLog,
-		Events:      stageLogs,
-		Blocks:      blockInfo,
+	if !persistSplits {
+		ranges = nil
 	}
+	return &EventBatch{
+		fromBlock: startBlock,
+		ranges:    ranges,
+		filters:   filters,
+		endHeader: endHeader,
+		Events:    stageLogs,
+		Blocks:    blockInfo,
+		Receipts:  receipts,
+	}, nil
 }
 
 func (s *Sprint) getStageBlockInfo(ctx context.Context, eventLogs []*ghost.ErigonLog) (map[int]*BlockInfo, error) {
 	blockSet := make(map[int][]common.Hash)
+	logHashes := make(map[int]common.Hash)
 	for _, eventLog := range eventLogs {
 		blockSet[int(eventLog.BlockNumber)] = append(blockSet[int(eventLog.BlockNumber)], eventLog.TxHash)
+		logHashes[int(eventLog.BlockNumber)] = eventLog.BlockHash
+	}
+	blocks, err := s.fetchStageBlocks(ctx, blockSet)
+	if err != nil {
+		return nil, err
+	}
+	stale := staleBlocks(blocks, blockSet, logHashes)
+	if len(stale) == 0 {
+		return blocks, nil
+	}
+	// blocks are cached by number, so a block cached before a reorg is served until it is invalidated
+	s.blockCache.InvalidateFrom(stale[0])
+	refetch := make(map[int][]common.Hash, len(stale))
+	for _, block := range stale {
+		refetch[block] = blockSet[block]
+	}
+	refetched, err := s.fetchStageBlocks(ctx, refetch)
+	if err != nil {
+		return nil, err
+	}
+	if stale := staleBlocks(refetched, refetch, logHashes); len(stale) > 0 {
+		// the logs are from a chain the node is no longer on, so the retry must query them again
+		s.blockCache.InvalidateFrom(stale[0])
+		return nil, fmt.Errorf("block %d does not match its logs", stale[0])
+	}
+	for block, blk := range refetched {
+		blocks[block] = blk
+	}
+	return blocks, nil
+}
+
+func (s *Sprint) fetchStageBlocks(ctx context.Context, blockSet map[int][]common.Hash) (map[int]*BlockInfo, error) {
+	switch {
+	case s.c.HeaderOnlyBlocks:
+		return s.blockCache.PartialBlocksAt(ctx, blockSet)
+	case s.c.MaxBatchSize > 1:
+		return s.getBlocksBatched(ctx, blockSet)
+	default:
+		return s.getBlocks(ctx, blockSet)
+	}
+}
+
+// Returns the blocks, in order, whose hash differs from the hash of their logs or that miss a
+// transaction of their logs
+func staleBlocks(blocks map[int]*BlockInfo, blockSet map[int][]common.Hash, logHashes map[int]common.Hash) []int {
+	var stale []int
+	for block, txs := range blockSet {
+		if blocks[block].Hash != logHashes[block] || !checkAllTxsExist(blocks[block], txs) {
+			stale = append(stale, block)
+		}
 	}
+	sort.Ints(stale)
+	return stale
+}
+
+func (s *Sprint) getBlocks(ctx context.Context, blockSet map[int][]common.Hash) (map[int]*BlockInfo, error) {
 	blocks := make(map[int]*BlockInfo, len(blockSet))
 	wg := errgroup.Group{}
 	m := sync.Mutex{}
@@ -280,9 +766,6 @@ func (s *Sprint) getStageBlockInfo(ctx context.Context, eventLogs []*ghost.Erigo
 			if err != nil {
 				return err
 			}
-			if !checkAllTxsExist(blk, blockSet[block]) {
-				return fmt.Errorf("missing transaction in block: %d", block)
-			}
 			m.Lock()
 			defer m.Unlock()
 			blocks[block] = blk
@@ -292,20 +775,35 @@ func (s *Sprint) getStageBlockInfo(ctx context.Context, eventLogs []*ghost.Erigo
 	return blocks, wg.Wait()
 }
 
-func (s *Sprint) getStageEventLogs(ctx context.Context, start, stop int) ([]*ghost.ErigonLog, error) {
-	filters := s.m.GetStageFilters(start, stop)
+func (s *Sprint) getBlocksBatched(ctx context.Context, blockSet map[int][]common.Hash) (map[int]*BlockInfo, error) {
+	numbers := make([]int, 0, len(blockSet))
+	for block := range blockSet {
+		numbers = append(numbers, block)
+	}
+	sort.Ints(numbers)
+	return s.blockCache.BlocksAt(ctx, numbers)
+}
+
+// Returns the logs of the stage along with the filters they were queried with
+func (s *Sprint) getStageEventLogs(ctx context.Context, lane string, start, stop int) ([]*ghost.ErigonLog, []ethereum.FilterQuery, error) {
+	filters := s.stageFilters(lane, start, stop)
 	var allLogs []*ghost.ErigonLog
-	m := sync.Mutex{}
-	getLogs := func(ctx context.Context, f ethereum.FilterQuery) error {
-		logs, err := s.getLogs(ctx, f)
-		m.Lock()
-		defer m.Unlock()
-		allLogs = append(allLogs, logs...)
-		return err
+	var err error
+	if s.c.MaxBatchSize > 1 && len(filters) > 1 {
+		allLogs, err = s.getLogsBatched(ctx, filters)
+	} else {
+		m := sync.Mutex{}
+		getLogs := func(ctx context.Context, f ethereum.FilterQuery) error {
+			logs, err := s.getLogs(ctx, f)
+			m.Lock()
+			defer m.Unlock()
+			allLogs = append(allLogs, logs...)
+			return err
+		}
+		err = concurrency.DoContext(ctx, len(filters), getLogs, filters...)
 	}
-	err := concurrency.DoContext(ctx, len(filters), getLogs, filters...)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	sort.SliceStable(allLogs, func(i, j int) bool {
 		if allLogs[i].BlockNumber != allLogs[j].BlockNumber {
@@ -313,6 +811,31 @@ func (s *Sprint) getStageEventLogs(ctx context.Context, start, stop int) ([]*gho
 		}
 		return allLogs[i].Index < allLogs[j].Index
 	})
+	return allLogs, filters, nil
+}
+
+// Queries every filter in JSON-RPC batches. The first failed query fails the whole stage, so
+// range limit errors still bisect the stage
+func (s *Sprint) getLogsBatched(ctx context.Context, filters []ethereum.FilterQuery) ([]*ghost.ErigonLog, error) {
+	elems := make([]*jrpc.BatchElem, len(filters))
+	for i, f := range filters {
+		elems[i] = &jrpc.BatchElem{
+			Method: "eth_getLogs",
+			Params: []any{toGethFilter(f)},
+			Result: &[]*ghost.ErigonLog{},
+		}
+	}
+	err := s.blockCache.batchCall(ctx, elems)
+	if err != nil {
+		return nil, err
+	}
+	var allLogs []*ghost.ErigonLog
+	for _, el := range elems {
+		if el.Error != nil {
+			return nil, el.Error
+		}
+		allLogs = append(allLogs, *el.Result.(*[]*ghost.ErigonLog)...)
+	}
 	return allLogs, nil
 }
 
@@ -327,27 +850,78 @@ func (s *Sprint) getLogs(ctx context.Context, f ethereum.FilterQuery) ([]*ghost.
 }
 
 func (s *Sprint) validateTask(ctx context.Context, t *task) *EventBatch {
-	var stageLogs []*ghost.ErigonLog
-	var blockInfo map[int]*BlockInfo
+	prog := t.StageProgressLog
+	finalized := s.isFinalized(prog.EndBlock)
+	fetchStart := time.Now()
+	var batch *EventBatch
 	var err error
-	for {
-		stageLogs, err = s.getStageEventLogs(ctx, t.StageProgressLog.StartBlock, t.StageProgressLog.EndBlock)
-		if err != nil {
-			log.Err(err).Msg("error getting event logs")
-			continue
+	for attempt := 1; ; attempt++ {
+		batch, err = s.validateRange(ctx, prog.Lane, prog.StartBlock, prog.EndBlock)
+		if err == nil {
+			break
 		}
-		blockInfo, err = s.getStageBlockInfo(ctx, stageLogs)
-		if err != nil {
-			log.Err(err).Msg("error getting block info")
-			continue
+		// abandon the task when sprint is stopped mid-fetch
+		if ctx.Err() != nil {
+			return nil
 		}
-		break
+		log.Err(err).Int("start_block", prog.StartBlock).Int("end_block", prog.EndBlock).Int("attempt", attempt).Msg("error validating range")
+		if !s.c.Retry.wait(ctx, attempt) {
+			if ctx.Err() != nil {
+				return nil
+			}
+			// out of attempts, the validation sequencer releases the range for a later pass
+			return &EventBatch{progressLog: prog, fromBlock: prog.StartBlock, finalizing: t.finalizing, err: err}
+		}
+		s.c.Metrics.incRetries(t.kind())
 	}
-	return &EventBatch{
-		progressLog: t.StageProgressLog,
-		Events:      stageLogs,
-		Blocks:      blockInfo,
+	s.c.Metrics.observeFetch(t.kind(), time.Since(fetchStart))
+	batch.progressLog = prog
+	batch.finalized = finalized
+	batch.finalizing = t.finalizing
+	batch.backfill = s.backfillLane(prog.Lane)
+	return batch
+}
+
+// Fetches the range of an upload batch again, see ErrStaleFilters
+func (s *Sprint) refetchUpload(ctx context.Context, batch *EventBatch) error {
+	prog := batch.progressLog
+	fresh, err := s.fetchRange(ctx, prog.Lane, prog.StartBlock, prog.EndBlock, true)
+	if err != nil {
+		return err
+	}
+	batch.refetched(fresh)
+	return nil
+}
+
+// Fetches the range of a validation batch again from its fork block, see ErrStaleFilters
+func (s *Sprint) refetchValidation(ctx context.Context, batch *EventBatch) error {
+	fresh, err := s.fetchRange(withValidation(ctx), batch.progressLog.Lane, batch.fromBlock, batch.progressLog.EndBlock, false)
+	if err != nil {
+		return err
+	}
+	batch.refetched(fresh)
+	return nil
+}
+
+func (s *Sprint) validateRange(ctx context.Context, lane string, startBlock, endBlock int) (*EventBatch, error) {
+	// compare stored block hashes against the chain first, so we only re-query logs
+	// from the block the chain forked off at. Pools with a quorum check the headers as well
+	fromBlock, reorged, err := s.findForkBlock(withValidation(ctx), lane, startBlock, endBlock)
+	if err != nil {
+		s.c.Metrics.incRPCErrors("eth_getBlockByNumber")
+		return nil, fmt.Errorf("error finding fork block: %w", err)
+	}
+	if !reorged {
+		return &EventBatch{
+			fromBlock: fromBlock,
+			canonical: true,
+		}, nil
 	}
+	// cached blocks from the fork onwards may belong to the reorged chain
+	s.blockCache.InvalidateFrom(fromBlock)
+	// splits are only persisted when executing, validators just bisect in memory. Pools with a quorum
+	// check the refetched logs against several endpoints
+	return s.fetchRange(withValidation(ctx), lane, fromBlock, endBlock, false)
 }
 
 func (s *Sprint) updateValidatorProgress(validatorID int, endBlock int) {
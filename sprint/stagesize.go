@@ -0,0 +1,151 @@
+package sprint
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"gfx.cafe/open/ghost"
+	"github.com/ethereum/go-ethereum"
+	"github.com/upper/db/v4"
+	"tuxpa.in/a/zlog/log"
+)
+
+// Error fragments returned by providers when an eth_getLogs query covers too many results or too
+// large a response. These are only recoverable by querying a smaller block range.
+var rangeLimitErrors = []string{
+	// geth, erigon, infura
+	"query returned more than",
+	// alchemy
+	"log response size exceeded",
+	"response size exceeded",
+	// bsc
+	"response size should not greater than",
+	"exceed maximum block range",
+	"block range is too large",
+	"block range too large",
+	"query exceeds max results",
+	"result window is too large",
+}
+
+func isRangeLimitError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	for _, frag := range rangeLimitErrors {
+		if strings.Contains(msg, frag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Splits an inclusive block range into two halves, returning false if it is a single block or its size
+// is below minBlocks
+func bisectRange(rng stageFilterRange, minBlocks uint64) (stageFilterRange, stageFilterRange, bool) {
+	if rng.size() < minBlocks || rng.end == rng.start {
+		return stageFilterRange{}, stageFilterRange{}, false
+	}
+	mid := rng.start + rng.size()/2
+	return stageFilterRange{start: rng.start, end: mid}, stageFilterRange{start: mid + 1, end: rng.end}, true
+}
+
+// Fetches stage logs, recursively bisecting the range whenever the provider rejects it for returning
+// too many results. Returns the logs in order along with the sub-ranges that were actually queried
+// and the filters they were queried with.
+func (s *Sprint) getStageEventLogsAdaptive(ctx context.Context, lane string, rng stageFilterRange) ([]*ghost.ErigonLog, []stageFilterRange, []ethereum.FilterQuery, error) {
+	logs, filters, err := s.getStageEventLogs(ctx, lane, int(rng.start), int(rng.end))
+	if err == nil {
+		return logs, []stageFilterRange{rng}, filters, nil
+	}
+	if !isRangeLimitError(err) {
+		return nil, nil, nil, err
+	}
+	lower, upper, ok := bisectRange(rng, s.minStageBlocks())
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("range %d-%d cannot be split further: %w", rng.start, rng.end, err)
+	}
+	log.Debug().Uint64("start_block", rng.start).Uint64("end_block", rng.end).Msg("range too large, bisecting")
+	lowerLogs, lowerRanges, lowerFilters, err := s.getStageEventLogsAdaptive(ctx, lane, lower)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	upperLogs, upperRanges, upperFilters, err := s.getStageEventLogsAdaptive(ctx, lane, upper)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// both halves are sorted and the lower half strictly precedes the upper one
+	return append(lowerLogs, upperLogs...), append(lowerRanges, upperRanges...), append(lowerFilters, upperFilters...), nil
+}
+
+func (s *Sprint) minStageBlocks() uint64 {
+	if s.c.MinBlocksPerStage == 0 {
+		return 1
+	}
+	return s.c.MinBlocksPerStage
+}
+
+func (s *Sprint) maxStageBlocks() uint64 {
+	if s.c.MaxBlocksPerStage == 0 {
+		return s.c.BlocksPerStage
+	}
+	return s.c.MaxBlocksPerStage
+}
+
+// ranges with fewer events than this grow the stage size back unless SparseStageEvents is set
+const defaultSparseStageEvents = 100
+
+func (s *Sprint) sparseStageEvents() int {
+	if s.c.SparseStageEvents == 0 {
+		return defaultSparseStageEvents
+	}
+	return s.c.SparseStageEvents
+}
+
+// Adjusts the size of newly scheduled stages based on the outcome of an executed range. Ranges that had
+// to be split shrink the stage size to the largest piece that succeeded, and sparse ranges grow it back
+func (s *Sprint) adjustStageSize(ranges []stageFilterRange, eventCount int) {
+	curr := s.stageSize.Load()
+	next := curr
+	if len(ranges) > 1 {
+		largest := uint64(0)
+		for _, rng := range ranges {
+			if size := rng.size(); size > largest {
+				largest = size
+			}
+		}
+		if largest < next {
+			next = largest
+		}
+	} else if sparse := s.sparseStageEvents(); sparse > 0 && eventCount < sparse {
+		next = curr * 2
+	}
+	if next < s.minStageBlocks() {
+		next = s.minStageBlocks()
+	}
+	if max := s.maxStageBlocks(); next > max {
+		next = max
+	}
+	if next != curr && s.stageSize.CompareAndSwap(curr, next) && s.c.Verbose {
+		log.Info().Uint64("previous", curr).Uint64("blocks_per_stage", next).Msg("adjusted stage size")
+	}
+}
+
+// Replaces a progress row with one row per sub-range it was split into, so that validators and later
+// passes over the range query the smaller pieces directly
+func (s *Sprint) splitProgressRange(ctx context.Context, tx db.Session, prog *StageProgressLog, ranges []stageFilterRange) error {
+	parts, err := createScheduleLogs(prog.Lane, ranges)
+	if err != nil {
+		return err
+	}
+	for _, part := range parts {
+		part.StartTs = prog.StartTs
+		part.EndTs = prog.EndTs
+		part.Success = prog.Success
+		part.ValidatorPasses = prog.ValidatorPasses
+		part.Msg = fmt.Sprintf("Split from %s at %s", prog.PrimaryKey, time.Now().String())
+	}
+	return s.store.SplitProgress(ctx, tx, prog, parts)
+}
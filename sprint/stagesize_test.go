@@ -0,0 +1,73 @@
+package sprint
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestIsRangeLimitError(t *testing.T) {
+	cases := map[string]bool{
+		"query returned more than 10000 results":                        true,
+		"Log response size exceeded. You can make eth_getLogs requests": true,
+		"exceed maximum block range: 5000":                              true,
+		"429 Too Many Requests":                                         false,
+		"context deadline exceeded":                                     false,
+	}
+	for msg, want := range cases {
+		if got := isRangeLimitError(errors.New(msg)); got != want {
+			t.Errorf("isRangeLimitError(%q) = %v, want %v", msg, got, want)
+		}
+	}
+	if isRangeLimitError(nil) {
+		t.Error("nil error should not be a range limit error")
+	}
+}
+
+func TestBisectRange(t *testing.T) {
+	lower, upper, ok := bisectRange(stageFilterRange{start: 100, end: 199}, 1)
+	if !ok {
+		t.Fatal("expected range to be split")
+	}
+	if lower.start != 100 || lower.end != 149 || upper.start != 150 || upper.end != 199 {
+		t.Fatalf("unexpected halves %+v %+v", lower, upper)
+	}
+	if _, _, ok := bisectRange(stageFilterRange{start: 5, end: 5}, 1); ok {
+		t.Fatal("single block range should not be split")
+	}
+	if _, _, ok := bisectRange(stageFilterRange{start: 0, end: 9}, 10); ok {
+		t.Fatal("range below the minimum size should not be split")
+	}
+	if _, _, ok := bisectRange(stageFilterRange{start: 0, end: 10}, 10); !ok {
+		t.Fatal("range at the minimum size should be split")
+	}
+}
+
+func TestAdjustStageSizeRecovers(t *testing.T) {
+	s, err := NewSprintWithStore(context.Background(), nil, nil, &SprintConfig{
+		BlocksPerStage:  99,
+		Workers:         1,
+		ExecuteInterval: 1,
+	}, NewMemoryProgressStore(), headManager(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a range bisected into quarters
+	s.adjustStageSize([]stageFilterRange{{0, 24}, {25, 49}, {50, 74}, {75, 99}}, 5000)
+	if size := s.stageSize.Load(); size != 24 {
+		t.Fatalf("expected the stage size to shrink to 24, got %d", size)
+	}
+	// sparse ranges grow it back by default, up to BlocksPerStage
+	for i := 0; i < 4; i++ {
+		s.adjustStageSize([]stageFilterRange{{0, 24}}, 10)
+	}
+	if size := s.stageSize.Load(); size != 99 {
+		t.Fatalf("expected the stage size to recover to 99, got %d", size)
+	}
+	s.c.SparseStageEvents = -1
+	s.adjustStageSize([]stageFilterRange{{0, 24}, {25, 49}}, 5000)
+	s.adjustStageSize([]stageFilterRange{{0, 24}}, 10)
+	if size := s.stageSize.Load(); size != 24 {
+		t.Fatalf("expected growth to be disabled, got %d", size)
+	}
+}
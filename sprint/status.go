@@ -1,6 +1,7 @@
 package sprint
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -8,19 +9,30 @@ import (
 	"tuxpa.in/a/zlog/log"
 )
 
-// loops and logs status of sprint and validator every 5 seconds
-func (s *Sprint) logLoop() {
+// loops and logs status of sprint and validator every 5 seconds until the context is cancelled
+func (s *Sprint) logLoop(ctx context.Context) {
 	if !s.c.Verbose {
 		return
 	}
 	logInterval := time.NewTicker(5 * time.Second)
+	defer logInterval.Stop()
 	for {
-		<-logInterval.C
+		select {
+		case <-ctx.Done():
+			return
+		case <-logInterval.C:
+		}
 		if !s.c.Verbose {
 			continue
 		}
 		statusLog := log.Debug().Int64("chain_head", int64(s.m.CurrentBlock())).
 			Int64("sprint_head", s.lastSuccessfulBlock.Load())
+		if s.c.FinalityTag != "" {
+			statusLog = statusLog.Uint64("finalized_block", s.FinalizedBlock())
+		}
+		for name, head := range s.LaneHeads() {
+			statusLog = statusLog.Int64("lane_"+name, head)
+		}
 		for i := range s.validatorBlockStatus {
 			statusLog = statusLog.Int64(fmt.Sprintf("validator_%d", i), s.validatorBlockStatus[i].Load())
 		}
@@ -50,6 +62,7 @@ func getProgressLog(b *EventBatch) *zlog.Event {
 	prog := b.progressLog
 	logInfo := log.Info().Int("start_block", prog.StartBlock).
 		Int("end_block", prog.EndBlock).
+		Str("lane", prog.Lane).
 		Float64("duration (s)", prog.EndTs.Sub(prog.StartTs).Seconds()).
 		Float64("block_time (s)", calculateBlockTime(prog.StartTs, prog.EndTs, prog.StartBlock, prog.EndBlock)).
 		Int("event_count", len(b.Events))
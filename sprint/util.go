@@ -1,6 +1,10 @@
 package sprint
 
 import (
+	"errors"
+	"strings"
+	"sync/atomic"
+
 	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/holiman/uint256"
@@ -18,8 +22,36 @@ func toGethFilter(e ethereum.FilterQuery) map[string]any {
 	return m
 }
 
-func onConflictDoNothing(s string) string {
-	return s + " ON CONFLICT DO NOTHING"
+// rpcError is implemented by errors the JSON-RPC server returned in its response
+type rpcError interface {
+	error
+	ErrorCode() int
+}
+
+// Returns the JSON-RPC error code of an error returned by the server
+func rpcErrorCode(err error) (int, bool) {
+	var rpcErr rpcError
+	if errors.As(err, &rpcErr) {
+		return rpcErr.ErrorCode(), true
+	}
+	return 0, false
+}
+
+// SQLDialect selects the SQL syntax of stores kept in an upper/db session
+type SQLDialect int
+
+const (
+	DialectPostgres SQLDialect = iota
+	DialectSQLite
+)
+
+// IgnoreConflicts rewrites an insert statement so rows conflicting with existing rows are skipped, for
+// use with upper/db's Amend
+func (d SQLDialect) IgnoreConflicts(stmt string) string {
+	if d == DialectSQLite {
+		return strings.Replace(stmt, "INSERT INTO", "INSERT OR IGNORE INTO", 1)
+	}
+	return stmt + " ON CONFLICT DO NOTHING"
 }
 
 func checkAllTxsExist(block *BlockInfo, txs []common.Hash) bool {
@@ -30,3 +62,13 @@ func checkAllTxsExist(block *BlockInfo, txs []common.Hash) bool {
 	}
 	return true
 }
+
+// Raises a head to n, leaving heads that are already higher in place
+func storeMax(head *atomic.Int64, n int64) {
+	for {
+		curr := head.Load()
+		if curr >= n || head.CompareAndSwap(curr, n) {
+			return
+		}
+	}
+}